@@ -0,0 +1,363 @@
+package api
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/logging"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/mailer"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/middleware"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/store"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/utils"
+)
+
+// AccountHandler lets users take their data with them (GET /users/me/export) and delete their account (DELETE /users/me).
+type AccountHandler struct {
+	userStore   store.UserStore
+	tokenStore  store.TokenStore
+	exportStore store.ExportStore
+	mailer      mailer.Mailer
+	background  *sync.WaitGroup // Emails go out in the background, tracked here so shutdown waits for them
+	gracePeriod time.Duration   // How long a deleted account can still be recovered by logging in
+	auditor     *Auditor
+}
+
+// Constructor for AccountHandler
+func NewAccountHandler(userStore store.UserStore, tokenStore store.TokenStore, exportStore store.ExportStore, mail mailer.Mailer, background *sync.WaitGroup, gracePeriod time.Duration, auditor *Auditor) *AccountHandler {
+	return &AccountHandler{
+		userStore:   userStore,
+		tokenStore:  tokenStore,
+		exportStore: exportStore,
+		mailer:      mail,
+		background:  background,
+		gracePeriod: gracePeriod,
+		auditor:     auditor,
+	}
+}
+
+// Streams a ZIP of everything the user has:
+//
+//	profile.json        the account
+//	notes/<folders>/    one Markdown file per note, in the same folder hierarchy as in the app
+//	trash/<folders>/    the same for notes and folders in the trash
+//	metadata.json       IDs, tags, favorites and timestamps of every folder and note, with their path in the ZIP
+func (ah *AccountHandler) HandleExportAccount(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+	if currentUser.IsAnonymous() {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
+		return
+	}
+
+	// Large accounts take longer than the server's usual write timeout
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	export := newZipExport(w, currentUser)
+	err := ah.exportStore.ExportUserData(r.Context(), currentUser.ID, export)
+	if err == nil {
+		err = export.finish()
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error exporting data", "error", err)
+		if !export.started {
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to export account"}) // 500
+		}
+		// Otherwise the ZIP is already on its way; it ends up truncated and fails to open
+		return
+	}
+	ah.auditor.Record(r, store.AuditAccountExported, userTarget(currentUser.ID), nil, nil)
+}
+
+// Schedules the account for deletion: {"password": "..."}.
+// The user is logged out everywhere and everything is purged once the grace period is over, unless they log in before.
+func (ah *AccountHandler) HandleDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+	if currentUser.IsAnonymous() {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
+		return
+	}
+
+	var req struct {
+		Password string `json:"password"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Password == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "password is required"}) // 400
+		return
+	}
+
+	// The session alone is not enough, it might have been left open on someone else's computer
+	passwordsDoMatch, err := currentUser.PasswordHash.Matches(req.Password)
+	if err != nil || !passwordsDoMatch {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Invalid credentials"}) // 401
+		return
+	}
+
+	deleteAt := time.Now().Add(ah.gracePeriod)
+	err = ah.userStore.ScheduleUserDeletion(currentUser.ID, deleteAt)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error scheduling deletion", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to delete account"}) // 500
+		return
+	}
+
+	// Logging in again is how the deletion gets cancelled, so no session may stay open
+	_, err = ah.tokenStore.DeleteAllSessions(currentUser.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error revoking sessions", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"}) // 500
+		return
+	}
+	logging.FromContext(r.Context()).Info("Account scheduled for deletion", "delete_at", deleteAt)
+	ah.auditor.Record(r, store.AuditAccountDeletionScheduled, userTarget(currentUser.ID), nil, utils.Envelope{"delete_at": deleteAt})
+
+	msg := mailer.Message{
+		To:      currentUser.Email,
+		Subject: "Your account will be deleted",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"Your notes account and everything in it will be permanently deleted on %s.\n\n"+
+			"Changed your mind? Log in before then and the deletion is cancelled.\n",
+			currentUser.Username, deleteAt.UTC().Format("January 2, 2006 at 15:04 MST")),
+	}
+	ah.background.Go(func() {
+		err := ah.mailer.Send(msg)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Error sending account deletion email", "error", err)
+		}
+	})
+
+	utils.WriteJSON(w, http.StatusAccepted, utils.Envelope{
+		"message":               "Your account will be deleted. Log in before then to cancel.",
+		"deletion_scheduled_at": deleteAt,
+	}) // 202
+}
+
+// zipExport is the store.ExportWriter behind HandleExportAccount
+type zipExport struct {
+	w       http.ResponseWriter
+	zw      *zip.Writer
+	user    *store.User
+	started bool // set once the response has been sent, errors can no longer be reported
+
+	folderPaths map[int]string  // folder ID -> directory in the ZIP, without the notes/ or trash/ root
+	taken       map[string]bool // lowercased paths already in the ZIP
+
+	metadata exportMetadata
+}
+
+type exportMetadata struct {
+	ExportedAt time.Time        `json:"exported_at"`
+	Folders    []exportedFolder `json:"folders"`
+	Notes      []exportedNote   `json:"notes"`
+}
+
+type exportedFolder struct {
+	ID             int     `json:"id"`
+	Title          string  `json:"title"`
+	Path           string  `json:"path"`
+	ParentFolderID *int64  `json:"parent_folder_id"`
+	IsFavorite     bool    `json:"is_favorite"`
+	CreatedAt      string  `json:"created_at"`
+	UpdatedAt      string  `json:"updated_at"`
+	DeletedAt      *string `json:"deleted_at"`
+}
+
+type exportedNote struct {
+	ID         int      `json:"id"`
+	Title      string   `json:"title"`
+	Path       string   `json:"path"`
+	FolderID   *int     `json:"folder_id"`
+	Tags       []string `json:"tags"`
+	IsFavorite bool     `json:"is_favorite"`
+	CreatedAt  string   `json:"created_at"`
+	UpdatedAt  string   `json:"updated_at"`
+	DeletedAt  *string  `json:"deleted_at"`
+}
+
+func newZipExport(w http.ResponseWriter, user *store.User) *zipExport {
+	return &zipExport{
+		w:           w,
+		user:        user,
+		folderPaths: make(map[int]string),
+		taken:       make(map[string]bool),
+		metadata: exportMetadata{
+			ExportedAt: time.Now().UTC(),
+			Folders:    []exportedFolder{},
+			Notes:      []exportedNote{},
+		},
+	}
+}
+
+// start sends the headers and profile.json once the data is known to be readable
+func (e *zipExport) start() error {
+	filename := fmt.Sprintf("notes-export-%s.zip", e.metadata.ExportedAt.Format(time.DateOnly))
+	e.w.Header().Set("Content-Type", "application/zip")
+	e.w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	e.w.Header().Set("Cache-Control", "no-store")
+	e.w.WriteHeader(http.StatusOK)
+	e.started = true
+
+	e.zw = zip.NewWriter(e.w)
+	return e.writeJSON("profile.json", e.user)
+}
+
+func (e *zipExport) WriteFolders(folders []*store.Folder) error {
+	if err := e.start(); err != nil {
+		return err
+	}
+
+	byID := make(map[int]*store.Folder, len(folders))
+	for _, folder := range folders {
+		byID[folder.ID] = folder
+	}
+
+	// resolve works out a folder's path from its parent's, which may not have been seen yet
+	var resolve func(folder *store.Folder, depth int) string
+	resolve = func(folder *store.Folder, depth int) string {
+		if p, ok := e.folderPaths[folder.ID]; ok {
+			return p
+		}
+		parentPath := ""
+		if folder.ParentFolderID.Valid && depth < 100 {
+			if parent, ok := byID[int(folder.ParentFolderID.Int64)]; ok {
+				parentPath = resolve(parent, depth+1)
+			}
+		}
+		p := e.unique(path.Join(parentPath, exportFileName(folder.Title)), "")
+		e.folderPaths[folder.ID] = p
+		return p
+	}
+
+	for _, folder := range folders {
+		dir := exportRoot(folder.DeletedAt) + "/" + resolve(folder, 0) + "/"
+		_, err := e.zw.CreateHeader(&zip.FileHeader{Name: dir, Modified: parseExportTime(folder.UpdatedAt)})
+		if err != nil {
+			return err
+		}
+
+		var parentID *int64
+		if folder.ParentFolderID.Valid {
+			parentID = &folder.ParentFolderID.Int64
+		}
+		e.metadata.Folders = append(e.metadata.Folders, exportedFolder{
+			ID:             folder.ID,
+			Title:          folder.Title,
+			Path:           dir,
+			ParentFolderID: parentID,
+			IsFavorite:     folder.IsFavorite,
+			CreatedAt:      folder.CreatedAt,
+			UpdatedAt:      folder.UpdatedAt,
+			DeletedAt:      folder.DeletedAt,
+		})
+	}
+	return nil
+}
+
+func (e *zipExport) WriteNote(note *store.Note) error {
+	dir := ""
+	if note.FolderID != nil {
+		dir = e.folderPaths[*note.FolderID]
+	}
+	name := exportRoot(note.DeletedAt) + "/" + e.unique(path.Join(dir, exportFileName(note.Title)), ".md")
+
+	f, err := e.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: parseExportTime(note.UpdatedAt)})
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte(note.Content))
+	if err != nil {
+		return err
+	}
+
+	tags := note.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	e.metadata.Notes = append(e.metadata.Notes, exportedNote{
+		ID:         note.ID,
+		Title:      note.Title,
+		Path:       name,
+		FolderID:   note.FolderID,
+		Tags:       tags,
+		IsFavorite: note.IsFavorite,
+		CreatedAt:  note.CreatedAt,
+		UpdatedAt:  note.UpdatedAt,
+		DeletedAt:  note.DeletedAt,
+	})
+	return nil
+}
+
+// finish writes metadata.json and the ZIP's central directory
+func (e *zipExport) finish() error {
+	if !e.started {
+		if err := e.start(); err != nil {
+			return err
+		}
+	}
+	if err := e.writeJSON("metadata.json", e.metadata); err != nil {
+		return err
+	}
+	return e.zw.Close()
+}
+
+func (e *zipExport) writeJSON(name string, v any) error {
+	f, err := e.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: e.metadata.ExportedAt})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// unique returns p+ext, or p+" (2)"+ext and so on if that is already taken. Paths are compared case-insensitively
+// since most file systems the ZIP gets extracted on do.
+func (e *zipExport) unique(p, ext string) string {
+	candidate := p + ext
+	for i := 2; e.taken[strings.ToLower(candidate)]; i++ {
+		candidate = fmt.Sprintf("%s (%d)%s", p, i, ext)
+	}
+	e.taken[strings.ToLower(candidate)] = true
+	return candidate
+}
+
+// exportRoot is the top-level directory for an item, depending on whether it is in the trash
+func exportRoot(deletedAt *string) string {
+	if deletedAt != nil {
+		return "trash"
+	}
+	return "notes"
+}
+
+// exportFileName turns a title into something every file system accepts as a file or directory name
+func exportFileName(title string) string {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, title)
+	name = strings.Trim(name, " .")
+	if runes := []rune(name); len(runes) > 100 {
+		name = strings.TrimRight(string(runes[:100]), " .")
+	}
+	if name == "" {
+		return "Untitled"
+	}
+	return name
+}
+
+func parseExportTime(value string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Now()
+	}
+	return t
+}
@@ -0,0 +1,296 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/events"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/logging"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/middleware"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/store"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/utils"
+)
+
+// AdminHandler serves the /admin routes. Every route is behind RequireRole(store.RoleAdmin),
+// and every change is recorded in the audit trail.
+type AdminHandler struct {
+	userStore      store.UserStore
+	adminStore     store.AdminStore
+	tokenStore     store.TokenStore
+	apiTokenStore  store.APITokenStore
+	passwordResets *PasswordResetHandler // Sends the reset link for forced password resets
+	events         events.Publisher
+	auditor        *Auditor
+}
+
+// Constructor for AdminHandler
+func NewAdminHandler(userStore store.UserStore, adminStore store.AdminStore, tokenStore store.TokenStore, apiTokenStore store.APITokenStore, passwordResets *PasswordResetHandler, publisher events.Publisher, auditor *Auditor) *AdminHandler {
+	return &AdminHandler{
+		userStore:      userStore,
+		adminStore:     adminStore,
+		tokenStore:     tokenStore,
+		apiTokenStore:  apiTokenStore,
+		passwordResets: passwordResets,
+		events:         publisher,
+		auditor:        auditor,
+	}
+}
+
+// Lists users by ID: ?q=<search>&suspended=true|false&limit=50&cursor=...
+func (ah *AdminHandler) HandleListUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	opts := store.UserListOptions{
+		Search: query.Get("q"),
+		Cursor: query.Get("cursor"),
+	}
+
+	limit, err := utils.ReadIntQueryParam(r, "limit", store.DefaultListLimit)
+	if err != nil || limit < 1 || limit > store.MaxListLimit {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "limit must be between 1 and " + strconv.Itoa(store.MaxListLimit)}) // 400
+		return
+	}
+	opts.Limit = limit
+
+	if value := query.Get("suspended"); value != "" {
+		suspended, err := strconv.ParseBool(value)
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid suspended parameter"}) // 400
+			return
+		}
+		opts.Suspended = &suspended
+	}
+
+	users, nextCursor, err := ah.adminStore.ListUsers(opts)
+	if errors.Is(err, store.ErrInvalidCursor) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()}) // 400
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error listing users", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to list users"}) // 500
+		return
+	}
+
+	// next_cursor is null on the last page
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"users": users, "next_cursor": cursorOrNil(nextCursor)}) // 200
+}
+
+// A user along with how much they store and how they are logged in
+func (ah *AdminHandler) HandleGetUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := ah.readTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	stats, err := ah.adminStore.GetUserStats(user.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error fetching user stats", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to fetch user"}) // 500
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"user": user, "role": user.Role(), "stats": stats}) // 200
+}
+
+// Changes a user's role: {"role": "moderator"}
+func (ah *AdminHandler) HandleUpdateUserRole(w http.ResponseWriter, r *http.Request) {
+	user, ok := ah.readTargetUser(w, r)
+	if !ok || !ah.notSelf(w, r, user) {
+		return
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid request payload"}) // 400
+		return
+	}
+	role, ok := store.ParseRole(req.Role)
+	if !ok {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "role must be one of user, moderator or admin"}) // 400
+		return
+	}
+
+	err = ah.userStore.UpdateUserRole(user.ID, role)
+	if !ah.checkUpdate(w, r, err, "Error updating user role") {
+		return
+	}
+	ah.auditor.Record(r, store.AuditAdminChangeRole, userTarget(user.ID), utils.Envelope{"role": user.Role()}, utils.Envelope{"role": role})
+
+	publish(ah.events, r, events.UserUpdated, utils.Envelope{"id": user.ID}, user.ID)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"id": user.ID, "role": role, "auth_level": role.AuthLevel()}) // 200
+}
+
+// Suspends a user: {"reason": "..."} (optional). They are logged out and cannot log in until unsuspended.
+// Their personal access tokens stop working too, but are kept for when the suspension is lifted.
+func (ah *AdminHandler) HandleSuspendUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := ah.readTargetUser(w, r)
+	if !ok || !ah.notSelf(w, r, user) {
+		return
+	}
+
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	// The body is optional
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid request payload"}) // 400
+			return
+		}
+	}
+
+	err := ah.userStore.SetUserSuspended(user.ID, true)
+	if !ah.checkUpdate(w, r, err, "Error suspending user") {
+		return
+	}
+	sessions, err := ah.tokenStore.DeleteAllSessions(user.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error revoking sessions of user", "target_user_id", user.ID, "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"}) // 500
+		return
+	}
+	ah.auditor.Record(r, store.AuditAdminSuspend, userTarget(user.ID), nil, utils.Envelope{"reason": strings.TrimSpace(req.Reason), "revoked_tokens": sessions})
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "User has been suspended"}) // 200
+}
+
+func (ah *AdminHandler) HandleUnsuspendUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := ah.readTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := ah.userStore.SetUserSuspended(user.ID, false)
+	if !ah.checkUpdate(w, r, err, "Error unsuspending user") {
+		return
+	}
+	ah.auditor.Record(r, store.AuditAdminUnsuspend, userTarget(user.ID), nil, nil)
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "User is no longer suspended"}) // 200
+}
+
+// Logs the user out everywhere, personal access tokens included, refuses their password until they reset it
+// and emails them a reset link.
+func (ah *AdminHandler) HandleForcePasswordReset(w http.ResponseWriter, r *http.Request) {
+	user, ok := ah.readTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := ah.userStore.RequirePasswordReset(user.ID)
+	if !ah.checkUpdate(w, r, err, "Error requiring password reset") {
+		return
+	}
+	user.PasswordResetRequired = true
+
+	// The account may be compromised, and tokens created by whoever got in would outlive the new password
+	var sessions, apiTokens int64
+	sessions, err = ah.tokenStore.DeleteAllSessions(user.ID)
+	if err == nil {
+		apiTokens, err = ah.apiTokenStore.DeleteAllAPITokens(user.ID)
+	}
+	if err == nil {
+		err = ah.passwordResets.SendResetLink(r.Context(), user)
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error forcing password reset of user", "target_user_id", user.ID, "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"}) // 500
+		return
+	}
+	ah.auditor.Record(r, store.AuditAdminPasswordReset, userTarget(user.ID), nil, utils.Envelope{"revoked_tokens": sessions, "revoked_api_tokens": apiTokens})
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "A password reset link has been sent to the user"}) // 200
+}
+
+// Revokes every session and personal access token of the user
+func (ah *AdminHandler) HandleRevokeUserTokens(w http.ResponseWriter, r *http.Request) {
+	user, ok := ah.readTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	sessions, err := ah.tokenStore.DeleteAllSessions(user.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error revoking sessions of user", "target_user_id", user.ID, "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"}) // 500
+		return
+	}
+	apiTokens, err := ah.apiTokenStore.DeleteAllAPITokens(user.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error revoking API tokens of user", "target_user_id", user.ID, "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"}) // 500
+		return
+	}
+	ah.auditor.Record(r, store.AuditAdminRevokeTokens, userTarget(user.ID), nil, utils.Envelope{"revoked_tokens": sessions, "revoked_api_tokens": apiTokens})
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"revoked_tokens": sessions, "revoked_api_tokens": apiTokens}) // 200
+}
+
+// Deletes the user and everything they own, immediately
+func (ah *AdminHandler) HandleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := ah.readTargetUser(w, r)
+	if !ok || !ah.notSelf(w, r, user) {
+		return
+	}
+
+	err := ah.userStore.DeleteUser(user.ID)
+	if !ah.checkUpdate(w, r, err, "Error deleting user") {
+		return
+	}
+	// The user is gone, so keep enough to tell later who it was
+	ah.auditor.Record(r, store.AuditAdminDeleteUser, userTarget(user.ID), userSummary(user), nil)
+
+	w.WriteHeader(http.StatusNoContent) // 204
+}
+
+// readTargetUser loads the user named by the {id} route parameter, writing the error response if there is none.
+func (ah *AdminHandler) readTargetUser(w http.ResponseWriter, r *http.Request) (*store.User, bool) {
+	userID, err := utils.ReadIDParam(r, "id")
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid user ID parameter"}) // 400
+		return nil, false
+	}
+
+	user, err := ah.userStore.GetUserById(int(userID))
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error fetching user", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to fetch user"}) // 500
+		return nil, false
+	}
+	if user == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "User not found"}) // 404
+		return nil, false
+	}
+	return user, true
+}
+
+// notSelf refuses actions admins could lock themselves out with, like demoting, suspending or deleting their own account.
+func (ah *AdminHandler) notSelf(w http.ResponseWriter, r *http.Request, user *store.User) bool {
+	if middleware.GetUser(r).ID == user.ID {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "admins cannot do this to their own account"}) // 400
+		return false
+	}
+	return true
+}
+
+// checkUpdate writes the error response for a failed user update. It returns true when err is nil.
+func (ah *AdminHandler) checkUpdate(w http.ResponseWriter, r *http.Request, err error, logMessage string) bool {
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "User not found"}) // 404
+		return false
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error(logMessage, "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"}) // 500
+		return false
+	}
+	return true
+}
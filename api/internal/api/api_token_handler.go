@@ -0,0 +1,145 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/logging"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/metrics"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/middleware"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/store"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/utils"
+)
+
+type APITokenHandler struct {
+	apiTokenStore store.APITokenStore
+	auditor       *Auditor
+	metrics       *metrics.Metrics
+}
+
+// Used for decoding create API token requests
+type createAPITokenRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"` // optional, no expiry when missing
+}
+
+// Constructor for APITokenHandler
+func NewAPITokenHandler(apiTokenStore store.APITokenStore, auditor *Auditor, metrics *metrics.Metrics) *APITokenHandler {
+	return &APITokenHandler{
+		apiTokenStore: apiTokenStore,
+		auditor:       auditor,
+		metrics:       metrics,
+	}
+}
+
+// Creates a personal access token. The token itself is only returned in this response.
+func (ah *APITokenHandler) HandleCreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+	if currentUser.IsAnonymous() {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
+		return
+	}
+
+	var req createAPITokenRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("Invalid request payload", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid request payload"}) // 400
+		return
+	}
+
+	// Validation
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "name is required and must be at most 100 characters"}) // 400
+		return
+	}
+	if len(req.Scopes) == 0 {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "at least one scope is required", "valid_scopes": store.APIScopes}) // 400
+		return
+	}
+	scopes := []string{}
+	for _, scope := range req.Scopes {
+		if !utils.StringInSlice(scope, store.APIScopes) {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "unknown scope: " + scope, "valid_scopes": store.APIScopes}) // 400
+			return
+		}
+		if !utils.StringInSlice(scope, scopes) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "expires_at must be in the future"}) // 400
+		return
+	}
+
+	apiToken, err := ah.apiTokenStore.CreateAPIToken(&store.APIToken{
+		UserID:    currentUser.ID,
+		Name:      req.Name,
+		Scopes:    scopes,
+		ExpiresAt: req.ExpiresAt,
+	})
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error creating API token", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to create API token"}) // 500
+		return
+	}
+
+	ah.metrics.TokenCreated(metrics.TokenPersonalAccess)
+	ah.auditor.Record(r, store.AuditTokenCreated, auditTarget{Type: store.AuditTargetAPIToken, ID: apiToken.ID, OwnerID: currentUser.ID}, nil, utils.Envelope{
+		"name":       apiToken.Name,
+		"scopes":     apiToken.Scopes,
+		"expires_at": apiToken.ExpiresAt,
+	})
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"api_token": apiToken}) // 201
+}
+
+func (ah *APITokenHandler) HandleListAPITokens(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+	if currentUser.IsAnonymous() {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
+		return
+	}
+
+	apiTokens, err := ah.apiTokenStore.ListAPITokens(currentUser.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error retrieving API tokens", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve API tokens"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"api_tokens": apiTokens}) // 200
+}
+
+func (ah *APITokenHandler) HandleDeleteAPIToken(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+	if currentUser.IsAnonymous() {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
+		return
+	}
+
+	tokenId, err := utils.ReadIDParam(r, "id")
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid API token ID parameter"}) // 400
+		return
+	}
+
+	err = ah.apiTokenStore.DeleteAPIToken(currentUser.ID, int(tokenId))
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "API token not found"})
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error deleting API token", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to delete API token"}) // 500
+		return
+	}
+
+	ah.auditor.Record(r, store.AuditTokenRevoked, auditTarget{Type: store.AuditTargetAPIToken, ID: int(tokenId), OwnerID: currentUser.ID}, nil, nil)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "API token deleted successfully"}) // 200
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/logging"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/middleware"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/store"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/utils"
+)
+
+// Auditor records audit events on behalf of the handlers
+type Auditor struct {
+	auditStore store.AuditStore
+}
+
+// Constructor for Auditor
+func NewAuditor(auditStore store.AuditStore) *Auditor {
+	return &Auditor{
+		auditStore: auditStore,
+	}
+}
+
+// auditTarget is what an audited action was done to, and whose it is
+type auditTarget struct {
+	Type    string // one of the store.AuditTarget* constants
+	ID      int    // 0 when the target has no numeric ID, like a session
+	OwnerID int    // the user the event concerns, 0 for none
+}
+
+// Record adds an event done by the current user. before and after summarize the target around the change
+// (nil when there is no such side). A failure is only logged: the change itself already happened.
+func (a *Auditor) Record(r *http.Request, action string, target auditTarget, before, after any) {
+	a.RecordAs(r, middleware.GetUser(r).ID, action, target, before, after)
+}
+
+// RecordAs is Record for requests where the actor is not the authenticated user, such as logins. 0 means nobody.
+func (a *Auditor) RecordAs(r *http.Request, actorID int, action string, target auditTarget, before, after any) {
+	a.record(r.Context(), &store.AuditEvent{
+		ActorID:    optionalID(actorID),
+		UserID:     optionalID(target.OwnerID),
+		Action:     action,
+		TargetType: target.Type,
+		TargetID:   optionalID(target.ID),
+		IP:         utils.ClientIP(r),
+		UserAgent:  r.UserAgent(),
+		Before:     before,
+		After:      after,
+	})
+}
+
+// RecordPurge adds an event for data the background purgers deleted for good. Nobody is the actor.
+func (a *Auditor) RecordPurge(ctx context.Context, action, targetType string, row store.PurgedRow) {
+	a.record(ctx, &store.AuditEvent{
+		UserID:     optionalID(row.UserID),
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   optionalID(row.ID),
+	})
+}
+
+func (a *Auditor) record(ctx context.Context, event *store.AuditEvent) {
+	err := a.auditStore.RecordAuditEvent(event)
+	if err != nil {
+		logging.FromContext(ctx).Error("Error recording audit event", "action", event.Action, "error", err)
+	}
+}
+
+func optionalID(id int) *int {
+	if id == 0 {
+		return nil
+	}
+	return &id
+}
+
+// Targets of the common audited things
+func noteTarget(note *store.Note) auditTarget {
+	return auditTarget{Type: store.AuditTargetNote, ID: note.ID, OwnerID: note.UserID}
+}
+
+func folderTarget(folder *store.Folder) auditTarget {
+	return auditTarget{Type: store.AuditTargetFolder, ID: folder.ID, OwnerID: folder.UserID}
+}
+
+func userTarget(userID int) auditTarget {
+	return auditTarget{Type: store.AuditTargetUser, ID: userID, OwnerID: userID}
+}
+
+// Summaries stored as before/after. Note content is never copied into the trail, only a hash to tell whether it changed.
+func noteSummary(note *store.Note) utils.Envelope {
+	sum := sha256.Sum256([]byte(note.Content))
+	return utils.Envelope{
+		"title":          note.Title,
+		"folder_id":      note.FolderID,
+		"is_favorite":    note.IsFavorite,
+		"content_length": len(note.Content),
+		"content_sha256": hex.EncodeToString(sum[:]),
+	}
+}
+
+func folderSummary(folder *store.Folder) utils.Envelope {
+	var parentID *int64
+	if folder.ParentFolderID.Valid {
+		parentID = &folder.ParentFolderID.Int64
+	}
+	return utils.Envelope{
+		"title":            folder.Title,
+		"parent_folder_id": parentID,
+		"is_favorite":      folder.IsFavorite,
+	}
+}
+
+func userSummary(user *store.User) utils.Envelope {
+	return utils.Envelope{
+		"username":       user.Username,
+		"email":          user.Email,
+		"first_name":     user.FirstName,
+		"last_name":      user.LastName,
+		"bio":            user.Bio,
+		"pfp_url":        user.PfpURL,
+		"auth_level":     user.AuthLevel,
+		"email_verified": user.IsEmailVerified(),
+		"address": utils.Envelope{
+			"line1":   user.AddressLine1,
+			"line2":   user.AddressLine2,
+			"city":    user.AddressCity,
+			"state":   user.AddressState,
+			"zip":     user.AddressZip,
+			"country": user.AddressCountry,
+		},
+	}
+}
+
+func shareSummary(share *store.Share) utils.Envelope {
+	return utils.Envelope{
+		"note_id":             share.NoteID,
+		"folder_id":           share.FolderID,
+		"shared_with_user_id": share.SharedWithUserID,
+		"permission":          share.Permission,
+	}
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/logging"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/middleware"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/store"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/utils"
+)
+
+// AuditHandler serves the audit trail: users see what concerns them, admins see everything.
+type AuditHandler struct {
+	auditStore store.AuditStore
+}
+
+// Constructor for AuditHandler
+func NewAuditHandler(auditStore store.AuditStore) *AuditHandler {
+	return &AuditHandler{
+		auditStore: auditStore,
+	}
+}
+
+// The current user's events: the ones about their account and data, and the ones they did themselves.
+// ?action=note.updated (or a prefix such as note.)&since=...&until=...&limit=50&cursor=...
+func (ah *AuditHandler) HandleListMyAuditEvents(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+	if currentUser.IsAnonymous() {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
+		return
+	}
+
+	q, err := readAuditQuery(r)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()}) // 400
+		return
+	}
+	q.Involving = &currentUser.ID
+
+	ah.writeAuditEvents(w, r, q)
+}
+
+// Every event, for admins. Takes the same parameters as /users/me/audit plus
+// ?user_id=<whose account or data>&actor_id=<who did it>&target_type=note&target_id=<id>
+func (ah *AuditHandler) HandleListAuditEvents(w http.ResponseWriter, r *http.Request) {
+	q, err := readAuditQuery(r)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()}) // 400
+		return
+	}
+
+	query := r.URL.Query()
+	q.TargetType = query.Get("target_type")
+	idParams := map[string]**int{
+		"user_id":   &q.UserID,
+		"actor_id":  &q.ActorID,
+		"target_id": &q.TargetID,
+	}
+	for param, dest := range idParams {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": fmt.Sprintf("invalid %s parameter", param)}) // 400
+			return
+		}
+		*dest = &id
+	}
+
+	ah.writeAuditEvents(w, r, q)
+}
+
+// readAuditQuery reads the filters both listings share
+func readAuditQuery(r *http.Request) (store.AuditQuery, error) {
+	query := r.URL.Query()
+	q := store.AuditQuery{
+		Action: query.Get("action"),
+		Cursor: query.Get("cursor"),
+	}
+
+	limit, err := utils.ReadIntQueryParam(r, "limit", store.DefaultListLimit)
+	if err != nil {
+		return q, err
+	}
+	if limit < 1 || limit > store.MaxListLimit {
+		return q, fmt.Errorf("limit must be between 1 and %d", store.MaxListLimit)
+	}
+	q.Limit = limit
+
+	for param, dest := range map[string]**time.Time{"since": &q.Since, "until": &q.Until} {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+		t, err := parseTimeParam(value)
+		if err != nil {
+			return q, fmt.Errorf("invalid %s parameter", param)
+		}
+		*dest = &t
+	}
+
+	return q, nil
+}
+
+func (ah *AuditHandler) writeAuditEvents(w http.ResponseWriter, r *http.Request, q store.AuditQuery) {
+	auditEvents, nextCursor, err := ah.auditStore.ListAuditEvents(q)
+	if errors.Is(err, store.ErrInvalidCursor) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()}) // 400
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error listing audit events", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to list audit events"}) // 500
+		return
+	}
+
+	// next_cursor is null on the last page
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"events": auditEvents, "next_cursor": cursorOrNil(nextCursor)}) // 200
+}
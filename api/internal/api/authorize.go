@@ -0,0 +1,84 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/logging"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/middleware"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/policy"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/store"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/utils"
+)
+
+// authorizeNote loads the note from the {id} URL parameter and checks the current user has at least the needed permission on it.
+// On failure it writes the error response itself and returns nil. The user's actual permission is returned alongside.
+func authorizeNote(w http.ResponseWriter, r *http.Request, notesStore store.NoteStore, accessPolicy *policy.Policy, needed policy.Permission) (*store.Note, policy.Permission) {
+	noteId, err := utils.ReadIDParam(r, "id")
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("Invalid note ID parameter", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid note ID parameter"}) // 400
+		return nil, policy.None
+	}
+
+	note, err := notesStore.GetNoteByID(int(noteId))
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error retrieving note", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve note"})
+		return nil, policy.None
+	}
+	if note == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "Note not found"})
+		return nil, policy.None
+	}
+
+	currentUser := middleware.GetUser(r)
+	permission, err := accessPolicy.NotePermission(currentUser, note)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error checking note permission", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve note"})
+		return nil, policy.None
+	}
+	if !permission.Allows(needed) {
+		logging.FromContext(r.Context()).Warn("Unauthorized access to note", "note_id", note.ID)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
+		return nil, policy.None
+	}
+
+	return note, permission
+}
+
+// authorizeFolder is authorizeNote for the folder in the {id} URL parameter.
+func authorizeFolder(w http.ResponseWriter, r *http.Request, folderStore store.FolderStore, accessPolicy *policy.Policy, needed policy.Permission) *store.Folder {
+	folderId, err := utils.ReadIDParam(r, "id")
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("Invalid folder ID parameter", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid folder ID parameter"}) // 400
+		return nil
+	}
+
+	folder, err := folderStore.GetFolderByID(int(folderId))
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error retrieving folder", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve folder"})
+		return nil
+	}
+	if folder == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "Folder not found"})
+		return nil
+	}
+
+	currentUser := middleware.GetUser(r)
+	permission, err := accessPolicy.FolderPermission(currentUser, folder)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error checking folder permission", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve folder"})
+		return nil
+	}
+	if !permission.Allows(needed) {
+		logging.FromContext(r.Context()).Warn("Unauthorized access to folder", "folder_id", folder.ID)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
+		return nil
+	}
+
+	return folder
+}
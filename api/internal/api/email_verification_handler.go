@@ -0,0 +1,148 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/logging"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/mailer"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/middleware"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/store"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/tokens"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/utils"
+)
+
+// How long an email verification link stays valid
+const emailVerificationTTL = 48 * time.Hour
+
+// EmailVerifier sends the "confirm your email" message. Used on registration, email changes and resends.
+type EmailVerifier struct {
+	tokenStore store.TokenStore
+	mailer     mailer.Mailer
+	background *sync.WaitGroup // SendInBackground runs here, so shutdown waits for it before closing the database
+	appURL     string          // Base URL of the UI, for the link in the email
+}
+
+func NewEmailVerifier(tokenStore store.TokenStore, mail mailer.Mailer, background *sync.WaitGroup, appURL string) *EmailVerifier {
+	return &EmailVerifier{
+		tokenStore: tokenStore,
+		mailer:     mail,
+		background: background,
+		appURL:     strings.TrimRight(appURL, "/"),
+	}
+}
+
+// Send issues a new email_verification token for the user's current address and mails it.
+// Links sent for an earlier address stop working.
+func (v *EmailVerifier) Send(user *store.User) error {
+	err := v.tokenStore.DeleteAllTokensForUser(tokens.ScopeEmailVerification, user.ID)
+	if err != nil {
+		return err
+	}
+
+	token, err := v.tokenStore.CreateNewToken(user.ID, emailVerificationTTL, tokens.ScopeEmailVerification)
+	if err != nil {
+		return err
+	}
+
+	return v.mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"Please confirm that this is your email address by opening this link within %d hours:\n\n"+
+			"%s/verify-email?token=%s\n\n"+
+			"If you did not create a notes account, you can ignore this email.\n",
+			user.Username, int(emailVerificationTTL.Hours()), v.appURL, url.QueryEscape(token.Plaintext)),
+	})
+}
+
+// SendInBackground is Send for handlers that should not wait on the mail server. Errors are logged by the logger of ctx.
+func (v *EmailVerifier) SendInBackground(ctx context.Context, user *store.User) {
+	v.background.Go(func() {
+		err := v.Send(user)
+		if err != nil {
+			logging.FromContext(ctx).Error("Error sending verification email", "error", err)
+		}
+	})
+}
+
+type EmailVerificationHandler struct {
+	userStore  store.UserStore
+	tokenStore store.TokenStore
+	verifier   *EmailVerifier
+}
+
+// Constructor for EmailVerificationHandler
+func NewEmailVerificationHandler(userStore store.UserStore, tokenStore store.TokenStore, verifier *EmailVerifier) *EmailVerificationHandler {
+	return &EmailVerificationHandler{
+		userStore:  userStore,
+		tokenStore: tokenStore,
+		verifier:   verifier,
+	}
+}
+
+// Confirms an email address with the token from the email: {"token": "..."}
+func (eh *EmailVerificationHandler) HandleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Token == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "token is required"}) // 400
+		return
+	}
+
+	user, err := eh.userStore.GetUserToken(tokens.ScopeEmailVerification, req.Token)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error fetching user", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"}) // 500
+		return
+	}
+	if user == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid or expired verification token"}) // 400
+		return
+	}
+
+	err = eh.userStore.MarkEmailVerified(user.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error verifying email", "user_id", user.ID, "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to verify email"}) // 500
+		return
+	}
+
+	err = eh.tokenStore.DeleteAllTokensForUser(tokens.ScopeEmailVerification, user.ID)
+	if err != nil {
+		// Not fatal, the address is verified and the token expires on its own
+		logging.FromContext(r.Context()).Error("Error deleting verification tokens", "user_id", user.ID, "error", err)
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "Email verified successfully"}) // 200
+}
+
+// Sends a new verification email to the current user
+func (eh *EmailVerificationHandler) HandleResendVerification(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+	if currentUser.IsAnonymous() {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
+		return
+	}
+	if currentUser.IsEmailVerified() {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "Email is already verified"}) // 409
+		return
+	}
+
+	err := eh.verifier.Send(currentUser)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error sending verification email", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to send verification email"}) // 500
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusAccepted, utils.Envelope{"message": "Verification email sent"}) // 202
+}
@@ -0,0 +1,436 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/events"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/mailer"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/middleware"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/store"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/tokens"
+	"github.com/go-chi/chi/v5"
+)
+
+// fakeTokenStore keeps tokens in memory, by plaintext. Methods the tests do not need are left to the
+// embedded interface and panic if called.
+type fakeTokenStore struct {
+	store.TokenStore
+	mu     sync.Mutex
+	tokens map[string]*tokens.Token
+}
+
+func newFakeTokenStore() *fakeTokenStore {
+	return &fakeTokenStore{tokens: make(map[string]*tokens.Token)}
+}
+
+func (f *fakeTokenStore) CreateNewToken(userID int, ttl time.Duration, scope string) (*tokens.Token, error) {
+	token, err := tokens.GenerateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tokens[token.Plaintext] = token
+	return token, nil
+}
+
+func (f *fakeTokenStore) DeleteAllTokensForUser(scope string, userID int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for plaintext, token := range f.tokens {
+		if token.Scope == scope && token.UserID == userID {
+			delete(f.tokens, plaintext)
+		}
+	}
+	return nil
+}
+
+func (f *fakeTokenStore) lookup(scope, plaintext string) *tokens.Token {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	token, ok := f.tokens[plaintext]
+	if !ok || token.Scope != scope || token.Expiry.Before(time.Now()) {
+		return nil
+	}
+	return token
+}
+
+// fakeUserStore keeps users in memory and finds them by token in a fakeTokenStore, like the tokens join does
+type fakeUserStore struct {
+	store.UserStore
+	mu     sync.Mutex
+	users  map[int]*store.User
+	tokens *fakeTokenStore
+}
+
+func newFakeUserStore(tokenStore *fakeTokenStore, users ...*store.User) *fakeUserStore {
+	f := &fakeUserStore{users: make(map[int]*store.User), tokens: tokenStore}
+	for _, user := range users {
+		f.users[user.ID] = user
+	}
+	return f
+}
+
+func (f *fakeUserStore) get(userID int) *store.User {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	user, ok := f.users[userID]
+	if !ok {
+		return nil
+	}
+	copied := *user
+	return &copied
+}
+
+func (f *fakeUserStore) GetUserById(id int) (*store.User, error) {
+	return f.get(id), nil
+}
+
+func (f *fakeUserStore) GetUserToken(scope, tokenPlaintext string) (*store.User, error) {
+	token := f.tokens.lookup(scope, tokenPlaintext)
+	if token == nil {
+		return nil, nil
+	}
+	return f.get(token.UserID), nil
+}
+
+func (f *fakeUserStore) MarkEmailVerified(userID int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if user := f.users[userID]; user != nil && user.EmailVerifiedAt == nil {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+	}
+	return nil
+}
+
+// UpdateUser clears email_verified_at when the email changes, as PostgresUserStore.UpdateUser does
+func (f *fakeUserStore) UpdateUser(user *store.User) (*store.User, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	existing := f.users[user.ID]
+	updated := *user
+	updated.EmailVerifiedAt = existing.EmailVerifiedAt
+	if !strings.EqualFold(existing.Email, user.Email) {
+		updated.EmailVerifiedAt = nil
+	}
+	f.users[user.ID] = &updated
+	copied := updated
+	return &copied, nil
+}
+
+// fakeMailer records the messages it is asked to send
+type fakeMailer struct {
+	mu       sync.Mutex
+	messages []mailer.Message
+}
+
+func (f *fakeMailer) Send(msg mailer.Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.messages = append(f.messages, msg)
+	return nil
+}
+
+func (f *fakeMailer) sent() []mailer.Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]mailer.Message(nil), f.messages...)
+}
+
+var linkTokenRegex = regexp.MustCompile(`[?&]token=([^&\s]+)`)
+
+// linkToken is the token in the link of a verification email
+func linkToken(t *testing.T, msg mailer.Message) string {
+	t.Helper()
+	match := linkTokenRegex.FindStringSubmatch(msg.Body)
+	if match == nil {
+		t.Fatalf("no link in the email: %q", msg.Body)
+	}
+	token, err := url.QueryUnescape(match[1])
+	if err != nil {
+		t.Fatalf("invalid token in the link: %v", err)
+	}
+	return token
+}
+
+type fakeAuditStore struct {
+	store.AuditStore
+}
+
+func (fakeAuditStore) RecordAuditEvent(*store.AuditEvent) error {
+	return nil
+}
+
+// verificationTest wires the email verification handlers to fakes
+type verificationTest struct {
+	users      *fakeUserStore
+	tokens     *fakeTokenStore
+	mail       *fakeMailer
+	background *sync.WaitGroup
+	verifier   *EmailVerifier
+	handler    *EmailVerificationHandler
+	middleware *middleware.UserMiddleware
+}
+
+func newVerificationTest(users ...*store.User) *verificationTest {
+	vt := &verificationTest{
+		tokens:     newFakeTokenStore(),
+		mail:       &fakeMailer{},
+		background: &sync.WaitGroup{},
+	}
+	vt.users = newFakeUserStore(vt.tokens, users...)
+	vt.verifier = NewEmailVerifier(vt.tokens, vt.mail, vt.background, "https://notes.example.com/")
+	vt.handler = NewEmailVerificationHandler(vt.users, vt.tokens, vt.verifier)
+	vt.middleware = &middleware.UserMiddleware{UserStore: vt.users, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	return vt
+}
+
+// login returns an authentication token for the user
+func (vt *verificationTest) login(t *testing.T, userID int) string {
+	t.Helper()
+	token, err := vt.tokens.CreateNewToken(userID, time.Hour, tokens.ScopeAuth)
+	if err != nil {
+		t.Fatalf("CreateNewToken: %v", err)
+	}
+	return token.Plaintext
+}
+
+func (vt *verificationTest) verifyEmail(token string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(map[string]string{"token": token})
+	w := httptest.NewRecorder()
+	vt.handler.HandleVerifyEmail(w, httptest.NewRequest(http.MethodPost, "/verify-email", strings.NewReader(string(body))))
+	return w
+}
+
+func newUser(id int, email string, verified bool) *store.User {
+	username, _, _ := strings.Cut(email, "@")
+	user := &store.User{ID: id, Username: username, Email: email, AuthLevel: store.AuthLevelUser}
+	if verified {
+		verifiedAt := time.Now().Add(-time.Hour)
+		user.EmailVerifiedAt = &verifiedAt
+	}
+	return user
+}
+
+func TestEmailVerifierSendMailsALinkToTheCurrentAddress(t *testing.T) {
+	vt := newVerificationTest(newUser(1, "alice@example.com", false))
+
+	err := vt.verifier.Send(vt.users.get(1))
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	sent := vt.mail.sent()
+	if len(sent) != 1 || sent[0].To != "alice@example.com" {
+		t.Fatalf("expected one email to alice@example.com, got %+v", sent)
+	}
+	if !strings.Contains(sent[0].Body, "https://notes.example.com/verify-email?token=") {
+		t.Errorf("expected a link to the UI, got %q", sent[0].Body)
+	}
+	if vt.tokens.lookup(tokens.ScopeEmailVerification, linkToken(t, sent[0])) == nil {
+		t.Error("expected the token in the link to be stored")
+	}
+}
+
+func TestHandleVerifyEmail(t *testing.T) {
+	vt := newVerificationTest(newUser(1, "alice@example.com", false))
+	err := vt.verifier.Send(vt.users.get(1))
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	token := linkToken(t, vt.mail.sent()[0])
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"missing token", "", http.StatusBadRequest},
+		{"unknown token", "not-a-token", http.StatusBadRequest},
+		{"token from the email", token, http.StatusOK},
+		{"token used twice", token, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := vt.verifyEmail(tt.token)
+		if w.Code != tt.status {
+			t.Errorf("%s: expected %d, got %d: %s", tt.name, tt.status, w.Code, w.Body)
+		}
+	}
+
+	if !vt.users.get(1).IsEmailVerified() {
+		t.Error("expected the email to be verified")
+	}
+}
+
+func TestResendInvalidatesEarlierLinks(t *testing.T) {
+	vt := newVerificationTest(newUser(1, "alice@example.com", false))
+	authToken := vt.login(t, 1)
+
+	resend := func() {
+		r := httptest.NewRequest(http.MethodPost, "/verify-email/resend", nil)
+		r.Header.Set("Authorization", "Bearer "+authToken)
+		w := httptest.NewRecorder()
+		vt.middleware.Authenticate(vt.middleware.RequireUser(vt.handler.HandleResendVerification)).ServeHTTP(w, r)
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("resend: expected 202, got %d: %s", w.Code, w.Body)
+		}
+	}
+	resend()
+	resend()
+
+	sent := vt.mail.sent()
+	if len(sent) != 2 {
+		t.Fatalf("expected two emails, got %d", len(sent))
+	}
+	if w := vt.verifyEmail(linkToken(t, sent[0])); w.Code != http.StatusBadRequest {
+		t.Errorf("expected the first link to stop working once resent, got %d", w.Code)
+	}
+	if w := vt.verifyEmail(linkToken(t, sent[1])); w.Code != http.StatusOK {
+		t.Errorf("expected the latest link to work, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestResendRefusedOnceVerified(t *testing.T) {
+	vt := newVerificationTest(newUser(1, "alice@example.com", true))
+
+	r := middleware.SetUser(httptest.NewRequest(http.MethodPost, "/verify-email/resend", nil), vt.users.get(1))
+	w := httptest.NewRecorder()
+	vt.handler.HandleResendVerification(w, r)
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected 409, got %d", w.Code)
+	}
+	if len(vt.mail.sent()) != 0 {
+		t.Error("expected no email")
+	}
+}
+
+// unverifiedRoutes are the routes behind RequireVerifiedEmail, wired as in routes.go. The handlers have no stores,
+// so reaching them at all would fail the test.
+func unverifiedRoutes(um *middleware.UserMiddleware) map[string]http.Handler {
+	shareHandler := &ShareHandler{}
+	linkHandler := &PublicLinkHandler{}
+	route := func(pattern string, scope string, handler http.HandlerFunc) http.Handler {
+		r := chi.NewRouter()
+		r.Use(um.Authenticate)
+		r.Post(pattern, um.RequireVerifiedEmail(um.RequireScope(scope, handler)))
+		return r
+	}
+	return map[string]http.Handler{
+		"/notes/1/shares":       route("/notes/{id}/shares", store.APIScopeNotesWrite, shareHandler.HandleShareNote),
+		"/folders/1/shares":     route("/folders/{id}/shares", store.APIScopeFoldersWrite, shareHandler.HandleShareFolder),
+		"/notes/1/public-links": route("/notes/{id}/public-links", store.APIScopeNotesWrite, linkHandler.HandleCreatePublicLink),
+	}
+}
+
+func TestRequireVerifiedEmailRefusesSharingAndPublicLinks(t *testing.T) {
+	vt := newVerificationTest(newUser(1, "alice@example.com", false))
+	authToken := vt.login(t, 1)
+
+	for path, handler := range unverifiedRoutes(vt.middleware) {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{}`))
+		r.Header.Set("Authorization", "Bearer "+authToken)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: expected 403, got %d: %s", path, w.Code, w.Body)
+		}
+		if !strings.Contains(w.Body.String(), "verify your email") {
+			t.Errorf("%s: expected the error to say why, got %s", path, w.Body)
+		}
+	}
+}
+
+func TestRequireVerifiedEmail(t *testing.T) {
+	vt := newVerificationTest(newUser(1, "alice@example.com", false), newUser(2, "bob@example.com", true))
+
+	tests := []struct {
+		name   string
+		user   *store.User
+		status int
+	}{
+		{"anonymous", store.AnonymousUser, http.StatusUnauthorized},
+		{"unverified", vt.users.get(1), http.StatusForbidden},
+		{"verified", vt.users.get(2), http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		next := func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		r := middleware.SetUser(httptest.NewRequest(http.MethodPost, "/notes/1/shares", nil), tt.user)
+		w := httptest.NewRecorder()
+		vt.middleware.RequireVerifiedEmail(next).ServeHTTP(w, r)
+
+		if w.Code != tt.status {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.status, w.Code)
+		}
+	}
+}
+
+func TestEmailChangeRequiresVerificationAgain(t *testing.T) {
+	vt := newVerificationTest(newUser(1, "alice@example.com", true))
+	userHandler := NewUserHandler(vt.users, vt.verifier, events.NewMemoryBus(), NewAuditor(fakeAuditStore{}))
+
+	body := `{"username": "alice", "email": "alice@new.example.com", "password": "Passw0rd!"}`
+	r := httptest.NewRequest(http.MethodPut, "/users/1", strings.NewReader(body))
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", "1")
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	r = middleware.SetUser(r, vt.users.get(1))
+	w := httptest.NewRecorder()
+	userHandler.HandleUpdateUser(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	var resp struct {
+		User struct {
+			Email           string     `json:"email"`
+			EmailVerifiedAt *time.Time `json:"email_verified_at"`
+		} `json:"user"`
+	}
+	err := json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if resp.User.Email != "alice@new.example.com" || resp.User.EmailVerifiedAt != nil {
+		t.Errorf("expected the new address, unverified, got %+v", resp.User)
+	}
+
+	// The verification email goes out in the background
+	vt.background.Wait()
+	sent := vt.mail.sent()
+	if len(sent) != 1 || sent[0].To != "alice@new.example.com" {
+		t.Fatalf("expected a verification email to the new address, got %+v", sent)
+	}
+
+	// Until the new address is verified, sharing is off limits again
+	authToken := vt.login(t, 1)
+	r = httptest.NewRequest(http.MethodPost, "/notes/1/shares", strings.NewReader(`{}`))
+	r.Header.Set("Authorization", "Bearer "+authToken)
+	w = httptest.NewRecorder()
+	unverifiedRoutes(vt.middleware)["/notes/1/shares"].ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected sharing to be refused, got %d: %s", w.Code, w.Body)
+	}
+
+	if w := vt.verifyEmail(linkToken(t, sent[0])); w.Code != http.StatusOK {
+		t.Fatalf("expected the link to verify the new address, got %d: %s", w.Code, w.Body)
+	}
+	if !vt.users.get(1).IsEmailVerified() {
+		t.Error("expected the new address to be verified")
+	}
+}
@@ -0,0 +1,250 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/events"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/logging"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/middleware"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/store"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/utils"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/websocket"
+)
+
+// How often idle streams send something, so proxies and load balancers keep them open
+const eventKeepAliveInterval = 25 * time.Second
+
+type EventHandler struct {
+	bus          events.Bus
+	shuttingDown chan struct{} // Closed by Shutdown to end every stream
+	shutdownOnce sync.Once
+}
+
+// Constructor for EventHandler
+func NewEventHandler(bus events.Bus) *EventHandler {
+	return &EventHandler{
+		bus:          bus,
+		shuttingDown: make(chan struct{}),
+	}
+}
+
+// Shutdown ends every open stream, so that a graceful server shutdown does not wait on them.
+// Clients reconnect, to another instance or once this one is back, and resume with Last-Event-ID.
+// Meant for http.Server.RegisterOnShutdown.
+func (eh *EventHandler) Shutdown() {
+	eh.shutdownOnce.Do(func() {
+		close(eh.shuttingDown)
+	})
+}
+
+// readLastEventID returns the id a reconnecting client wants to resume after, or -1.
+// Browsers send the Last-Event-ID header when an EventSource reconnects; ?last_event_id= works for the first connection and WebSockets.
+func readLastEventID(r *http.Request) (int64, error) {
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("last_event_id")
+	}
+	if value == "" {
+		return -1, nil
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || id < 0 {
+		return 0, fmt.Errorf("invalid Last-Event-ID")
+	}
+	return id, nil
+}
+
+// subscribe starts a subscription for the current user. On failure it writes the error response itself and returns nil.
+func (eh *EventHandler) subscribe(w http.ResponseWriter, r *http.Request) *events.Subscription {
+	currentUser := middleware.GetUser(r)
+	if currentUser.IsAnonymous() {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
+		return nil
+	}
+
+	lastEventID, err := readLastEventID(r)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()}) // 400
+		return nil
+	}
+
+	return eh.bus.Subscribe(currentUser.ID, lastEventID)
+}
+
+// backlog is what a stream sends before any live events: a ready event, then either a resync or the replayed events.
+func backlog(sub *events.Subscription) []events.Event {
+	list := []events.Event{{ID: sub.LastID, Type: events.Ready, CreatedAt: time.Now()}}
+	if sub.Resync {
+		return append(list, events.Event{ID: sub.LastID, Type: events.Resync, CreatedAt: time.Now()})
+	}
+	return append(list, sub.Replay...)
+}
+
+// Streams the current user's events as Server-Sent Events: GET /events
+func (eh *EventHandler) HandleEventStream(w http.ResponseWriter, r *http.Request) {
+	sub := eh.subscribe(w, r)
+	if sub == nil {
+		return
+	}
+	defer sub.Close()
+
+	// The stream outlives the server's write timeout
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx
+	w.WriteHeader(http.StatusOK)
+
+	send := func(event events.Event) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+		if err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	for _, event := range backlog(sub) {
+		if send(event) != nil {
+			return
+		}
+	}
+
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-eh.shuttingDown:
+			return
+		case event, ok := <-sub.Events:
+			if !ok {
+				return // dropped by the bus, the browser reconnects with Last-Event-ID
+			}
+			if send(event) != nil {
+				return
+			}
+		case <-keepAlive.C:
+			_, err := fmt.Fprint(w, ": keep-alive\n\n")
+			if err != nil || rc.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+// Same stream over a WebSocket: GET /events/ws. Each message is one JSON event.
+func (eh *EventHandler) HandleEventWebSocket(w http.ResponseWriter, r *http.Request) {
+	sub := eh.subscribe(w, r)
+	if sub == nil {
+		return
+	}
+	defer sub.Close()
+
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("WebSocket upgrade failed", "error", err)
+		return
+	}
+
+	// The client only sends control frames; ReadLoop handles them and tells us when it is gone
+	done := make(chan struct{})
+	go func() {
+		conn.ReadLoop()
+		close(done)
+	}()
+
+	send := func(event events.Event) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		return conn.WriteText(data)
+	}
+
+	for _, event := range backlog(sub) {
+		if send(event) != nil {
+			conn.Close(websocket.CloseGoingAway)
+			return
+		}
+	}
+
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-eh.shuttingDown:
+			conn.Close(websocket.CloseGoingAway)
+			return
+		case event, ok := <-sub.Events:
+			if !ok {
+				conn.Close(websocket.CloseGoingAway)
+				return
+			}
+			if send(event) != nil {
+				conn.Close(websocket.CloseGoingAway)
+				return
+			}
+		case <-keepAlive.C:
+			if conn.Ping() != nil {
+				conn.Close(websocket.CloseGoingAway)
+				return
+			}
+		}
+	}
+}
+
+// publish sends an event to each of the given users, once per user.
+// A failed publish is logged but never fails the request: the change itself already happened.
+func publish(publisher events.Publisher, r *http.Request, eventType string, data any, userIDs ...int) {
+	seen := make(map[int]bool, len(userIDs))
+	for _, userID := range userIDs {
+		if seen[userID] {
+			continue
+		}
+		seen[userID] = true
+
+		err := publisher.Publish(r.Context(), events.Event{UserID: userID, Type: eventType, Data: data})
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Error publishing event", "event_type", eventType, "error", err)
+		}
+	}
+}
+
+// publishNoteEvent tells the note's owner, and whoever made the change if that was someone the note is shared with.
+func publishNoteEvent(publisher events.Publisher, r *http.Request, eventType string, note *store.Note) {
+	data := utils.Envelope{
+		"id":        note.ID,
+		"title":     note.Title,
+		"folder_id": note.FolderID,
+	}
+	publish(publisher, r, eventType, data, note.UserID, middleware.GetUser(r).ID)
+}
+
+func publishFolderEvent(publisher events.Publisher, r *http.Request, eventType string, folder *store.Folder) {
+	var parentID *int64
+	if folder.ParentFolderID.Valid {
+		parentID = &folder.ParentFolderID.Int64
+	}
+	data := utils.Envelope{
+		"id":               folder.ID,
+		"title":            folder.Title,
+		"parent_folder_id": parentID,
+	}
+	publish(publisher, r, eventType, data, folder.UserID, middleware.GetUser(r).ID)
+}
@@ -1,11 +1,15 @@
 package api
 
 import (
+	"database/sql"
 	"encoding/json"
-	"log"
+	"errors"
 	"net/http"
 
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/events"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/logging"
 	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/middleware"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/policy"
 	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/store"
 	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/utils"
 )
@@ -13,17 +17,28 @@ import (
 type FolderHandler struct {
 	// Dependencies for the FolderHandler can be added here, such as a FolderStore or Logger
 	folderStore store.FolderStore
-	logger      *log.Logger
+	notesStore  store.NoteStore // To list the notes inside a folder
+	policy      *policy.Policy  // Who can see, edit or delete which folder
+	events      events.Publisher
+	auditor     *Auditor
 }
 
 // Constructor for FolderHandler
-func NewFolderHandler(folderStore store.FolderStore, logger *log.Logger) *FolderHandler {
+func NewFolderHandler(folderStore store.FolderStore, notesStore store.NoteStore, folderPolicy *policy.Policy, publisher events.Publisher, auditor *Auditor) *FolderHandler {
 	return &FolderHandler{
 		folderStore: folderStore,
-		logger:      logger,
+		notesStore:  notesStore,
+		policy:      folderPolicy,
+		events:      publisher,
+		auditor:     auditor,
 	}
 }
 
+// getFolder loads the {id} folder if the current user has at least the needed permission on it.
+func (fh *FolderHandler) getFolder(w http.ResponseWriter, r *http.Request, needed policy.Permission) *store.Folder {
+	return authorizeFolder(w, r, fh.folderStore, fh.policy, needed)
+}
+
 // FolderHandler methods for handling HTTP requests related to folders can be added here.
 // CRUD
 
@@ -34,7 +49,7 @@ func (fh *FolderHandler) HandleCreateFolder(w http.ResponseWriter, r *http.Reque
 
 	err := json.NewDecoder(r.Body).Decode(&folder)
 	if err != nil {
-		fh.logger.Printf("Invalid request payload: %v", err)
+		logging.FromContext(r.Context()).Warn("Invalid request payload", "error", err)
 		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid request payload"}) // 400
 		return
 	}
@@ -42,49 +57,44 @@ func (fh *FolderHandler) HandleCreateFolder(w http.ResponseWriter, r *http.Reque
 	// Ensure current user is the owner of the folder
 	currentUser := middleware.GetUser(r)
 	if currentUser.IsAnonymous() {
-		fh.logger.Printf("Unauthorized: anonymous user cannot create folders")
+		logging.FromContext(r.Context()).Warn("Unauthorized: anonymous user cannot create folders")
 		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
 		return
 	}
 
 	folder.UserID = currentUser.ID // Set the folder's UserID to the current user's ID
 
+	// A parent folder has to be one of the user's own folders
+	if folder.ParentFolderID.Valid {
+		owned, err := fh.policy.OwnsFolder(int(folder.ParentFolderID.Int64), currentUser.ID)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Error retrieving parent folder", "error", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve parent folder"})
+			return
+		}
+		if !owned {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Parent folder not found"}) // 400
+			return
+		}
+	}
+
 	createdFolder, err := fh.folderStore.CreateFolder(&folder)
 	if err != nil {
-		fh.logger.Printf("Error creating folder: %v", err)
+		logging.FromContext(r.Context()).Error("Error creating folder", "error", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to create folder"}) // 500
 		return
 	}
 
+	fh.auditor.Record(r, store.AuditFolderCreated, folderTarget(createdFolder), nil, folderSummary(createdFolder))
+	publishFolderEvent(fh.events, r, events.FolderCreated, createdFolder)
 	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"folder": createdFolder}) // 201
 
 }
 
 func (fh *FolderHandler) HandleGetFolderByID(w http.ResponseWriter, r *http.Request) {
-	// Implementation for getting a folder by ID
-	folderId, err := utils.ReadIDParam(r, "id")
-	if err != nil {
-		fh.logger.Printf("Invalid folder ID parameter: %v", err)
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid folder ID parameter"}) // 400
-		return
-	}
-
-	folder, err := fh.folderStore.GetFolderByID(int(folderId))
-	if err != nil {
-		fh.logger.Printf("Error retrieving folder: %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve folder"})
-		return
-	}
+	// Owners and anyone the folder is shared with can read it
+	folder := fh.getFolder(w, r, policy.View)
 	if folder == nil {
-		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "Folder not found"})
-		return
-	}
-
-	// Ensure current user is the owner of the folder
-	currentUser := middleware.GetUser(r)
-	if currentUser.IsAnonymous() || folder.UserID != currentUser.ID {
-		fh.logger.Printf("Unauthorized access to folder ID %d by user ID %d", folder.ID, currentUser.ID)
-		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
 		return
 	}
 
@@ -93,42 +103,21 @@ func (fh *FolderHandler) HandleGetFolderByID(w http.ResponseWriter, r *http.Requ
 
 func (fh *FolderHandler) HandleUpdateFolder(w http.ResponseWriter, r *http.Request) {
 
-	// Implementation for updating a folder
-	paramsFolderId, err := utils.ReadIDParam(r, "id")
-	if err != nil {
-		fh.logger.Printf("Invalid folder ID parameter: %v", err)
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid folder ID parameter"}) // 400
-		return
-	}
-
-	// Fetch existing folder
-	existingFolder, err := fh.folderStore.GetFolderByID(int(paramsFolderId))
-	if err != nil {
-		fh.logger.Printf("Error retrieving folder: %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve folder"})
-		return
-	}
+	// Owners and editors can rename the folder
+	existingFolder := fh.getFolder(w, r, policy.Edit)
 	if existingFolder == nil {
-		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "Folder not found"})
-		return
-	}
-
-	// Ensure current user is the owner of the folder
-	currentUser := middleware.GetUser(r)
-	if currentUser.IsAnonymous() || existingFolder.UserID != currentUser.ID {
-		fh.logger.Printf("Unauthorized access to folder ID %d by user ID %d", existingFolder.ID, currentUser.ID)
-		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
 		return
 	}
+	before := folderSummary(existingFolder)
 
 	// struct
 	var updatedFolderRequest struct {
 		Name *string `json:"name"`
 	}
 
-	err = json.NewDecoder(r.Body).Decode(&updatedFolderRequest)
+	err := json.NewDecoder(r.Body).Decode(&updatedFolderRequest)
 	if err != nil {
-		fh.logger.Printf("Invalid request payload: %v", err)
+		logging.FromContext(r.Context()).Warn("Invalid request payload", "error", err)
 		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid request payload"}) // 400
 		return
 	}
@@ -141,80 +130,232 @@ func (fh *FolderHandler) HandleUpdateFolder(w http.ResponseWriter, r *http.Reque
 	// Save the updated folder
 	err = fh.folderStore.UpdateFolder(existingFolder)
 	if err != nil {
-		fh.logger.Printf("Error updating folder: %v", err)
+		logging.FromContext(r.Context()).Error("Error updating folder", "error", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to update folder"}) // 500
 		return
 	}
 
+	fh.auditor.Record(r, store.AuditFolderUpdated, folderTarget(existingFolder), before, folderSummary(existingFolder))
+	publishFolderEvent(fh.events, r, events.FolderUpdated, existingFolder)
 	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"folder": existingFolder}) // 200
 }
 
 func (fh *FolderHandler) HandleDeleteFolder(w http.ResponseWriter, r *http.Request) {
 
-	folderId, err := utils.ReadIDParam(r, "id")
+	// Only the owner can delete the folder
+	folder := fh.getFolder(w, r, policy.Owner)
+	if folder == nil {
+		return
+	}
+
+	// Delete the folder
+	err := fh.folderStore.DeleteFolder(folder.ID)
 	if err != nil {
-		fh.logger.Printf("Invalid folder ID parameter: %v", err)
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid folder ID parameter"}) // 400
+		logging.FromContext(r.Context()).Error("Error deleting folder", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to delete folder"}) // 500
 		return
 	}
 
-	// Fetch existing folder
-	_, err = fh.folderStore.GetFolderByID(int(folderId))
+	// Its subfolders and notes go to the trash with it, as part of this one event
+	fh.auditor.Record(r, store.AuditFolderDeleted, folderTarget(folder), folderSummary(folder), nil)
+	publishFolderEvent(fh.events, r, events.FolderDeleted, folder)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "Folder deleted successfully"}) // 200
+}
+
+func (fh *FolderHandler) HandleListFoldersByUserID(w http.ResponseWriter, r *http.Request) {
+
+	// Implementation for listing notes by user ID
+	userId, err := utils.ReadIDParam(r, "user_id")
 	if err != nil {
-		fh.logger.Printf("Error retrieving folder: %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve folder"})
+		logging.FromContext(r.Context()).Warn("Invalid user ID parameter", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid user ID parameter"}) // 400
 		return
 	}
 
-	// Ensure current user is the owner of the folder
+	// Ensure current user is the same as the requested user ID
 	currentUser := middleware.GetUser(r)
-	folderOwnerID, err := fh.folderStore.GetFolderOwner(int(folderId))
+	if currentUser.IsAnonymous() || currentUser.ID != int(userId) {
+		logging.FromContext(r.Context()).Warn("Unauthorized access to folders of user", "folders_of_user_id", userId)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
+		return
+	}
+
+	listOptions, err := readListOptions(r, int(userId))
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()}) // 400
+		return
+	}
+	opts := store.FolderListOptions{ListOptions: listOptions}
+
+	// ?parent_folder_id=<id> or ?parent_folder_id=none for top-level folders
+	opts.ParentFolderID, opts.RootOnly, err = readOptionalFolderParam(r, "parent_folder_id")
 	if err != nil {
-		fh.logger.Printf("Error retrieving folder owner: %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve folder owner"})
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()}) // 400
+		return
+	}
+
+	folders, nextCursor, err := fh.folderStore.ListFoldersByUserID(opts)
+	if errors.Is(err, store.ErrInvalidCursor) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()}) // 400
 		return
 	}
-	if currentUser.IsAnonymous() || folderOwnerID != currentUser.ID {
-		fh.logger.Printf("Unauthorized access to folder ID %d by user ID %d", folderId, currentUser.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error retrieving folders", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve folders"})
+		return
+	}
+
+	// next_cursor is null on the last page
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"folders": folders, "next_cursor": cursorOrNil(nextCursor)}) // 200
+}
+
+// Nested folder hierarchy of the current user, with note counts per folder
+func (fh *FolderHandler) HandleGetFolderTree(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+	if currentUser.IsAnonymous() {
 		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
 		return
 	}
 
-	// Delete the folder
-	err = fh.folderStore.DeleteFolder(int(folderId))
+	tree, err := fh.folderStore.GetFolderTree(currentUser.ID)
 	if err != nil {
-		fh.logger.Printf("Error deleting folder: %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to delete folder"}) // 500
+		logging.FromContext(r.Context()).Error("Error retrieving folder tree", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve folder tree"})
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "Folder deleted successfully"}) // 200
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"tree": tree}) // 200
 }
 
-func (fh *FolderHandler) HandleListFoldersByUserID(w http.ResponseWriter, r *http.Request) {
+// Breadcrumbs from the root folder down to the {id} folder
+func (fh *FolderHandler) HandleGetFolderPath(w http.ResponseWriter, r *http.Request) {
+	folder := fh.getFolder(w, r, policy.View)
+	if folder == nil {
+		return
+	}
 
-	// Implementation for listing notes by user ID
-	userId, err := utils.ReadIDParam(r, "user_id")
+	path, err := fh.folderStore.GetFolderPath(folder.ID)
 	if err != nil {
-		fh.logger.Printf("Invalid user ID parameter: %v", err)
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid user ID parameter"}) // 400
+		logging.FromContext(r.Context()).Error("Error retrieving folder path", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve folder path"})
 		return
 	}
 
-	// Ensure current user is the same as the requested user ID
-	currentUser := middleware.GetUser(r)
-	if currentUser.IsAnonymous() || currentUser.ID != int(userId) {
-		fh.logger.Printf("Unauthorized access to folders of user ID %d by user ID %d", userId, currentUser.ID)
-		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"path": path}) // 200
+}
+
+// Moves a folder under a new parent: {"parent_folder_id": 12}, or {"parent_folder_id": null} for the root
+func (fh *FolderHandler) HandleMoveFolder(w http.ResponseWriter, r *http.Request) {
+
+	// Only the owner can move the folder
+	folder := fh.getFolder(w, r, policy.Owner)
+	if folder == nil {
+		return
+	}
+
+	// A map tells a missing field apart from an explicit null
+	var req map[string]*int
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("Invalid request payload", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid request payload"}) // 400
+		return
+	}
+	parentID, ok := req["parent_folder_id"]
+	if !ok {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "parent_folder_id is required (null moves the folder to the root)"}) // 400
+		return
+	}
+
+	if parentID != nil {
+		owned, err := fh.policy.OwnsFolder(*parentID, folder.UserID)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Error retrieving parent folder", "error", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve parent folder"})
+			return
+		}
+		if !owned {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Parent folder not found"}) // 400
+			return
+		}
+	}
+
+	err = fh.folderStore.MoveFolder(folder.ID, parentID)
+	if errors.Is(err, store.ErrFolderCycle) {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": err.Error()}) // 409
+		return
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "Folder not found"})
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error moving folder", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to move folder"}) // 500
+		return
+	}
+
+	movedFolder, err := fh.folderStore.GetFolderByID(folder.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error retrieving folder", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve folder"})
+		return
+	}
+
+	if movedFolder != nil {
+		fh.auditor.Record(r, store.AuditFolderUpdated, folderTarget(movedFolder), folderSummary(folder), folderSummary(movedFolder))
+		publishFolderEvent(fh.events, r, events.FolderUpdated, movedFolder)
+	}
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"folder": movedFolder}) // 200
+}
+
+// Notes and subfolders directly inside a folder. Works for shared folders too, which is how
+// someone a folder was shared with browses its contents. Takes the same paging parameters as the listings.
+func (fh *FolderHandler) HandleGetFolderContents(w http.ResponseWriter, r *http.Request) {
+	folder := fh.getFolder(w, r, policy.View)
+	if folder == nil {
+		return
+	}
+
+	// Listings are scoped by owner, so list as the folder's owner
+	listOptions, err := readListOptions(r, folder.UserID)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()}) // 400
+		return
+	}
+	// Subfolders are always returned in full, so only the notes page
+	folderOptions := listOptions
+	folderOptions.Cursor = ""
+	folderOptions.Limit = store.MaxListLimit
+
+	notes, nextCursor, err := fh.notesStore.ListNotesByUserID(store.NoteListOptions{
+		ListOptions: listOptions,
+		FolderID:    &folder.ID,
+	})
+	if errors.Is(err, store.ErrInvalidCursor) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()}) // 400
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error retrieving notes", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve notes"})
 		return
 	}
 
-	folders, err := fh.folderStore.ListFoldersByUserID(int(userId))
+	folders, _, err := fh.folderStore.ListFoldersByUserID(store.FolderListOptions{
+		ListOptions:    folderOptions,
+		ParentFolderID: &folder.ID,
+	})
 	if err != nil {
-		fh.logger.Printf("Error retrieving folders: %v", err)
+		logging.FromContext(r.Context()).Error("Error retrieving folders", "error", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve folders"})
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"folders": folders}) // 200
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{
+		"folder":      folder,
+		"folders":     folders,
+		"notes":       notes,
+		"next_cursor": cursorOrNil(nextCursor),
+	}) // 200
 }
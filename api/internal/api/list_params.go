@@ -0,0 +1,105 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/store"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/utils"
+)
+
+// Query string parsing shared by the note and folder listings:
+//
+//	?limit=50&cursor=...               page size and opaque cursor from the previous page's next_cursor
+//	?sort=created_at|updated_at|title  sort field (default created_at)
+//	?order=asc|desc                    sort direction (default desc)
+//	?is_favorite=true|false
+//	?created_after=...&created_before=...&updated_after=...&updated_before=...  RFC 3339 timestamps or YYYY-MM-DD dates
+func readListOptions(r *http.Request, userID int) (store.ListOptions, error) {
+	query := r.URL.Query()
+	opts := store.ListOptions{
+		UserID:   userID,
+		Cursor:   query.Get("cursor"),
+		SortDesc: true,
+	}
+
+	limit, err := utils.ReadIntQueryParam(r, "limit", store.DefaultListLimit)
+	if err != nil {
+		return opts, err
+	}
+	if limit < 1 || limit > store.MaxListLimit {
+		return opts, fmt.Errorf("limit must be between 1 and %d", store.MaxListLimit)
+	}
+	opts.Limit = limit
+
+	switch sortBy := query.Get("sort"); sortBy {
+	case "":
+		opts.SortBy = store.SortByCreatedAt
+	case store.SortByCreatedAt, store.SortByUpdatedAt, store.SortByTitle:
+		opts.SortBy = sortBy
+	default:
+		return opts, fmt.Errorf("sort must be one of created_at, updated_at or title")
+	}
+
+	switch query.Get("order") {
+	case "", "desc":
+	case "asc":
+		opts.SortDesc = false
+	default:
+		return opts, fmt.Errorf("order must be either asc or desc")
+	}
+
+	if value := query.Get("is_favorite"); value != "" {
+		isFavorite, err := strconv.ParseBool(value)
+		if err != nil {
+			return opts, fmt.Errorf("invalid is_favorite parameter")
+		}
+		opts.IsFavorite = &isFavorite
+	}
+
+	dateParams := map[string]**time.Time{
+		"created_after":  &opts.CreatedAfter,
+		"created_before": &opts.CreatedBefore,
+		"updated_after":  &opts.UpdatedAfter,
+		"updated_before": &opts.UpdatedBefore,
+	}
+	for param, dest := range dateParams {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+		t, err := parseTimeParam(value)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s parameter", param)
+		}
+		*dest = &t
+	}
+
+	return opts, nil
+}
+
+// parseTimeParam accepts a full RFC 3339 timestamp or a plain YYYY-MM-DD date (midnight UTC).
+func parseTimeParam(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
+
+// readOptionalFolderParam reads a folder ID filter where "none" means "not in any folder".
+func readOptionalFolderParam(r *http.Request, param string) (id *int, none bool, err error) {
+	value := r.URL.Query().Get(param)
+	switch value {
+	case "":
+		return nil, false, nil
+	case "none", "null":
+		return nil, true, nil
+	}
+	folderID, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid %s parameter", param)
+	}
+	return &folderID, false, nil
+}
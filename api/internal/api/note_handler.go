@@ -2,10 +2,16 @@ package api
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
 
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/diff"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/events"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/logging"
 	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/middleware"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/policy"
 	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/store"
 	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/utils"
 )
@@ -13,17 +19,45 @@ import (
 type NoteHandler struct {
 	// Dependencies for the NoteHandler can be added here, such as a NoteStore or Logger
 	notesStore store.NoteStore
-	logger     *log.Logger
+	policy     *policy.Policy // Who can see, edit or delete which note
+	events     events.Publisher
+	auditor    *Auditor
 }
 
 // Constructor for NoteHandler
-func NewNoteHandler(notesStore store.NoteStore, logger *log.Logger) *NoteHandler {
+func NewNoteHandler(notesStore store.NoteStore, notePolicy *policy.Policy, publisher events.Publisher, auditor *Auditor) *NoteHandler {
 	return &NoteHandler{
 		notesStore: notesStore,
-		logger:     logger,
+		policy:     notePolicy,
+		events:     publisher,
+		auditor:    auditor,
 	}
 }
 
+// checkNoteFolder makes sure a note is only ever filed in one of its owner's folders.
+// On failure it writes the error response itself and returns false.
+func (nh *NoteHandler) checkNoteFolder(w http.ResponseWriter, r *http.Request, folderID *int, userID int) bool {
+	if folderID == nil {
+		return true
+	}
+	owned, err := nh.policy.OwnsFolder(*folderID, userID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error retrieving folder", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve folder"})
+		return false
+	}
+	if !owned {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Folder not found"}) // 400
+		return false
+	}
+	return true
+}
+
+// getNote loads the {id} note if the current user has at least the needed permission on it.
+func (nh *NoteHandler) getNote(w http.ResponseWriter, r *http.Request, needed policy.Permission) (*store.Note, policy.Permission) {
+	return authorizeNote(w, r, nh.notesStore, nh.policy, needed)
+}
+
 // NoteHandler methods for handling HTTP requests related to notes can be added here.
 // CRUD
 
@@ -34,7 +68,7 @@ func (nh *NoteHandler) HandleCreateNote(w http.ResponseWriter, r *http.Request)
 
 	err := json.NewDecoder(r.Body).Decode(&note)
 	if err != nil {
-		nh.logger.Printf("Invalid request payload: %v", err)
+		logging.FromContext(r.Context()).Warn("Invalid request payload", "error", err)
 		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid request payload"}) // 400
 		return
 	}
@@ -42,49 +76,33 @@ func (nh *NoteHandler) HandleCreateNote(w http.ResponseWriter, r *http.Request)
 	// Ensure current user is the owner of the note
 	currentUser := middleware.GetUser(r)
 	if currentUser.IsAnonymous() {
-		nh.logger.Printf("Unauthorized: anonymous user cannot create notes")
+		logging.FromContext(r.Context()).Warn("Unauthorized: anonymous user cannot create notes")
 		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
 		return
 	}
 
 	note.UserID = currentUser.ID // Set the note's UserID to the current user's ID
+	if !nh.checkNoteFolder(w, r, note.FolderID, currentUser.ID) {
+		return
+	}
 
 	createdNote, err := nh.notesStore.CreateNote(&note)
 	if err != nil {
-		nh.logger.Printf("Error creating note: %v", err)
+		logging.FromContext(r.Context()).Error("Error creating note", "error", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to create note"}) // 500
 		return
 	}
 
+	nh.auditor.Record(r, store.AuditNoteCreated, noteTarget(createdNote), nil, noteSummary(createdNote))
+	publishNoteEvent(nh.events, r, events.NoteCreated, createdNote)
 	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"note": createdNote}) // 201
 
 }
 
 func (nh *NoteHandler) HandleGetNoteByID(w http.ResponseWriter, r *http.Request) {
-	// Implementation for getting a note by ID
-	noteId, err := utils.ReadIDParam(r, "id")
-	if err != nil {
-		nh.logger.Printf("Invalid note ID parameter: %v", err)
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid note ID parameter"}) // 400
-		return
-	}
-
-	note, err := nh.notesStore.GetNoteByID(int(noteId))
-	if err != nil {
-		nh.logger.Printf("Error retrieving note: %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve note"})
-		return
-	}
+	// Owners and anyone the note is shared with can read it
+	note, _ := nh.getNote(w, r, policy.View)
 	if note == nil {
-		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "Note not found"})
-		return
-	}
-
-	// Ensure current user is the owner of the note
-	currentUser := middleware.GetUser(r)
-	if currentUser.IsAnonymous() || note.UserID != currentUser.ID {
-		nh.logger.Printf("Unauthorized access to note ID %d by user ID %d", note.ID, currentUser.ID)
-		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
 		return
 	}
 
@@ -93,33 +111,12 @@ func (nh *NoteHandler) HandleGetNoteByID(w http.ResponseWriter, r *http.Request)
 
 func (nh *NoteHandler) HandleUpdateNote(w http.ResponseWriter, r *http.Request) {
 
-	// Implementation for updating a note
-	paramsNoteId, err := utils.ReadIDParam(r, "id")
-	if err != nil {
-		nh.logger.Printf("Invalid note ID parameter: %v", err)
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid note ID parameter"}) // 400
-		return
-	}
-
-	// Fetch existing note
-	existingNote, err := nh.notesStore.GetNoteByID(int(paramsNoteId))
-	if err != nil {
-		nh.logger.Printf("Error retrieving note: %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve note"})
-		return
-	}
+	// Owners and editors can update the note
+	existingNote, permission := nh.getNote(w, r, policy.Edit)
 	if existingNote == nil {
-		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "Note not found"})
-		return
-	}
-
-	// Ensure current user is the owner of the note
-	currentUser := middleware.GetUser(r)
-	if currentUser.IsAnonymous() || existingNote.UserID != currentUser.ID {
-		nh.logger.Printf("Unauthorized access to note ID %d by user ID %d", existingNote.ID, currentUser.ID)
-		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
 		return
 	}
+	before := noteSummary(existingNote)
 
 	// struct
 	var updatedNoteRequest struct {
@@ -129,9 +126,9 @@ func (nh *NoteHandler) HandleUpdateNote(w http.ResponseWriter, r *http.Request)
 		FolderId   *int    `json:"folder_id"`
 	}
 
-	err = json.NewDecoder(r.Body).Decode(&updatedNoteRequest)
+	err := json.NewDecoder(r.Body).Decode(&updatedNoteRequest)
 	if err != nil {
-		nh.logger.Printf("Invalid request payload: %v", err)
+		logging.FromContext(r.Context()).Warn("Invalid request payload", "error", err)
 		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid request payload"}) // 400
 		return
 	}
@@ -143,93 +140,249 @@ func (nh *NoteHandler) HandleUpdateNote(w http.ResponseWriter, r *http.Request)
 	if updatedNoteRequest.Content != nil {
 		existingNote.Content = *updatedNoteRequest.Content
 	}
-	if updatedNoteRequest.IsFavorite != nil {
+	if updatedNoteRequest.IsFavorite != nil && permission == policy.Owner {
 		existingNote.IsFavorite = *updatedNoteRequest.IsFavorite
 	}
-	// FolderId can be nil to remove from folder
-	if updatedNoteRequest.FolderId != nil {
-		existingNote.FolderID = updatedNoteRequest.FolderId
-	} else {
-		existingNote.FolderID = nil
+	// Only the owner files the note into folders; editors leave it where it is
+	if permission == policy.Owner {
+		// FolderId can be nil to remove from folder
+		if updatedNoteRequest.FolderId != nil {
+			existingNote.FolderID = updatedNoteRequest.FolderId
+		} else {
+			existingNote.FolderID = nil
+		}
+
+		if !nh.checkNoteFolder(w, r, existingNote.FolderID, existingNote.UserID) {
+			return
+		}
 	}
 
 	// Save the updated note
 	err = nh.notesStore.UpdateNote(existingNote)
 	if err != nil {
-		nh.logger.Printf("Error updating note: %v", err)
+		logging.FromContext(r.Context()).Error("Error updating note", "error", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to update note"}) // 500
 		return
 	}
 
+	nh.auditor.Record(r, store.AuditNoteUpdated, noteTarget(existingNote), before, noteSummary(existingNote))
+	publishNoteEvent(nh.events, r, events.NoteUpdated, existingNote)
 	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"note": existingNote}) // 200
 }
 
 func (nh *NoteHandler) HandleDeleteNote(w http.ResponseWriter, r *http.Request) {
 
-	noteId, err := utils.ReadIDParam(r, "id")
+	// Only the owner can delete the note
+	note, _ := nh.getNote(w, r, policy.Owner)
+	if note == nil {
+		return
+	}
+
+	// Delete the note
+	err := nh.notesStore.DeleteNote(note.ID)
 	if err != nil {
-		nh.logger.Printf("Invalid note ID parameter: %v", err)
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid note ID parameter"}) // 400
+		logging.FromContext(r.Context()).Error("Error deleting note", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to delete note"}) // 500
 		return
 	}
 
-	// Fetch existing note
-	_, err = nh.notesStore.GetNoteByID(int(noteId))
+	nh.auditor.Record(r, store.AuditNoteDeleted, noteTarget(note), noteSummary(note), nil)
+	publishNoteEvent(nh.events, r, events.NoteDeleted, note)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "Note deleted successfully"}) // 200
+}
+
+func (nh *NoteHandler) HandleListNotesByUserID(w http.ResponseWriter, r *http.Request) {
+
+	// Implementation for listing notes by user ID
+	userId, err := utils.ReadIDParam(r, "user_id")
 	if err != nil {
-		nh.logger.Printf("Error retrieving note: %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve note"})
+		logging.FromContext(r.Context()).Warn("Invalid user ID parameter", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid user ID parameter"}) // 400
 		return
 	}
 
-	// Ensure current user is the owner of the note
+	// Ensure current user is the same as the requested user ID
 	currentUser := middleware.GetUser(r)
-	noteOwnerID, err := nh.notesStore.GetNoteOwner(int(noteId))
+	if currentUser.IsAnonymous() || currentUser.ID != int(userId) {
+		logging.FromContext(r.Context()).Warn("Unauthorized access to notes of user", "notes_of_user_id", userId)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
+		return
+	}
+
+	listOptions, err := readListOptions(r, int(userId))
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()}) // 400
+		return
+	}
+	opts := store.NoteListOptions{ListOptions: listOptions}
+
+	// ?folder_id=<id> or ?folder_id=none for notes outside any folder
+	opts.FolderID, opts.NoFolder, err = readOptionalFolderParam(r, "folder_id")
 	if err != nil {
-		nh.logger.Printf("Error retrieving note owner: %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve note owner"})
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()}) // 400
+		return
+	}
+
+	// Optional tag filtering: ?tags=a,b&match=all|any (defaults to any)
+	if tagsParam := r.URL.Query().Get("tags"); tagsParam != "" {
+		for _, name := range strings.Split(tagsParam, ",") {
+			name = normalizeTagName(name)
+			if name != "" && !utils.StringInSlice(name, opts.TagFilter.Names) {
+				opts.TagFilter.Names = append(opts.TagFilter.Names, name)
+			}
+		}
+	}
+	switch r.URL.Query().Get("match") {
+	case "", "any":
+	case "all":
+		opts.TagFilter.MatchAll = true
+	default:
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "match must be either all or any"}) // 400
 		return
 	}
-	if currentUser.IsAnonymous() || noteOwnerID != currentUser.ID {
-		nh.logger.Printf("Unauthorized access to note ID %d by user ID %d", noteId, currentUser.ID)
+
+	notes, nextCursor, err := nh.notesStore.ListNotesByUserID(opts)
+	if errors.Is(err, store.ErrInvalidCursor) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()}) // 400
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error retrieving notes", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve notes"})
+		return
+	}
+
+	// next_cursor is null on the last page
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"notes": notes, "next_cursor": cursorOrNil(nextCursor)}) // 200
+}
+
+// cursorOrNil turns an empty next cursor into a JSON null.
+func cursorOrNil(cursor string) any {
+	if cursor == "" {
+		return nil
+	}
+	return cursor
+}
+
+// Search limits
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// Full-text search over the current user's notes: GET /notes/search?q=...&limit=...
+func (nh *NoteHandler) HandleSearchNotes(w http.ResponseWriter, r *http.Request) {
+
+	currentUser := middleware.GetUser(r)
+	if currentUser.IsAnonymous() {
+		logging.FromContext(r.Context()).Warn("Unauthorized: anonymous user cannot search notes")
 		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
 		return
 	}
 
-	// Delete the note
-	err = nh.notesStore.DeleteNote(int(noteId))
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Missing q parameter"}) // 400
+		return
+	}
+
+	limit, err := utils.ReadIntQueryParam(r, "limit", defaultSearchLimit)
+	if err != nil || limit < 1 || limit > maxSearchLimit {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "limit must be between 1 and 100"}) // 400
+		return
+	}
+
+	results, err := nh.notesStore.SearchNotes(currentUser.ID, query, limit)
+	if errors.Is(err, store.ErrEmptySearchQuery) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()}) // 400
+		return
+	}
 	if err != nil {
-		nh.logger.Printf("Error deleting note: %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to delete note"}) // 500
+		logging.FromContext(r.Context()).Error("Error searching notes", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to search notes"})
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "Note deleted successfully"}) // 200
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"results": results}) // 200
 }
 
-func (nh *NoteHandler) HandleListNotesByUserID(w http.ResponseWriter, r *http.Request) {
+// Revision history
 
-	// Implementation for listing notes by user ID
-	userId, err := utils.ReadIDParam(r, "user_id")
+func (nh *NoteHandler) HandleListNoteRevisions(w http.ResponseWriter, r *http.Request) {
+	note, _ := nh.getNote(w, r, policy.View)
+	if note == nil {
+		return
+	}
+
+	revisions, err := nh.notesStore.ListNoteRevisions(note.ID)
 	if err != nil {
-		nh.logger.Printf("Invalid user ID parameter: %v", err)
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid user ID parameter"}) // 400
+		logging.FromContext(r.Context()).Error("Error retrieving note revisions", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve note revisions"})
 		return
 	}
 
-	// Ensure current user is the same as the requested user ID
-	currentUser := middleware.GetUser(r)
-	if currentUser.IsAnonymous() || currentUser.ID != int(userId) {
-		nh.logger.Printf("Unauthorized access to notes of user ID %d by user ID %d", userId, currentUser.ID)
-		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"revisions": revisions}) // 200
+}
+
+// Unified diff from a revision to the note's current content
+func (nh *NoteHandler) HandleGetNoteRevisionDiff(w http.ResponseWriter, r *http.Request) {
+	note, _ := nh.getNote(w, r, policy.View)
+	if note == nil {
 		return
 	}
 
-	notes, err := nh.notesStore.ListNotesByUserID(int(userId))
+	revisionNumber, err := utils.ReadIDParam(r, "rev")
 	if err != nil {
-		nh.logger.Printf("Error retrieving notes: %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve notes"})
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid revision parameter"}) // 400
+		return
+	}
+
+	revision, err := nh.notesStore.GetNoteRevision(note.ID, int(revisionNumber))
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error retrieving note revision", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve note revision"})
+		return
+	}
+	if revision == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "Revision not found"})
+		return
+	}
+
+	// Include the title as the first line so renames show up in the diff too
+	from := revision.Title + "\n\n" + revision.Content
+	to := note.Title + "\n\n" + note.Content
+	unified := diff.Unified(from, to, fmt.Sprintf("revision %d", revision.Revision), "current", 3)
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{
+		"revision": revision.Revision,
+		"diff":     unified,
+	}) // 200
+}
+
+func (nh *NoteHandler) HandleRestoreNoteRevision(w http.ResponseWriter, r *http.Request) {
+	note, _ := nh.getNote(w, r, policy.Edit)
+	if note == nil {
+		return
+	}
+
+	revisionNumber, err := utils.ReadIDParam(r, "rev")
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid revision parameter"}) // 400
+		return
+	}
+
+	restoredNote, err := nh.notesStore.RestoreNoteRevision(note.ID, int(revisionNumber))
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error restoring note revision", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to restore note revision"}) // 500
+		return
+	}
+	if restoredNote == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "Revision not found"})
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"notes": notes}) // 200
+	nh.auditor.Record(r, store.AuditNoteUpdated, noteTarget(restoredNote), noteSummary(note), noteSummary(restoredNote))
+	publishNoteEvent(nh.events, r, events.NoteUpdated, restoredNote)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"note": restoredNote}) // 200
 }
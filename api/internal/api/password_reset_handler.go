@@ -0,0 +1,192 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/lockout"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/logging"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/mailer"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/store"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/tokens"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/utils"
+)
+
+// How long a password reset link stays valid
+const passwordResetTTL = 30 * time.Minute
+
+type PasswordResetHandler struct {
+	userStore     store.UserStore
+	tokenStore    store.TokenStore
+	apiTokenStore store.APITokenStore
+	mailer        mailer.Mailer
+	background    *sync.WaitGroup // The reset email is sent in the background, shutdown waits for it
+	appURL        string          // Base URL of the UI, for the link in the email
+	loginGuard    *lockout.Tracker
+	auditor       *Auditor
+}
+
+// Constructor for PasswordResetHandler
+func NewPasswordResetHandler(userStore store.UserStore, tokenStore store.TokenStore, apiTokenStore store.APITokenStore, mail mailer.Mailer, background *sync.WaitGroup, appURL string, loginGuard *lockout.Tracker, auditor *Auditor) *PasswordResetHandler {
+	return &PasswordResetHandler{
+		userStore:     userStore,
+		tokenStore:    tokenStore,
+		apiTokenStore: apiTokenStore,
+		mailer:        mail,
+		background:    background,
+		appURL:        strings.TrimRight(appURL, "/"),
+		loginGuard:    loginGuard,
+		auditor:       auditor,
+	}
+}
+
+// Emails a password reset link: {"email": "..."}.
+// Always answers the same way so it cannot be used to find out which emails have an account.
+func (ph *PasswordResetHandler) HandleRequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || strings.TrimSpace(req.Email) == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "email is required"}) // 400
+		return
+	}
+
+	response := utils.Envelope{"message": "If an account exists for that email, a password reset link has been sent"}
+
+	user, err := ph.userStore.GetUserByEmail(strings.TrimSpace(req.Email))
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error fetching user", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"}) // 500
+		return
+	}
+	if user == nil {
+		utils.WriteJSON(w, http.StatusAccepted, response) // 202
+		return
+	}
+
+	err = ph.SendResetLink(r.Context(), user)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error creating password reset token", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"}) // 500
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusAccepted, response) // 202
+}
+
+// SendResetLink replaces any earlier reset link of the user with a new one and emails it.
+// The email goes out in the background, so the response takes as long whether or not the account exists.
+// ctx is the one of the request, for its logger.
+func (ph *PasswordResetHandler) SendResetLink(ctx context.Context, user *store.User) error {
+	// Only the most recent link works
+	err := ph.tokenStore.DeleteAllTokensForUser(tokens.ScopePasswordReset, user.ID)
+	if err != nil {
+		return err
+	}
+
+	token, err := ph.tokenStore.CreateNewToken(user.ID, passwordResetTTL, tokens.ScopePasswordReset)
+	if err != nil {
+		return err
+	}
+
+	msg := mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"Someone asked to reset the password of your notes account. If it was you, open this link within %d minutes:\n\n"+
+			"%s/reset-password?token=%s\n\n"+
+			"If it was not you, you can ignore this email. Your password has not been changed.\n",
+			user.Username, int(passwordResetTTL.Minutes()), ph.appURL, url.QueryEscape(token.Plaintext)),
+	}
+	if user.PasswordResetRequired {
+		msg.Body = fmt.Sprintf("Hi %s,\n\n"+
+			"An administrator has asked you to choose a new password for your notes account. "+
+			"You will not be able to log in until you do. Open this link within %d minutes:\n\n"+
+			"%s/reset-password?token=%s\n\n"+
+			"If the link has expired, request a new one from the \"Forgot password\" page.\n",
+			user.Username, int(passwordResetTTL.Minutes()), ph.appURL, url.QueryEscape(token.Plaintext))
+	}
+
+	ph.background.Go(func() {
+		err := ph.mailer.Send(msg)
+		if err != nil {
+			logging.FromContext(ctx).Error("Error sending password reset email", "user_id", user.ID, "error", err)
+		}
+	})
+	return nil
+}
+
+// Sets a new password using the token from the email: {"token": "...", "new_password": "..."}.
+// Every session of the user is logged out afterwards.
+func (ph *PasswordResetHandler) HandleConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"new_password"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("Invalid request payload", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid request payload"}) // 400
+		return
+	}
+	if req.Token == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "token is required"}) // 400
+		return
+	}
+
+	err = validatePassword(req.NewPassword)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()}) // 400
+		return
+	}
+
+	user, err := ph.userStore.GetUserToken(tokens.ScopePasswordReset, req.Token)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error fetching user", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"}) // 500
+		return
+	}
+	if user == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid or expired password reset token"}) // 400
+		return
+	}
+
+	err = ph.userStore.UpdateUserPassword(user.ID, req.NewPassword)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error updating user password", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to update password"}) // 500
+		return
+	}
+
+	// The reset link is single use, and whoever had the old password is logged out and loses their API tokens
+	var sessions, apiTokens int64
+	err = ph.tokenStore.DeleteAllTokensForUser(tokens.ScopePasswordReset, user.ID)
+	if err == nil {
+		sessions, err = ph.tokenStore.DeleteAllSessions(user.ID)
+	}
+	if err == nil {
+		apiTokens, err = ph.apiTokenStore.DeleteAllAPITokens(user.ID)
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error revoking tokens", "user_id", user.ID, "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"}) // 500
+		return
+	}
+
+	// The new password should not have to wait out the lockout the old one earned
+	err = ph.loginGuard.ResetUser(r.Context(), user.Username)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error clearing login failures", "user_id", user.ID, "error", err)
+	}
+
+	// Whoever holds the emailed link acts as the user
+	ph.auditor.RecordAs(r, user.ID, store.AuditPasswordReset, userTarget(user.ID), nil, utils.Envelope{"revoked_tokens": sessions, "revoked_api_tokens": apiTokens})
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "Password has been reset, please log in again"}) // 200
+}
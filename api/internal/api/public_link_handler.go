@@ -0,0 +1,277 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/lockout"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/logging"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/middleware"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/policy"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/store"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/utils"
+	"github.com/go-chi/chi/v5"
+)
+
+type PublicLinkHandler struct {
+	linkStore  store.PublicLinkStore
+	notesStore store.NoteStore
+	policy     *policy.Policy
+	linkGuard  *lockout.Tracker // Slows down guessing of link passwords, per link and per IP address
+	auditor    *Auditor
+}
+
+// Used for decoding create public link requests. Every field is optional.
+type createPublicLinkRequest struct {
+	ExpiresAt *time.Time `json:"expires_at"`
+	Password  string     `json:"password"`
+	MaxViews  *int       `json:"max_views"`
+}
+
+// Constructor for PublicLinkHandler
+func NewPublicLinkHandler(linkStore store.PublicLinkStore, notesStore store.NoteStore, linkPolicy *policy.Policy, linkGuard *lockout.Tracker, auditor *Auditor) *PublicLinkHandler {
+	return &PublicLinkHandler{
+		linkStore:  linkStore,
+		notesStore: notesStore,
+		policy:     linkPolicy,
+		linkGuard:  linkGuard,
+		auditor:    auditor,
+	}
+}
+
+// Creates a public link for the {id} note. The slug is only returned here, it cannot be recovered later.
+func (ph *PublicLinkHandler) HandleCreatePublicLink(w http.ResponseWriter, r *http.Request) {
+	note, _ := authorizeNote(w, r, ph.notesStore, ph.policy, policy.Owner)
+	if note == nil {
+		return
+	}
+
+	var req createPublicLinkRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("Invalid request payload", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid request payload"}) // 400
+		return
+	}
+
+	// Validation
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "expires_at must be in the future"}) // 400
+		return
+	}
+	if req.MaxViews != nil && *req.MaxViews < 1 {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "max_views must be at least 1"}) // 400
+		return
+	}
+
+	link := &store.PublicLink{
+		NoteID:    note.ID,
+		UserID:    note.UserID,
+		ExpiresAt: req.ExpiresAt,
+		MaxViews:  req.MaxViews,
+	}
+	if req.Password != "" {
+		link.Password.Set(req.Password)
+	}
+
+	createdLink, err := ph.linkStore.CreatePublicLink(link)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error creating public link", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to create public link"}) // 500
+		return
+	}
+
+	// The slug is the secret of the link, so it stays out of the trail
+	ph.auditor.Record(r, store.AuditPublicLinkCreated, auditTarget{Type: store.AuditTargetPublicLink, ID: createdLink.ID, OwnerID: createdLink.UserID}, nil, utils.Envelope{"note_id": createdLink.NoteID, "expires_at": createdLink.ExpiresAt})
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"public_link": createdLink}) // 201
+}
+
+func (ph *PublicLinkHandler) HandleListPublicLinks(w http.ResponseWriter, r *http.Request) {
+	note, _ := authorizeNote(w, r, ph.notesStore, ph.policy, policy.Owner)
+	if note == nil {
+		return
+	}
+
+	links, err := ph.linkStore.ListPublicLinksForNote(note.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error retrieving public links", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve public links"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"public_links": links}) // 200
+}
+
+func (ph *PublicLinkHandler) HandleRevokePublicLink(w http.ResponseWriter, r *http.Request) {
+	linkId, err := utils.ReadIDParam(r, "id")
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("Invalid public link ID parameter", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid public link ID parameter"}) // 400
+		return
+	}
+
+	link, err := ph.linkStore.GetPublicLinkByID(int(linkId))
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error retrieving public link", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve public link"})
+		return
+	}
+	if link == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "Public link not found"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser.IsAnonymous() || link.UserID != currentUser.ID {
+		logging.FromContext(r.Context()).Warn("Unauthorized access to public link", "public_link_id", link.ID)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
+		return
+	}
+
+	err = ph.linkStore.RevokePublicLink(link.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "Public link already revoked"})
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error revoking public link", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to revoke public link"}) // 500
+		return
+	}
+
+	ph.auditor.Record(r, store.AuditPublicLinkRevoked, auditTarget{Type: store.AuditTargetPublicLink, ID: link.ID, OwnerID: link.UserID}, utils.Envelope{"note_id": link.NoteID, "expires_at": link.ExpiresAt}, nil)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "Public link revoked successfully"}) // 200
+}
+
+// Page used for ?format=html. Note content is the HTML produced by the editor in the UI.
+var publicNoteTemplate = template.Must(template.New("public_note").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{.Title}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 48rem; margin: 2rem auto; padding: 0 1rem; line-height: 1.6; color: #222; }
+img { max-width: 100%; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<article>{{.Content}}</article>
+</body>
+</html>
+`))
+
+// Serves a note through its public link: GET /p/{slug}. No account needed.
+// Password-protected links take the password in the X-Link-Password header, never in the URL, which ends up in logs and histories.
+// Responds with JSON by default, or an HTML page with ?format=html or an Accept: text/html header.
+func (ph *PublicLinkHandler) HandleViewPublicLink(w http.ResponseWriter, r *http.Request) {
+	// Not found, revoked, expired and used up all look the same from outside
+	notFound := func() {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "Link not found or no longer available"})
+	}
+
+	link, err := ph.linkStore.GetPublicLinkBySlug(chi.URLParam(r, "slug"))
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error retrieving public link", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return
+	}
+	if link == nil || !link.IsActive(time.Now()) {
+		notFound()
+		return
+	}
+
+	if link.HasPassword {
+		given := r.Header.Get("X-Link-Password")
+		if given == "" {
+			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "This link requires a password", "password_required": true}) // 401
+			return
+		}
+
+		// Each attempt is counted as a failure up front, and taken back if the password is right
+		linkKey := strconv.Itoa(link.ID)
+		ip := utils.ClientIP(r)
+		wait, err := ph.linkGuard.Attempt(r.Context(), linkKey, ip)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Error checking link password failures", "error", err)
+		}
+		if wait > 0 {
+			seconds := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			utils.WriteJSON(w, http.StatusTooManyRequests, utils.Envelope{
+				"error":       "too many invalid passwords, try again later",
+				"retry_after": seconds,
+			}) // 429
+			return
+		}
+
+		matches, err := link.Password.Matches(given)
+		if err != nil || !matches {
+			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Invalid password", "password_required": true}) // 401
+			return
+		}
+		err = ph.linkGuard.Succeed(r.Context(), linkKey, ip)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Error clearing link password failures", "error", err)
+		}
+	}
+
+	note, err := ph.notesStore.GetNoteByID(link.NoteID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error retrieving note", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return
+	}
+	if note == nil {
+		notFound() // the note is in the trash
+		return
+	}
+
+	// Count the view last, and atomically, so concurrent requests cannot exceed max_views
+	counted, err := ph.linkStore.RecordView(link.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error recording public link view", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"})
+		return
+	}
+	if !counted {
+		notFound()
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Robots-Tag", "noindex")
+
+	if r.URL.Query().Get("format") == "html" || strings.Contains(r.Header.Get("Accept"), "text/html") {
+		// The content is user-written HTML. The sandbox CSP stops any script in it from running on our origin.
+		w.Header().Set("Content-Security-Policy", "sandbox; default-src 'none'; style-src 'unsafe-inline'; img-src https: data:")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		err = publicNoteTemplate.Execute(w, struct {
+			Title   string
+			Content template.HTML
+		}{
+			Title:   note.Title,
+			Content: template.HTML(note.Content),
+		})
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Error rendering public note", "error", err)
+		}
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"note": utils.Envelope{
+		"title":      note.Title,
+		"content":    note.Content,
+		"updated_at": note.UpdatedAt,
+	}}) // 200
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"regexp"
+
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/logging"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/middleware"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/store"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/utils"
+	"github.com/go-chi/chi/v5"
+)
+
+var sessionIDRegex = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+type SessionHandler struct {
+	tokenStore store.TokenStore
+	auditor    *Auditor
+}
+
+// Constructor for SessionHandler
+func NewSessionHandler(tokenStore store.TokenStore, auditor *Auditor) *SessionHandler {
+	return &SessionHandler{
+		tokenStore: tokenStore,
+		auditor:    auditor,
+	}
+}
+
+// Lists the devices the current user is logged in on
+func (sh *SessionHandler) HandleListSessions(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+	if currentUser.IsAnonymous() {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
+		return
+	}
+
+	sessions, err := sh.tokenStore.ListSessions(currentUser.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error retrieving sessions", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve sessions"})
+		return
+	}
+
+	currentHash := middleware.GetTokenHash(r)
+	for _, session := range sessions {
+		session.Current = session.IsToken(currentHash)
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"sessions": sessions}) // 200
+}
+
+// Logs out one session. Revoking the current session is the same as logging out.
+func (sh *SessionHandler) HandleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+	if currentUser.IsAnonymous() {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
+		return
+	}
+
+	sessionID := chi.URLParam(r, "id")
+	if !sessionIDRegex.MatchString(sessionID) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid session ID parameter"}) // 400
+		return
+	}
+
+	err := sh.tokenStore.DeleteSession(currentUser.ID, sessionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "Session not found"})
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error revoking session", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to revoke session"}) // 500
+		return
+	}
+
+	sh.auditor.Record(r, store.AuditTokenRevoked, auditTarget{Type: store.AuditTargetSession, OwnerID: currentUser.ID}, nil, utils.Envelope{"session_id": sessionID})
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "Session revoked successfully"}) // 200
+}
+
+// Logs out every session except the one making the request
+func (sh *SessionHandler) HandleRevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+	currentHash := middleware.GetTokenHash(r)
+	if currentUser.IsAnonymous() || currentHash == nil {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
+		return
+	}
+
+	revoked, err := sh.tokenStore.DeleteOtherSessions(currentUser.ID, currentHash)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error revoking sessions", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to revoke sessions"}) // 500
+		return
+	}
+
+	sh.auditor.Record(r, store.AuditTokenRevoked, auditTarget{Type: store.AuditTargetSession, OwnerID: currentUser.ID}, nil, utils.Envelope{"reason": "other_sessions", "revoked": revoked})
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"revoked": revoked}) // 200
+}
@@ -0,0 +1,202 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/logging"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/middleware"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/policy"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/store"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/utils"
+)
+
+type ShareHandler struct {
+	shareStore  store.ShareStore
+	userStore   store.UserStore // To look up who a note is being shared with
+	notesStore  store.NoteStore
+	folderStore store.FolderStore
+	policy      *policy.Policy
+	auditor     *Auditor
+}
+
+// Used for decoding share requests
+type createShareRequest struct {
+	Username   string `json:"username"`
+	Permission string `json:"permission"` // "viewer" or "editor"
+}
+
+// Constructor for ShareHandler
+func NewShareHandler(shareStore store.ShareStore, userStore store.UserStore, notesStore store.NoteStore, folderStore store.FolderStore, sharePolicy *policy.Policy, auditor *Auditor) *ShareHandler {
+	return &ShareHandler{
+		shareStore:  shareStore,
+		userStore:   userStore,
+		notesStore:  notesStore,
+		folderStore: folderStore,
+		policy:      sharePolicy,
+		auditor:     auditor,
+	}
+}
+
+// Share a note: POST /notes/{id}/shares {"username": "eve", "permission": "viewer"}
+func (sh *ShareHandler) HandleShareNote(w http.ResponseWriter, r *http.Request) {
+	note := sh.getOwnedNote(w, r)
+	if note == nil {
+		return
+	}
+	sh.createShare(w, r, &store.Share{OwnerID: note.UserID, NoteID: &note.ID})
+}
+
+// Share a folder and everything in it: POST /folders/{id}/shares {"username": "eve", "permission": "editor"}
+func (sh *ShareHandler) HandleShareFolder(w http.ResponseWriter, r *http.Request) {
+	folder := sh.getOwnedFolder(w, r)
+	if folder == nil {
+		return
+	}
+	sh.createShare(w, r, &store.Share{OwnerID: folder.UserID, FolderID: &folder.ID})
+}
+
+func (sh *ShareHandler) HandleListNoteShares(w http.ResponseWriter, r *http.Request) {
+	note := sh.getOwnedNote(w, r)
+	if note == nil {
+		return
+	}
+
+	shares, err := sh.shareStore.ListSharesForNote(note.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error retrieving shares", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve shares"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"shares": shares}) // 200
+}
+
+func (sh *ShareHandler) HandleListFolderShares(w http.ResponseWriter, r *http.Request) {
+	folder := sh.getOwnedFolder(w, r)
+	if folder == nil {
+		return
+	}
+
+	shares, err := sh.shareStore.ListSharesForFolder(folder.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error retrieving shares", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve shares"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"shares": shares}) // 200
+}
+
+// Stop sharing. Only the owner of the shared item can remove a share.
+func (sh *ShareHandler) HandleDeleteShare(w http.ResponseWriter, r *http.Request) {
+	shareId, err := utils.ReadIDParam(r, "id")
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("Invalid share ID parameter", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid share ID parameter"}) // 400
+		return
+	}
+
+	share, err := sh.shareStore.GetShareByID(int(shareId))
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error retrieving share", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve share"})
+		return
+	}
+	if share == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "Share not found"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser.IsAnonymous() || share.OwnerID != currentUser.ID {
+		logging.FromContext(r.Context()).Warn("Unauthorized access to share", "share_id", share.ID)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
+		return
+	}
+
+	err = sh.shareStore.DeleteShare(share.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error deleting share", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to delete share"}) // 500
+		return
+	}
+
+	sh.auditor.Record(r, store.AuditShareDeleted, auditTarget{Type: store.AuditTargetShare, ID: share.ID, OwnerID: share.OwnerID}, shareSummary(share), nil)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "Share removed successfully"}) // 200
+}
+
+// Notes and folders other users shared with the current user
+func (sh *ShareHandler) HandleListSharedWithMe(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+	if currentUser.IsAnonymous() {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
+		return
+	}
+
+	notes, folders, err := sh.shareStore.ListSharedWithUser(currentUser.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error retrieving shared items", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve shared items"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"notes": notes, "folders": folders}) // 200
+}
+
+// createShare validates the request body and stores the share. share must already have its owner and target set.
+func (sh *ShareHandler) createShare(w http.ResponseWriter, r *http.Request, share *store.Share) {
+	var req createShareRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("Invalid request payload", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid request payload"}) // 400
+		return
+	}
+
+	if req.Permission != store.SharePermissionViewer && req.Permission != store.SharePermissionEditor {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "permission must be either viewer or editor"}) // 400
+		return
+	}
+
+	recipient, err := sh.userStore.GetUserByUsername(strings.TrimSpace(req.Username))
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error fetching user", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to fetch user"})
+		return
+	}
+	if recipient == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "User not found"})
+		return
+	}
+	if recipient.ID == share.OwnerID {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "You cannot share with yourself"}) // 400
+		return
+	}
+
+	share.SharedWithUserID = recipient.ID
+	share.SharedWithUsername = recipient.Username
+	share.Permission = req.Permission
+
+	createdShare, err := sh.shareStore.CreateShare(share)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error creating share", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to create share"}) // 500
+		return
+	}
+
+	sh.auditor.Record(r, store.AuditShareCreated, auditTarget{Type: store.AuditTargetShare, ID: createdShare.ID, OwnerID: createdShare.OwnerID}, nil, shareSummary(createdShare))
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"share": createdShare}) // 201
+}
+
+// getOwnedNote loads the {id} note. Only owners manage shares.
+func (sh *ShareHandler) getOwnedNote(w http.ResponseWriter, r *http.Request) *store.Note {
+	note, _ := authorizeNote(w, r, sh.notesStore, sh.policy, policy.Owner)
+	return note
+}
+
+// getOwnedFolder loads the {id} folder. Only owners manage shares.
+func (sh *ShareHandler) getOwnedFolder(w http.ResponseWriter, r *http.Request) *store.Folder {
+	return authorizeFolder(w, r, sh.folderStore, sh.policy, policy.Owner)
+}
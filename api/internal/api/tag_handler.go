@@ -0,0 +1,307 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/logging"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/middleware"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/policy"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/store"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/utils"
+)
+
+type TagHandler struct {
+	tagStore   store.TagStore
+	notesStore store.NoteStore // To check who can tag a note
+	policy     *policy.Policy
+}
+
+// Constructor for TagHandler
+func NewTagHandler(tagStore store.TagStore, notesStore store.NoteStore, accessPolicy *policy.Policy) *TagHandler {
+	return &TagHandler{
+		tagStore:   tagStore,
+		notesStore: notesStore,
+		policy:     accessPolicy,
+	}
+}
+
+// Used for decoding create, rename and attach requests
+type tagNameRequest struct {
+	Name string `json:"name"`
+}
+
+// normalizeTagName trims and lowercases a tag name so "Work" and " work" are the same tag.
+// Commas are stripped because they separate names in the ?tags= filter.
+func normalizeTagName(name string) string {
+	return strings.ToLower(strings.TrimSpace(strings.ReplaceAll(name, ",", "")))
+}
+
+// Validation:
+func validateTagName(name string) error {
+	if name == "" {
+		return errors.New("tag name is required")
+	}
+	if len(name) > 50 {
+		return errors.New("tag name must be less than 50 characters")
+	}
+	return nil
+}
+
+// getOwnedTag loads the tag from the given URL parameter and checks the current user owns it.
+// On failure it writes the error response itself and returns nil.
+func (th *TagHandler) getOwnedTag(w http.ResponseWriter, r *http.Request, param string) *store.Tag {
+	tagId, err := utils.ReadIDParam(r, param)
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("Invalid tag ID parameter", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid tag ID parameter"}) // 400
+		return nil
+	}
+
+	tag, err := th.tagStore.GetTagByID(int(tagId))
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error retrieving tag", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve tag"})
+		return nil
+	}
+	if tag == nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "Tag not found"})
+		return nil
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser.IsAnonymous() || tag.UserID != currentUser.ID {
+		logging.FromContext(r.Context()).Warn("Unauthorized access to tag", "tag_id", tag.ID)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
+		return nil
+	}
+
+	return tag
+}
+
+// CRUD
+
+func (th *TagHandler) HandleCreateTag(w http.ResponseWriter, r *http.Request) {
+	var req tagNameRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("Invalid request payload", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid request payload"}) // 400
+		return
+	}
+
+	name := normalizeTagName(req.Name)
+	if err := validateTagName(name); err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()}) // 400
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser.IsAnonymous() {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
+		return
+	}
+
+	createdTag, err := th.tagStore.CreateTag(&store.Tag{UserID: currentUser.ID, Name: name})
+	if errors.Is(err, store.ErrTagExists) {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": err.Error()}) // 409
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error creating tag", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to create tag"}) // 500
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"tag": createdTag}) // 201
+}
+
+func (th *TagHandler) HandleListTags(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+	if currentUser.IsAnonymous() {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
+		return
+	}
+
+	tags, err := th.tagStore.ListTagsByUserID(currentUser.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error retrieving tags", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve tags"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"tags": tags}) // 200
+}
+
+// Renaming a tag renames it on every note that uses it
+func (th *TagHandler) HandleRenameTag(w http.ResponseWriter, r *http.Request) {
+	tag := th.getOwnedTag(w, r, "id")
+	if tag == nil {
+		return
+	}
+
+	var req tagNameRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("Invalid request payload", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid request payload"}) // 400
+		return
+	}
+
+	name := normalizeTagName(req.Name)
+	if err := validateTagName(name); err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()}) // 400
+		return
+	}
+
+	err = th.tagStore.RenameTag(tag.ID, name)
+	if errors.Is(err, store.ErrTagExists) {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "a tag with this name already exists, merge the tags instead"}) // 409
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error renaming tag", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to rename tag"}) // 500
+		return
+	}
+
+	tag.Name = name
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"tag": tag}) // 200
+}
+
+func (th *TagHandler) HandleDeleteTag(w http.ResponseWriter, r *http.Request) {
+	tag := th.getOwnedTag(w, r, "id")
+	if tag == nil {
+		return
+	}
+
+	err := th.tagStore.DeleteTag(tag.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error deleting tag", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to delete tag"}) // 500
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "Tag deleted successfully"}) // 200
+}
+
+// Merges the {id} tag into another one: its notes get the target tag and the {id} tag is deleted
+func (th *TagHandler) HandleMergeTag(w http.ResponseWriter, r *http.Request) {
+	source := th.getOwnedTag(w, r, "id")
+	if source == nil {
+		return
+	}
+
+	var req struct {
+		IntoTagID int `json:"into_tag_id"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("Invalid request payload", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid request payload"}) // 400
+		return
+	}
+	if req.IntoTagID == source.ID {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Cannot merge a tag into itself"}) // 400
+		return
+	}
+
+	target, err := th.tagStore.GetTagByID(req.IntoTagID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error retrieving tag", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve tag"})
+		return
+	}
+	if target == nil || target.UserID != source.UserID {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "Target tag not found"})
+		return
+	}
+
+	err = th.tagStore.MergeTags(source.ID, target.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error merging tags", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to merge tags"}) // 500
+		return
+	}
+
+	// Reload for the updated note count
+	merged, err := th.tagStore.GetTagByID(target.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error retrieving tag", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve tag"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"tag": merged}) // 200
+}
+
+// Note tags
+
+// getNote loads the {id} note if the current user can edit it, so editors of a shared note can tag it too.
+func (th *TagHandler) getNote(w http.ResponseWriter, r *http.Request) *store.Note {
+	note, _ := authorizeNote(w, r, th.notesStore, th.policy, policy.Edit)
+	return note
+}
+
+// Tags a note by name, creating the tag if needed.
+// The tag is the note owner's, whoever adds it, so it shows up in the owner's tags and filters.
+func (th *TagHandler) HandleAttachTag(w http.ResponseWriter, r *http.Request) {
+	note := th.getNote(w, r)
+	if note == nil {
+		return
+	}
+
+	var req tagNameRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("Invalid request payload", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid request payload"}) // 400
+		return
+	}
+
+	name := normalizeTagName(req.Name)
+	if err := validateTagName(name); err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()}) // 400
+		return
+	}
+
+	tag, err := th.tagStore.AttachTag(note.ID, note.UserID, name)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error attaching tag", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to attach tag"}) // 500
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"tag": tag}) // 200
+}
+
+func (th *TagHandler) HandleDetachTag(w http.ResponseWriter, r *http.Request) {
+	note := th.getNote(w, r)
+	if note == nil {
+		return
+	}
+
+	// Any tag on the note can be removed by whoever can edit it
+	tagId, err := utils.ReadIDParam(r, "tag_id")
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("Invalid tag ID parameter", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid tag ID parameter"}) // 400
+		return
+	}
+
+	err = th.tagStore.DetachTag(note.ID, int(tagId))
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "Tag is not on this note"})
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error detaching tag", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to detach tag"}) // 500
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "Tag removed from note"}) // 200
+}
@@ -2,20 +2,35 @@ package api
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
+	"math"
 	"net/http"
-	"strings"
+	"strconv"
 	"time"
 
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/lockout"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/logging"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/metrics"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/middleware"
 	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/store"
 	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/tokens"
 	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/utils"
 )
 
 type TokenHandler struct {
-	tokenStore store.TokenStore
-	userStore  store.UserStore
-	logger     *log.Logger
+	tokenStore     store.TokenStore
+	userStore      store.UserStore
+	twoFactorStore store.TwoFactorStore
+	ttls           TokenTTLs
+	loginGuard     *lockout.Tracker // Slows down password guessing
+	auditor        *Auditor
+	metrics        *metrics.Metrics
+}
+
+// TokenTTLs are the lifetimes of the tokens a login hands out
+type TokenTTLs struct {
+	Access  time.Duration // authentication tokens, sent with every request
+	Refresh time.Duration // refresh tokens, traded at /tokens/refresh for a new pair
 }
 
 // Used for decoding create token requests
@@ -26,14 +41,21 @@ type createTokenRequest struct {
 
 // NewTokenHandler creates a new instance of TokenHandler
 
-func NewTokenHandler(tokenStore store.TokenStore, userStore store.UserStore, logger *log.Logger) *TokenHandler {
+func NewTokenHandler(tokenStore store.TokenStore, userStore store.UserStore, twoFactorStore store.TwoFactorStore, ttls TokenTTLs, loginGuard *lockout.Tracker, auditor *Auditor, metrics *metrics.Metrics) *TokenHandler {
 	return &TokenHandler{
-		tokenStore: tokenStore,
-		userStore:  userStore,
-		logger:     logger,
+		tokenStore:     tokenStore,
+		userStore:      userStore,
+		twoFactorStore: twoFactorStore,
+		ttls:           ttls,
+		loginGuard:     loginGuard,
+		auditor:        auditor,
+		metrics:        metrics,
 	}
 }
 
+// How long the user has to enter their code after the password was accepted
+const twoFactorPendingTTL = 5 * time.Minute
+
 func (h *TokenHandler) HandleCreateToken(w http.ResponseWriter, r *http.Request) {
 	// Implementation for creating a new token
 
@@ -55,69 +77,280 @@ func (h *TokenHandler) HandleCreateToken(w http.ResponseWriter, r *http.Request)
 
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		h.logger.Printf("Error decoding create token request: %v", err)
+		logging.FromContext(r.Context()).Error("Error decoding create token request", "error", err)
 		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid request payload"})
 		return
 	}
 
+	// Too many recent failures for this username or from this address. Otherwise the attempt is counted as a
+	// failure right away, so concurrent guesses cannot all get through before one of them is counted.
+	ip := utils.ClientIP(r)
+	wait, err := h.loginGuard.Attempt(r.Context(), req.Username, ip)
+	if err != nil {
+		// Better to let logins through than to lock everyone out while the store is down
+		logging.FromContext(r.Context()).Error("Error checking login failures", "error", err)
+	}
+	if wait > 0 {
+		h.metrics.LoginFailed("throttled")
+		writeTooManyAttempts(w, wait)
+		return
+	}
+
 	user, err := h.userStore.GetUserByUsername(req.Username)
 	if err != nil {
-		h.logger.Printf("Error fetching user: %v", err)
+		logging.FromContext(r.Context()).Error("Error fetching user", "error", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal Server Error"})
 		return
 	}
 
-	if user == nil {
-		h.logger.Printf("User not found: %s", req.Username)
+	// Unknown usernames count as failures too, so they cannot be told apart from wrong passwords
+	passwordsDoMatch := false
+	if user != nil {
+		passwordsDoMatch, err = user.PasswordHash.Matches(req.Password)
+	}
+	if user == nil || err != nil || !passwordsDoMatch {
+		// Never log the username, people sometimes type their password into that field
+		if user != nil {
+			logging.FromContext(r.Context()).Warn("Failed login", "user_id", user.ID, "ip", ip)
+			h.auditor.RecordAs(r, 0, store.AuditLoginFailed, userTarget(user.ID), nil, utils.Envelope{"reason": "invalid_password"})
+			h.metrics.LoginFailed("invalid_password")
+		} else {
+			logging.FromContext(r.Context()).Warn("Failed login for an unknown user", "ip", ip)
+			h.auditor.RecordAs(r, 0, store.AuditLoginFailed, auditTarget{}, nil, utils.Envelope{"reason": "unknown_user"})
+			h.metrics.LoginFailed("unknown_user")
+		}
 		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Invalid credentials"})
 		return
 	}
 
-	passwordsDoMatch, err := user.PasswordHash.Matches(req.Password)
-	if err != nil || !passwordsDoMatch {
-		h.logger.Printf("Invalid credentials for user %s", req.Username)
-		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Invalid credentials"})
+	err = h.loginGuard.Succeed(r.Context(), req.Username, ip)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error clearing login failures", "error", err)
+	}
+
+	if user.IsSuspended() {
+		h.auditor.RecordAs(r, 0, store.AuditLoginFailed, userTarget(user.ID), nil, utils.Envelope{"reason": "suspended"})
+		h.metrics.LoginFailed("suspended")
+		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "this account has been suspended"})
 		return
 	}
-	if !passwordsDoMatch {
-		h.logger.Printf("Invalid credentials for user %s", req.Username)
-		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Invalid credentials"})
+	if user.PasswordResetRequired {
+		h.auditor.RecordAs(r, 0, store.AuditLoginFailed, userTarget(user.ID), nil, utils.Envelope{"reason": "password_reset_required"})
+		h.metrics.LoginFailed("password_reset_required")
+		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "you must reset your password before logging in, check your email for a reset link"})
+		return
+	}
+
+	// With 2FA on, the password only earns a short-lived token to exchange at /tokens/2fa along with a code
+	twoFactor, err := h.twoFactorStore.GetTwoFactor(user.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error fetching two-factor settings", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal Server Error"})
+		return
+	}
+	if twoFactor.IsEnabled() {
+		pending, err := h.tokenStore.CreateNewToken(user.ID, twoFactorPendingTTL, tokens.ScopeTwoFactorPending)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Error creating token", "error", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal Server Error"})
+			return
+		}
+
+		utils.WriteJSON(w, http.StatusOK, utils.Envelope{
+			"two_factor_required": true,
+			"pending_token":       pending.Plaintext,
+			"expiry":              pending.Expiry,
+		})
+		return
+	}
+
+	h.issueAuthToken(w, r, user.ID)
+}
+
+// writeTooManyAttempts answers a login attempt made before the backoff or lockout is over
+func writeTooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	utils.WriteJSON(w, http.StatusTooManyRequests, utils.Envelope{
+		"error":       "too many failed login attempts, try again later",
+		"retry_after": seconds,
+	}) // 429
+}
+
+// issueAuthToken starts a new session: an access token plus a refresh token sharing one session ID,
+// remembering which client and address it was created from.
+func (h *TokenHandler) issueAuthToken(w http.ResponseWriter, r *http.Request, userID int) {
+	// Logging in is how a pending account deletion gets cancelled
+	deletionCancelled, err := h.userStore.CancelUserDeletion(userID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error cancelling account deletion", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal Server Error"})
 		return
 	}
 
-	token, err := h.tokenStore.CreateNewToken(user.ID, 24*time.Hour, tokens.ScopeAuth)
+	sessionID, err := tokens.NewSessionID()
 	if err != nil {
-		h.logger.Printf("Error creating token: %v", err)
+		logging.FromContext(r.Context()).Error("Error creating session ID", "error", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal Server Error"})
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"auth_token": token.Plaintext})
+	issued := make([]*tokens.Token, 0, 2)
+	for _, next := range []struct {
+		scope string
+		ttl   time.Duration
+	}{{tokens.ScopeAuth, h.ttls.Access}, {tokens.ScopeRefresh, h.ttls.Refresh}} {
+		token, err := tokens.GenerateToken(userID, next.ttl, next.scope)
+		if err == nil {
+			token.SessionID = sessionID
+			token.UserAgent = r.UserAgent()
+			token.IP = utils.ClientIP(r)
+			err = h.tokenStore.Insert(token)
+		}
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Error creating token", "error", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal Server Error"})
+			return
+		}
+		issued = append(issued, token)
+	}
+
+	// The rest of the request, the access log included, is logged as the user who just logged in
+	logging.AddAttrs(r.Context(), "user_id", userID)
+	h.auditor.RecordAs(r, userID, store.AuditLoginSucceeded, userTarget(userID), nil, utils.Envelope{"session_id": sessionID})
+	h.metrics.LoginSucceeded()
+	h.metrics.TokenCreated(metrics.TokenAccess)
+	h.metrics.TokenCreated(metrics.TokenRefresh)
+	response := tokenPairEnvelope(issued[0], issued[1])
+	if deletionCancelled {
+		logging.FromContext(r.Context()).Info("Account deletion cancelled by logging in")
+		h.auditor.RecordAs(r, userID, store.AuditAccountDeletionCancelled, userTarget(userID), nil, nil)
+		response["deletion_cancelled"] = true
+	}
+	utils.WriteJSON(w, http.StatusCreated, response)
+}
+
+func tokenPairEnvelope(access, refresh *tokens.Token) utils.Envelope {
+	return utils.Envelope{
+		"auth_token":           access.Plaintext,
+		"auth_token_expiry":    access.Expiry,
+		"refresh_token":        refresh.Plaintext,
+		"refresh_token_expiry": refresh.Expiry,
+	}
+}
+
+// Trades a refresh token for a new access token and refresh token: {"refresh_token": "..."}.
+// Each refresh token works once; presenting one a second time logs that whole session out.
+func (h *TokenHandler) HandleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.RefreshToken == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "refresh_token is required"})
+		return
+	}
+
+	access, refresh, err := h.tokenStore.RotateRefreshToken(req.RefreshToken, h.ttls.Access, h.ttls.Refresh)
+	if errors.Is(err, store.ErrRefreshTokenReused) {
+		logging.FromContext(r.Context()).Warn("Refresh token reuse detected, session revoked", "user_id", access.UserID)
+		h.auditor.RecordAs(r, 0, store.AuditTokenReuseDetected, auditTarget{Type: store.AuditTargetSession, OwnerID: access.UserID}, nil, utils.Envelope{"session_id": access.SessionID})
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "refresh token has already been used, please log in again"})
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error rotating refresh token", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal Server Error"})
+		return
+	}
+	if access == nil {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or expired refresh token"})
+		return
+	}
+
+	h.metrics.TokenCreated(metrics.TokenAccess)
+	h.metrics.TokenCreated(metrics.TokenRefresh)
+	utils.WriteJSON(w, http.StatusOK, tokenPairEnvelope(access, refresh))
+}
+
+// Second step of a 2FA login: {"pending_token": "...", "code": "123456"}. A recovery code works instead of a TOTP code.
+func (h *TokenHandler) HandleVerifyTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		PendingToken string `json:"pending_token"`
+		Code         string `json:"code"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.PendingToken == "" || req.Code == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "pending_token and code are required"})
+		return
+	}
+
+	user, err := h.userStore.GetUserToken(tokens.ScopeTwoFactorPending, req.PendingToken)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error fetching user", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal Server Error"})
+		return
+	}
+	if user == nil {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or expired token, please log in again"})
+		return
+	}
+
+	twoFactor, err := h.twoFactorStore.GetTwoFactor(user.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error fetching two-factor settings", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal Server Error"})
+		return
+	}
+	if twoFactor.IsEnabled() {
+		valid, locked, err := verifySecondFactor(h.twoFactorStore, twoFactor, req.Code)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Error verifying second factor", "error", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal Server Error"})
+			return
+		}
+		if locked {
+			utils.WriteJSON(w, http.StatusTooManyRequests, utils.Envelope{"error": "Too many invalid codes, try again later"})
+			return
+		}
+		if !valid {
+			h.auditor.RecordAs(r, 0, store.AuditLoginFailed, userTarget(user.ID), nil, utils.Envelope{"reason": "invalid_two_factor_code"})
+			h.metrics.LoginFailed("invalid_two_factor_code")
+			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Invalid code"})
+			return
+		}
+	}
+	// If 2FA was turned off in the meantime, the password check that produced the pending token is enough
+
+	// Pending tokens are single use
+	err = h.tokenStore.DeleteAllTokensForUser(tokens.ScopeTwoFactorPending, user.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error deleting pending tokens", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal Server Error"})
+		return
+	}
+
+	h.issueAuthToken(w, r, user.ID)
 }
 
 // Logging out:
 func (h *TokenHandler) HandleRevokeToken(w http.ResponseWriter, r *http.Request) {
 	// Implementation for revoking a token (logging out)
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
+	// Authenticate already checked the token and kept its hash, which is what the tokens table stores
+	tokenHash := middleware.GetTokenHash(r)
+	if tokenHash == nil {
 		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Missing Authorization header"})
 		return
 	}
 
-	headerParts := strings.Split(authHeader, " ")
-	if len(headerParts) != 2 || headerParts[0] != "Bearer" {
-		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Invalid Authorization header format"})
-		return
-	}
-
-	token := headerParts[1]
-	err := h.tokenStore.RevokeToken(token)
+	err := h.tokenStore.RevokeToken(tokenHash)
 	if err != nil {
-		h.logger.Printf("Error revoking token: %v", err)
+		logging.FromContext(r.Context()).Error("Error revoking token", "error", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal Server Error"})
 		return
 	}
 
 	// Token has been revoked successfully
+	h.auditor.Record(r, store.AuditTokenRevoked, auditTarget{Type: store.AuditTargetSession, OwnerID: middleware.GetUser(r).ID}, nil, utils.Envelope{"reason": "logout"})
 	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "Token revoked successfully"})
 }
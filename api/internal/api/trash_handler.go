@@ -0,0 +1,120 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/logging"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/middleware"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/store"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/utils"
+)
+
+type TrashHandler struct {
+	trashStore store.TrashStore
+	auditor    *Auditor
+}
+
+// Constructor for TrashHandler
+func NewTrashHandler(trashStore store.TrashStore, auditor *Auditor) *TrashHandler {
+	return &TrashHandler{
+		trashStore: trashStore,
+		auditor:    auditor,
+	}
+}
+
+func (th *TrashHandler) HandleListTrash(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+	if currentUser.IsAnonymous() {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
+		return
+	}
+
+	trash, err := th.trashStore.ListTrash(currentUser.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error retrieving trash", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to retrieve trash"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"trash": trash}) // 200
+}
+
+func (th *TrashHandler) HandleRestoreNote(w http.ResponseWriter, r *http.Request) {
+	noteId, err := utils.ReadIDParam(r, "id")
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("Invalid note ID parameter", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid note ID parameter"}) // 400
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser.IsAnonymous() {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
+		return
+	}
+
+	// The store only matches notes owned by the current user, so someone else's note is simply "not found"
+	err = th.trashStore.RestoreNote(currentUser.ID, int(noteId))
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "Note not found in trash"})
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error restoring note", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to restore note"}) // 500
+		return
+	}
+
+	th.auditor.Record(r, store.AuditNoteRestored, auditTarget{Type: store.AuditTargetNote, ID: int(noteId), OwnerID: currentUser.ID}, nil, nil)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "Note restored successfully"}) // 200
+}
+
+func (th *TrashHandler) HandleRestoreFolder(w http.ResponseWriter, r *http.Request) {
+	folderId, err := utils.ReadIDParam(r, "id")
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("Invalid folder ID parameter", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid folder ID parameter"}) // 400
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	if currentUser.IsAnonymous() {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
+		return
+	}
+
+	err = th.trashStore.RestoreFolder(currentUser.ID, int(folderId))
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "Folder not found in trash"})
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error restoring folder", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to restore folder"}) // 500
+		return
+	}
+
+	th.auditor.Record(r, store.AuditFolderRestored, auditTarget{Type: store.AuditTargetFolder, ID: int(folderId), OwnerID: currentUser.ID}, nil, nil)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "Folder restored successfully"}) // 200
+}
+
+// Permanently deletes everything in the current user's trash
+func (th *TrashHandler) HandleEmptyTrash(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+	if currentUser.IsAnonymous() {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
+		return
+	}
+
+	deleted, err := th.trashStore.EmptyTrash(currentUser.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error emptying trash", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to empty trash"}) // 500
+		return
+	}
+
+	th.auditor.Record(r, store.AuditTrashEmptied, auditTarget{OwnerID: currentUser.ID}, nil, utils.Envelope{"deleted": deleted})
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "Trash emptied successfully", "deleted": deleted}) // 200
+}
@@ -0,0 +1,264 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/logging"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/middleware"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/store"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/tokens"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/totp"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/utils"
+)
+
+// Shown as the account's name in authenticator apps
+const totpIssuer = "Notes App"
+
+const recoveryCodeCount = 10
+
+// After this many wrong codes in a row, only one attempt is allowed per secondFactorLockout
+const (
+	maxSecondFactorAttempts = 5
+	secondFactorLockout     = 15 * time.Minute
+)
+
+type TwoFactorHandler struct {
+	twoFactorStore store.TwoFactorStore
+	auditor        *Auditor
+}
+
+// Constructor for TwoFactorHandler
+func NewTwoFactorHandler(twoFactorStore store.TwoFactorStore, auditor *Auditor) *TwoFactorHandler {
+	return &TwoFactorHandler{
+		twoFactorStore: twoFactorStore,
+		auditor:        auditor,
+	}
+}
+
+// verifySecondFactor accepts a current TOTP code or one of the user's unused recovery codes.
+// Every attempt is counted towards the lockout before the code is checked, and locked is true when there
+// were too many wrong codes recently, in which case the code is not checked at all.
+func verifySecondFactor(twoFactorStore store.TwoFactorStore, tf *store.TwoFactor, code string) (valid bool, locked bool, err error) {
+	reserved, err := twoFactorStore.ReserveAttempt(tf.UserID, maxSecondFactorAttempts, secondFactorLockout)
+	if err != nil {
+		return false, false, err
+	}
+	if !reserved {
+		return false, true, nil
+	}
+
+	// An accepted code resets the count
+	if step, ok := totp.Validate(tf.Secret, code, time.Now()); ok {
+		valid, err = twoFactorStore.UseStep(tf.UserID, step)
+	} else if normalized := totp.NormalizeRecoveryCode(code); len(normalized) > totp.Digits {
+		valid, err = twoFactorStore.UseRecoveryCode(tf.UserID, tokens.Hash(normalized))
+	}
+	return valid, false, err
+}
+
+func (th *TwoFactorHandler) getEnrollment(w http.ResponseWriter, r *http.Request) (*store.User, *store.TwoFactor, bool) {
+	currentUser := middleware.GetUser(r)
+	if currentUser.IsAnonymous() {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
+		return nil, nil, false
+	}
+
+	tf, err := th.twoFactorStore.GetTwoFactor(currentUser.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error retrieving two-factor settings", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"}) // 500
+		return nil, nil, false
+	}
+	return currentUser, tf, true
+}
+
+// Whether 2FA is on and how many recovery codes are left: GET /users/me/2fa
+func (th *TwoFactorHandler) HandleGetTwoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	currentUser, tf, ok := th.getEnrollment(w, r)
+	if !ok {
+		return
+	}
+
+	remaining := 0
+	if tf.IsEnabled() {
+		count, err := th.twoFactorStore.CountRecoveryCodes(currentUser.ID)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Error counting recovery codes", "error", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"}) // 500
+			return
+		}
+		remaining = count
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{
+		"enabled":                  tf.IsEnabled(),
+		"recovery_codes_remaining": remaining,
+	}) // 200
+}
+
+// Starts enrollment: returns a new secret and the otpauth URI to show as a QR code.
+// 2FA is not on until /confirm receives a code from the authenticator app.
+func (th *TwoFactorHandler) HandleSetupTwoFactor(w http.ResponseWriter, r *http.Request) {
+	currentUser, tf, ok := th.getEnrollment(w, r)
+	if !ok {
+		return
+	}
+	if tf.IsEnabled() {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "Two-factor authentication is already enabled"}) // 409
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error generating TOTP secret", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"}) // 500
+		return
+	}
+
+	err = th.twoFactorStore.StartSetup(currentUser.ID, secret)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "Two-factor authentication is already enabled"}) // 409
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error starting two-factor setup", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to start two-factor setup"}) // 500
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{
+		"secret":      secret,
+		"otpauth_uri": totp.URI(totpIssuer, currentUser.Email, secret),
+	}) // 200
+}
+
+// Finishes enrollment with a code from the app: {"code": "123456"}.
+// Responds with the recovery codes. They are only ever shown here.
+func (th *TwoFactorHandler) HandleConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	currentUser, tf, ok := th.getEnrollment(w, r)
+	if !ok {
+		return
+	}
+	if tf == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Start two-factor setup first"}) // 400
+		return
+	}
+	if tf.IsEnabled() {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "Two-factor authentication is already enabled"}) // 409
+		return
+	}
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("Invalid request payload", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid request payload"}) // 400
+		return
+	}
+
+	step, valid := totp.Validate(tf.Secret, req.Code, time.Now())
+	if !valid {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid code"}) // 400
+		return
+	}
+
+	codes, err := totp.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error generating recovery codes", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"}) // 500
+		return
+	}
+	hashes := make([][]byte, len(codes))
+	for i, code := range codes {
+		hashes[i] = tokens.Hash(totp.NormalizeRecoveryCode(code))
+	}
+
+	err = th.twoFactorStore.Enable(currentUser.ID, hashes)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "Two-factor authentication is already enabled"}) // 409
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error enabling two-factor authentication", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to enable two-factor authentication"}) // 500
+		return
+	}
+
+	// The confirmation code cannot be reused to log in
+	_, err = th.twoFactorStore.UseStep(currentUser.ID, step)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error recording TOTP step", "error", err)
+	}
+
+	th.auditor.Record(r, store.AuditTwoFactorEnabled, userTarget(currentUser.ID), nil, nil)
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{
+		"message":        "Two-factor authentication enabled",
+		"recovery_codes": codes,
+	}) // 200
+}
+
+// Turns 2FA off. Needs the password and a current code (or a recovery code):
+// {"password": "...", "code": "123456"}
+func (th *TwoFactorHandler) HandleDisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	currentUser, tf, ok := th.getEnrollment(w, r)
+	if !ok {
+		return
+	}
+	if tf == nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Two-factor authentication is not enabled"}) // 400
+		return
+	}
+
+	var req struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("Invalid request payload", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid request payload"}) // 400
+		return
+	}
+
+	passwordsDoMatch, err := currentUser.PasswordHash.Matches(req.Password)
+	if err != nil || !passwordsDoMatch {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Invalid credentials"}) // 401
+		return
+	}
+
+	// An unconfirmed setup can be cancelled with the password alone
+	if tf.IsEnabled() {
+		valid, locked, err := verifySecondFactor(th.twoFactorStore, tf, req.Code)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Error verifying second factor", "error", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"}) // 500
+			return
+		}
+		if locked {
+			utils.WriteJSON(w, http.StatusTooManyRequests, utils.Envelope{"error": "Too many invalid codes, try again later"}) // 429
+			return
+		}
+		if !valid {
+			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Invalid code"}) // 401
+			return
+		}
+	}
+
+	err = th.twoFactorStore.Disable(currentUser.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Error disabling two-factor authentication", "error", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to disable two-factor authentication"}) // 500
+		return
+	}
+
+	if tf.IsEnabled() {
+		th.auditor.Record(r, store.AuditTwoFactorDisabled, userTarget(currentUser.ID), nil, nil)
+	}
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "Two-factor authentication disabled"}) // 200
+}
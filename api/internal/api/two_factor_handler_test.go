@@ -0,0 +1,72 @@
+package api
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/store"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/totp"
+)
+
+// fakeTwoFactorStore keeps one user's 2FA state in memory, with the same conditions as the UPDATEs of
+// PostgresTwoFactorStore. Methods the tests do not need are left to the embedded interface and panic if called.
+type fakeTwoFactorStore struct {
+	store.TwoFactorStore
+	mu           sync.Mutex
+	lastUsedStep *int64
+}
+
+func (f *fakeTwoFactorStore) ReserveAttempt(userID int, maxAttempts int, lockout time.Duration) (bool, error) {
+	return true, nil
+}
+
+func (f *fakeTwoFactorStore) UseStep(userID int, step int64) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.lastUsedStep != nil && *f.lastUsedStep >= step {
+		return false, nil
+	}
+	f.lastUsedStep = &step
+	return true, nil
+}
+
+func TestSecondFactorCodeCannotBeReplayed(t *testing.T) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatalf("GenerateSecret: %v", err)
+	}
+	now := totp.Step(time.Now())
+	codeFor := func(step int64) string {
+		code, err := totp.Code(secret, step)
+		if err != nil {
+			t.Fatalf("Code: %v", err)
+		}
+		return code
+	}
+
+	twoFactorStore := &fakeTwoFactorStore{}
+	tf := &store.TwoFactor{UserID: 1, Secret: secret}
+
+	// Each attempt in order, against the same store. The steps are all within the skew of now.
+	tests := []struct {
+		name  string
+		code  string
+		valid bool
+	}{
+		{"first use of the code", codeFor(now), true},
+		{"same code again", codeFor(now), false},
+		{"code from before the one used", codeFor(now - 1), false},
+		{"code from the next step", codeFor(now + 1), true},
+		{"next step code again", codeFor(now + 1), false},
+	}
+	for _, tt := range tests {
+		valid, locked, err := verifySecondFactor(twoFactorStore, tf, tt.code)
+		if err != nil || locked {
+			t.Fatalf("%s: unexpected locked=%v err=%v", tt.name, locked, err)
+		}
+		if valid != tt.valid {
+			t.Errorf("%s: expected valid=%v, got %v", tt.name, tt.valid, valid)
+		}
+	}
+}
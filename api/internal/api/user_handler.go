@@ -3,10 +3,13 @@ package api
 import (
 	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
 	"net/http"
 	"regexp"
+	"strings"
 
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/events"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/logging"
 	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/middleware"
 	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/store"
 	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/utils"
@@ -27,20 +30,24 @@ type RegisterUserRequest struct {
 	PfpURL         string `json:"pfp_url"`
 	FirstName      string `json:"first_name"`
 	LastName       string `json:"last_name"`
-	AuthLevel      int    `json:"auth_level"` // Optional, default to regular user
+	AuthLevel      int    `json:"auth_level"` // Optional, only honored for admins. Everyone else gets store.AuthLevelUser.
 }
 
 type UserHandler struct {
 	// Add fields as necessary, e.g., a reference to the application or database
 	userStore store.UserStore // Interface to interact with user data. This promotes db decoupling and easier testing.
-	logger    *log.Logger
+	verifier  *EmailVerifier  // Sends the "confirm your email" message
+	events    events.Publisher
+	auditor   *Auditor
 }
 
 // NewUserHandler creates a new instance of UserHandler
-func NewUserHandler(userStore store.UserStore, logger *log.Logger) *UserHandler {
+func NewUserHandler(userStore store.UserStore, verifier *EmailVerifier, publisher events.Publisher, auditor *Auditor) *UserHandler {
 	return &UserHandler{
 		userStore: userStore,
-		logger:    logger,
+		verifier:  verifier,
+		events:    publisher,
+		auditor:   auditor,
 	}
 }
 
@@ -64,12 +71,29 @@ func (h *UserHandler) validateRegisterUserRequest(req *RegisterUserRequest) erro
 		return errors.New("invalid email format")
 	}
 	// Password
-	if len(req.Password) < 8 {
+	return validatePassword(req.Password)
+}
+
+// requestedAuthLevel returns the auth_level a create or update should store: the requested one when an admin asks for it,
+// otherwise current (what the user already has, or store.AuthLevelUser for new users).
+func requestedAuthLevel(r *http.Request, requested, current int) (int, error) {
+	if requested == 0 || requested == current || !middleware.HasRole(r, store.RoleAdmin) {
+		return current, nil
+	}
+	if store.RoleForAuthLevel(requested).AuthLevel() != requested {
+		return 0, fmt.Errorf("auth_level must be %d (user), %d (moderator) or %d (admin)", store.AuthLevelUser, store.AuthLevelModerator, store.AuthLevelAdmin)
+	}
+	return requested, nil
+}
+
+// Password rules, shared by registration and password resets
+func validatePassword(password string) error {
+	if len(password) < 8 {
 		return errors.New("password must be at least 8 characters long")
 	}
-	hasLower := regexp.MustCompile(`[a-z]`).MatchString(req.Password)
-	hasUpper := regexp.MustCompile(`[A-Z]`).MatchString(req.Password)
-	hasDigit := regexp.MustCompile(`\d`).MatchString(req.Password)
+	hasLower := regexp.MustCompile(`[a-z]`).MatchString(password)
+	hasUpper := regexp.MustCompile(`[A-Z]`).MatchString(password)
+	hasDigit := regexp.MustCompile(`\d`).MatchString(password)
 	if !(hasLower && hasUpper && hasDigit) {
 		return errors.New("password must contain at least one uppercase letter, one lowercase letter, and one number")
 	}
@@ -85,7 +109,7 @@ func (h *UserHandler) HandleRegisterUser(w http.ResponseWriter, r *http.Request)
 	// Decode the POST request body into the RegisterUserRequest struct:
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		h.logger.Printf("Invalid request payload: %v", err)
+		logging.FromContext(r.Context()).Warn("Invalid request payload", "error", err)
 		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid request payload"}) // 400
 		return
 	}
@@ -93,7 +117,13 @@ func (h *UserHandler) HandleRegisterUser(w http.ResponseWriter, r *http.Request)
 	// Validate the request
 	err = h.validateRegisterUserRequest(&req)
 	if err != nil {
-		h.logger.Printf("Validation error: %v", err)
+		logging.FromContext(r.Context()).Warn("Validation error", "error", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()}) // 400
+		return
+	}
+
+	authLevel, err := requestedAuthLevel(r, req.AuthLevel, store.AuthLevelUser)
+	if err != nil {
 		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()}) // 400
 		return
 	}
@@ -112,27 +142,28 @@ func (h *UserHandler) HandleRegisterUser(w http.ResponseWriter, r *http.Request)
 		FirstName:      req.FirstName,
 		LastName:       req.LastName,
 		Bio:            req.Bio,
-		AuthLevel:      req.AuthLevel, // Default to 1 (regular user) if not provided
+		AuthLevel:      authLevel,
 	}
 
 	if req.Bio != "" {
 		user.Bio = req.Bio
 	}
 
-	err = user.PasswordHash.Set(req.Password)
-	if err != nil {
-		h.logger.Printf("Error setting password hash: %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"}) // 500
-		return
-	}
+	user.PasswordHash.Set(req.Password)
 
 	createdUser, err := h.userStore.CreateUser(user)
 	if err != nil {
-		h.logger.Printf("Error creating user: %v", err)
+		logging.FromContext(r.Context()).Error("Error creating user", "error", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to create user"}) // 500
 		return
 	}
 
+	// The account works right away, but sharing and public links wait until the email is verified
+	h.verifier.SendInBackground(r.Context(), createdUser)
+	// The actor is nobody for self sign-ups, the admin for users created by an admin
+	h.auditor.Record(r, store.AuditUserCreated, userTarget(createdUser.ID), nil, userSummary(createdUser))
+	publish(h.events, r, events.UserCreated, utils.Envelope{"id": createdUser.ID}, createdUser.ID)
+
 	// Respond with the created user (excluding password hash) as JSON to the frontend:
 	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"user": createdUser}) // 201
 
@@ -143,14 +174,14 @@ func (h *UserHandler) HandleGetUserByID(w http.ResponseWriter, r *http.Request)
 	// Implementation for getting a user by ID
 	userId, err := utils.ReadIDParam(r, "id")
 	if err != nil {
-		h.logger.Printf("Invalid user ID parameter: %v", err)
+		logging.FromContext(r.Context()).Warn("Invalid user ID parameter", "error", err)
 		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid user ID parameter"}) // 400
 		return
 	}
 
 	user, err := h.userStore.GetUserById(int(userId))
 	if err != nil {
-		h.logger.Printf("Error fetching user: %v", err)
+		logging.FromContext(r.Context()).Error("Error fetching user", "error", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to fetch user"})
 		return
 	}
@@ -166,7 +197,7 @@ func (h *UserHandler) HandleUpdateUser(w http.ResponseWriter, r *http.Request) {
 	// Implementation for updating a user by ID
 	userId, err := utils.ReadIDParam(r, "id")
 	if err != nil {
-		h.logger.Printf("Invalid user ID parameter: %v", err)
+		logging.FromContext(r.Context()).Warn("Invalid user ID parameter", "error", err)
 		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid user ID parameter"}) // 400
 		return
 	}
@@ -174,7 +205,7 @@ func (h *UserHandler) HandleUpdateUser(w http.ResponseWriter, r *http.Request) {
 	var req RegisterUserRequest
 	err = json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		h.logger.Printf("Invalid request payload: %v", err)
+		logging.FromContext(r.Context()).Warn("Invalid request payload", "error", err)
 		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid request payload"})
 		return
 	}
@@ -182,15 +213,21 @@ func (h *UserHandler) HandleUpdateUser(w http.ResponseWriter, r *http.Request) {
 	// Ensure current user is the one being updated
 	currentUser := middleware.GetUser(r)
 	if currentUser.IsAnonymous() || currentUser.ID != int(userId) {
-		h.logger.Printf("Unauthorized update attempt for user ID %d by user ID %d", userId, currentUser.ID)
+		logging.FromContext(r.Context()).Warn("Unauthorized update attempt for another user", "target_user_id", userId)
 		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
 		return
 	}
 
+	authLevel, err := requestedAuthLevel(r, req.AuthLevel, currentUser.AuthLevel)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()}) // 400
+		return
+	}
+
 	// // Validate the request
 	// err = h.validateRegisterUserRequest(&req)
 	// if err != nil {
-	// 	h.logger.Printf("Validation error: %v", err)
+	// 	logging.FromContext(r.Context()).Warn("Validation error", "error", err)
 	// 	utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()}) // 400
 	// 	return
 	// }
@@ -209,26 +246,27 @@ func (h *UserHandler) HandleUpdateUser(w http.ResponseWriter, r *http.Request) {
 		FirstName:      req.FirstName,
 		LastName:       req.LastName,
 		Bio:            req.Bio,
-		AuthLevel:      req.AuthLevel,
+		AuthLevel:      authLevel,
 	}
 
 	if req.Bio != "" {
 		user.Bio = req.Bio
 	}
-	err = user.PasswordHash.Set(req.Password)
-	if err != nil {
-		h.logger.Printf("Error setting password hash: %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Internal server error"}) // 500
-		return
-	}
+	user.PasswordHash.Set(req.Password)
 
 	updatedUser, err := h.userStore.UpdateUser(user)
 	if err != nil {
-		h.logger.Printf("Error updating user: %v", err)
+		logging.FromContext(r.Context()).Error("Error updating user", "error", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to update user"})
 		return
 	}
 
+	// A new email address has to be verified again
+	if !updatedUser.IsEmailVerified() && !strings.EqualFold(updatedUser.Email, currentUser.Email) {
+		h.verifier.SendInBackground(r.Context(), updatedUser)
+	}
+	h.auditor.Record(r, store.AuditUserUpdated, userTarget(updatedUser.ID), userSummary(currentUser), userSummary(updatedUser))
+	publish(h.events, r, events.UserUpdated, utils.Envelope{"id": updatedUser.ID}, updatedUser.ID)
 	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"user": updatedUser}) // 200
 }
 
@@ -236,14 +274,14 @@ func (h *UserHandler) HandleGetSelf(w http.ResponseWriter, r *http.Request) {
 	// Implementation for getting the currently authenticated user
 	currentUser := middleware.GetUser(r)
 	if currentUser.IsAnonymous() {
-		h.logger.Printf("Unauthorized access to self user data")
+		logging.FromContext(r.Context()).Warn("Unauthorized access to self user data")
 		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
 		return
 	}
 
 	user, err := h.userStore.GetUserById(currentUser.ID)
 	if err != nil {
-		h.logger.Printf("Error fetching user: %v", err)
+		logging.FromContext(r.Context()).Error("Error fetching user", "error", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to fetch user"})
 		return
 	}
@@ -260,7 +298,7 @@ func (h *UserHandler) HandleUpdateUserPassword(w http.ResponseWriter, r *http.Re
 	// Implementation for updating a user's password
 	userId, err := utils.ReadIDParam(r, "id")
 	if err != nil {
-		h.logger.Printf("Invalid user ID parameter: %v", err)
+		logging.FromContext(r.Context()).Warn("Invalid user ID parameter", "error", err)
 		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid user ID parameter"}) // 400
 		return
 	}
@@ -270,7 +308,7 @@ func (h *UserHandler) HandleUpdateUserPassword(w http.ResponseWriter, r *http.Re
 	}
 	err = json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		h.logger.Printf("Invalid request payload: %v", err)
+		logging.FromContext(r.Context()).Warn("Invalid request payload", "error", err)
 		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Invalid request payload"})
 		return
 	}
@@ -278,16 +316,18 @@ func (h *UserHandler) HandleUpdateUserPassword(w http.ResponseWriter, r *http.Re
 	// Ensure current user is the one being updated
 	currentUser := middleware.GetUser(r)
 	if currentUser.IsAnonymous() || currentUser.ID != int(userId) {
-		h.logger.Printf("Unauthorized password update attempt for user ID %d by user ID %d", userId, currentUser.ID)
+		logging.FromContext(r.Context()).Warn("Unauthorized password update attempt for another user", "target_user_id", userId)
 		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "Unauthorized"}) // 401
 		return
 	}
 	err = h.userStore.UpdateUserPassword(int(userId), req.NewPassword)
 	if err != nil {
-		h.logger.Printf("Error updating user password: %v", err)
+		logging.FromContext(r.Context()).Error("Error updating user password", "error", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "Failed to update user password"})
 		return
 	}
 
+	h.auditor.Record(r, store.AuditPasswordChanged, userTarget(int(userId)), nil, nil)
+	publish(h.events, r, events.UserUpdated, utils.Envelope{"id": int(userId)}, int(userId))
 	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "Password updated successfully"}) // 200
 }
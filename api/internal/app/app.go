@@ -3,53 +3,170 @@ package app
 import (
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"sync"
 
 	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/api"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/config"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/events"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/lockout"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/logging"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/mailer"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/metrics"
 	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/middleware"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/policy"
 	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/store"
 	"github.com/OlivierCoq/notes_app/api/notes_app_api/migrations"
 )
 
 // This is the main application struct that holds the dependencies for the app
 type Application struct {
-	Logger        *log.Logger
-	DB            *sql.DB // Add the database connection field
-	UserHandler   *api.UserHandler
-	TokenHandler  *api.TokenHandler
-	Middleware    *middleware.UserMiddleware
-	NoteHandler   *api.NoteHandler
-	FolderHandler *api.FolderHandler
+	Logger                   *slog.Logger
+	Config                   *config.Config
+	DB                       *sql.DB // Add the database connection field
+	UserHandler              *api.UserHandler
+	TokenHandler             *api.TokenHandler
+	Middleware               *middleware.UserMiddleware
+	NoteHandler              *api.NoteHandler
+	FolderHandler            *api.FolderHandler
+	TrashHandler             *api.TrashHandler
+	TagHandler               *api.TagHandler
+	ShareHandler             *api.ShareHandler
+	LinkHandler              *api.PublicLinkHandler
+	EventHandler             *api.EventHandler
+	PasswordResetHandler     *api.PasswordResetHandler
+	EmailVerificationHandler *api.EmailVerificationHandler
+	TwoFactorHandler         *api.TwoFactorHandler
+	SessionHandler           *api.SessionHandler
+	APITokenHandler          *api.APITokenHandler
+	AdminHandler             *api.AdminHandler
+	AuditHandler             *api.AuditHandler
+	AccountHandler           *api.AccountHandler
+	TrashStore               store.TrashStore // Used by the background trash purger
+	UserStore                store.UserStore  // Used by the background account purger
+	LoginGuard               *lockout.Tracker // Pruned in the background
+	TokenStore               store.TokenStore // Used by the background token cleaner
+	AdminStore               store.AdminStore // Used by the background metrics refresher
+	Auditor                  *api.Auditor     // Audits what the background purgers delete
+	EventBus                 events.Bus
+	Metrics                  *metrics.Metrics
+
+	lifecycle lifecycle
 }
 
-func NewApplication() (*Application, error) {
+// NewApplication wires the stores, handlers and middleware together according to cfg, and migrates the database.
+func NewApplication(cfg *config.Config) (*Application, error) {
 
-	// Create a new logger:
-	logger := log.New(os.Stdout, "", log.Ldate|log.Ltime)
+	// JSON logs on stdout. Requests log through their own logger, see middleware.RequestID.
+	level, err := cfg.Level()
+	if err != nil {
+		return nil, err
+	}
+	logger := logging.New(os.Stdout, level)
+	// Anything still using the log package, like net/http, goes through it too
+	slog.SetDefault(logger)
 
 	// Database connection
-	pgDB, err := store.Open()
+	pgDB, err := store.Open(cfg.DatabaseURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to the database: %w", err)
 	}
+	logger.Info("Database connection established! 🚀")
 
 	// Stores
 	notesStore := store.NewPostgresNoteStore(pgDB)
-	userStore := store.NewPostgresUserStore(pgDB)
+	userStore := store.NewPostgresUserStore(pgDB, cfg.BcryptCost)
 	tokenStore := store.NewPostgresTokenStore(pgDB)
 	folderStore := store.NewPostgresFolderStore(pgDB)
+	trashStore := store.NewPostgresTrashStore(pgDB)
+	tagStore := store.NewPostgresTagStore(pgDB)
+	shareStore := store.NewPostgresShareStore(pgDB)
+	linkStore := store.NewPostgresPublicLinkStore(pgDB, cfg.BcryptCost)
+	twoFactorStore := store.NewPostgresTwoFactorStore(pgDB)
+	apiTokenStore := store.NewPostgresAPITokenStore(pgDB)
+	adminStore := store.NewPostgresAdminStore(pgDB)
+	exportStore := store.NewPostgresExportStore(pgDB)
+	auditStore := store.NewPostgresAuditStore(pgDB)
+
+	// Real-time events
+	var eventBus events.Bus
+	switch cfg.EventBus {
+	case config.EventBusMemory:
+		eventBus = events.NewMemoryBus()
+	case config.EventBusPostgres:
+		eventBus = events.NewPostgresBus(pgDB, logger)
+	default:
+		return nil, fmt.Errorf("unknown event bus %q", cfg.EventBus)
+	}
+
+	// Outgoing mail
+	var mail mailer.Mailer
+	switch {
+	case cfg.SMTPAddr != "":
+		mail = mailer.NewSMTPMailer(cfg.SMTPAddr, cfg.MailFrom, nil)
+	case cfg.MailFile != "":
+		mail = mailer.NewFileMailer(cfg.MailFile, cfg.MailFrom)
+	default:
+		mail = mailer.NewLogMailer(logger)
+	}
+
+	// Failed login tracking
+	var loginFailures lockout.Store
+	switch cfg.LoginFailureStore {
+	case config.LoginFailuresMemory:
+		loginFailures = lockout.NewMemoryStore()
+	case config.LoginFailuresPostgres:
+		loginFailures = lockout.NewPostgresStore(pgDB)
+	default:
+		return nil, fmt.Errorf("unknown login failure store %q", cfg.LoginFailureStore)
+	}
+	loginGuard := lockout.NewTracker(loginFailures)
+	// Passwords of public links, counted per link in the same store and pruned along with the logins
+	linkGuard := lockout.NewTracker(loginFailures)
+	linkGuard.Prefix = "link:"
+
+	// Prometheus metrics, served on /metrics
+	appMetrics := metrics.New(pgDB)
+
+	// Authorization policy shared by the note, folder and share handlers
+	accessPolicy := policy.New(folderStore, shareStore)
+
+	// Audit trail, written to by most handlers
+	auditor := api.NewAuditor(auditStore)
 
 	// Handlers
-	noteHandler := api.NewNoteHandler(notesStore, logger)
-	userHandler := api.NewUserHandler(userStore, logger)
-	tokenHandler := api.NewTokenHandler(tokenStore, userStore, logger)
-	folderHandler := api.NewFolderHandler(folderStore, logger)
+	noteHandler := api.NewNoteHandler(notesStore, accessPolicy, eventBus, auditor)
+	// Mail sent in the background by the handlers, waited for by Shutdown
+	background := &sync.WaitGroup{}
+
+	emailVerifier := api.NewEmailVerifier(tokenStore, mail, background, cfg.AppURL)
+	userHandler := api.NewUserHandler(userStore, emailVerifier, eventBus, auditor)
+	tokenHandler := api.NewTokenHandler(tokenStore, userStore, twoFactorStore, api.TokenTTLs{Access: cfg.AccessTokenTTL, Refresh: cfg.RefreshTokenTTL}, loginGuard, auditor, appMetrics)
+	folderHandler := api.NewFolderHandler(folderStore, notesStore, accessPolicy, eventBus, auditor)
+	trashHandler := api.NewTrashHandler(trashStore, auditor)
+	tagHandler := api.NewTagHandler(tagStore, notesStore, accessPolicy)
+	shareHandler := api.NewShareHandler(shareStore, userStore, notesStore, folderStore, accessPolicy, auditor)
+	linkHandler := api.NewPublicLinkHandler(linkStore, notesStore, accessPolicy, linkGuard, auditor)
+	eventHandler := api.NewEventHandler(eventBus)
+	passwordResetHandler := api.NewPasswordResetHandler(userStore, tokenStore, apiTokenStore, mail, background, cfg.AppURL, loginGuard, auditor)
+	emailVerificationHandler := api.NewEmailVerificationHandler(userStore, tokenStore, emailVerifier)
+	twoFactorHandler := api.NewTwoFactorHandler(twoFactorStore, auditor)
+	sessionHandler := api.NewSessionHandler(tokenStore, auditor)
+	apiTokenHandler := api.NewAPITokenHandler(apiTokenStore, auditor, appMetrics)
+	accountHandler := api.NewAccountHandler(userStore, tokenStore, exportStore, mail, background, cfg.DeletionGracePeriod, auditor)
+	adminHandler := api.NewAdminHandler(userStore, adminStore, tokenStore, apiTokenStore, passwordResetHandler, eventBus, auditor)
+	auditHandler := api.NewAuditHandler(auditStore)
 
 	// Middleware
 	middlewareHandler := &middleware.UserMiddleware{
-		UserStore: userStore,
+		UserStore:     userStore,
+		TokenStore:    tokenStore,
+		APITokenStore: apiTokenStore,
+		CORSOrigins:   cfg.CORSOrigins,
+		Metrics:       appMetrics,
+		Logger:        logger,
 	}
 	userMiddleware := middlewareHandler
 
@@ -62,13 +179,37 @@ func NewApplication() (*Application, error) {
 	}
 
 	app := &Application{
-		Logger:        logger,
-		DB:            pgDB,
-		UserHandler:   userHandler,
-		TokenHandler:  tokenHandler,
-		Middleware:    userMiddleware,
-		NoteHandler:   noteHandler,
-		FolderHandler: folderHandler,
+		Logger:                   logger,
+		Config:                   cfg,
+		DB:                       pgDB,
+		UserHandler:              userHandler,
+		TokenHandler:             tokenHandler,
+		Middleware:               userMiddleware,
+		NoteHandler:              noteHandler,
+		FolderHandler:            folderHandler,
+		TrashHandler:             trashHandler,
+		TagHandler:               tagHandler,
+		ShareHandler:             shareHandler,
+		LinkHandler:              linkHandler,
+		EventHandler:             eventHandler,
+		PasswordResetHandler:     passwordResetHandler,
+		EmailVerificationHandler: emailVerificationHandler,
+		TwoFactorHandler:         twoFactorHandler,
+		SessionHandler:           sessionHandler,
+		APITokenHandler:          apiTokenHandler,
+		AdminHandler:             adminHandler,
+		AccountHandler:           accountHandler,
+		AuditHandler:             auditHandler,
+		TrashStore:               trashStore,
+		UserStore:                userStore,
+		TokenStore:               tokenStore,
+		LoginGuard:               loginGuard,
+		AdminStore:               adminStore,
+		Auditor:                  auditor,
+		EventBus:                 eventBus,
+		Metrics:                  appMetrics,
+
+		lifecycle: lifecycle{background: background},
 	}
 
 	return app, nil
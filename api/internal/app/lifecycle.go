@@ -0,0 +1,117 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// lifecycle tracks the background workers between Start and Shutdown
+type lifecycle struct {
+	stopWorkers context.CancelFunc
+	workers     sync.WaitGroup
+	background  *sync.WaitGroup // work started by requests that outlives them, like sending mail
+	shutdown    sync.Once
+}
+
+// worker is a background job that runs until its context is cancelled
+type worker struct {
+	name string
+	run  func(ctx context.Context)
+}
+
+// pendingWork is something Shutdown waits for once the workers have stopped, before closing the database
+type pendingWork struct {
+	what string
+	wait func()
+}
+
+// backgroundWorkers lists what Start runs next to the HTTP server
+func (a *Application) backgroundWorkers() []worker {
+	return []worker{
+		{"trash purger", func(ctx context.Context) { a.RunTrashPurger(ctx, a.Config.TrashRetention) }},
+		{"account purger", a.RunAccountPurger},
+		{"token cleaner", a.RunTokenCleaner},
+		{"login failure pruner", a.RunLoginFailurePruner},
+		{"event listener", a.RunEventListener},
+		{"metrics refresher", a.RunMetricsRefresher},
+	}
+}
+
+// pendingWork lists what may still be using the database after the workers have stopped
+func (a *Application) pendingWork() []pendingWork {
+	pending := []pendingWork{}
+	if a.lifecycle.background != nil {
+		pending = append(pending, pendingWork{"emails being sent", a.lifecycle.background.Wait})
+	}
+	if a.Middleware != nil {
+		pending = append(pending, pendingWork{"token usage updates", a.Middleware.Wait})
+	}
+	return pending
+}
+
+// Start runs the background workers until Shutdown
+func (a *Application) Start() {
+	a.startWorkers(a.backgroundWorkers())
+}
+
+func (a *Application) startWorkers(workers []worker) {
+	ctx, cancel := context.WithCancel(context.Background())
+	a.lifecycle.stopWorkers = cancel
+
+	for _, w := range workers {
+		a.lifecycle.workers.Add(1)
+		go func() {
+			defer a.lifecycle.workers.Done()
+			w.run(ctx)
+			a.Logger.Info("Stopped background worker", "worker", w.name)
+		}()
+	}
+}
+
+// Shutdown stops the application once the HTTP server has stopped taking requests (see http.Server.Shutdown):
+//
+//  1. the background workers are told to stop, and the ones in the middle of a run get to finish it
+//  2. mail still being sent and pending background writes of the middleware are waited for
+//  3. the database is closed, last, since everything before may still be using it
+//
+// If ctx ends first the database is closed anyway, and the error says what was still running.
+func (a *Application) Shutdown(ctx context.Context) error {
+	return a.shutdown(ctx, a.pendingWork(), a.DB.Close)
+}
+
+func (a *Application) shutdown(ctx context.Context, pending []pendingWork, closeDB func() error) error {
+	var err error
+	a.lifecycle.shutdown.Do(func() {
+		if a.lifecycle.stopWorkers != nil {
+			a.lifecycle.stopWorkers()
+		}
+		err = wait(ctx, "background workers", a.lifecycle.workers.Wait)
+		for _, p := range pending {
+			err = errors.Join(err, wait(ctx, p.what, p.wait))
+		}
+
+		closeErr := closeDB()
+		if closeErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to close the database: %w", closeErr))
+		}
+	})
+	return err
+}
+
+// wait runs a blocking wait function, giving up when ctx ends
+func wait(ctx context.Context, what string, waitFunc func()) error {
+	done := make(chan struct{})
+	go func() {
+		waitFunc()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%s did not stop in time: %w", what, ctx.Err())
+	}
+}
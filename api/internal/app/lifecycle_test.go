@@ -0,0 +1,148 @@
+package app
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// shutdownLog records the order things happen in during a shutdown
+type shutdownLog struct {
+	mu   sync.Mutex
+	list []string
+}
+
+func (e *shutdownLog) add(event string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.list = append(e.list, event)
+}
+
+func (e *shutdownLog) get() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return slices.Clone(e.list)
+}
+
+func newTestApplication() *Application {
+	return &Application{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+}
+
+// fakeWorker runs until cancelled, then takes a moment to finish its run like a real worker in the middle of a query
+func fakeWorker(name string, e *shutdownLog) worker {
+	return worker{name, func(ctx context.Context) {
+		<-ctx.Done()
+		time.Sleep(10 * time.Millisecond)
+		e.add(name + " stopped")
+	}}
+}
+
+func fakeCloseDB(e *shutdownLog) func() error {
+	return func() error {
+		e.add("db closed")
+		return nil
+	}
+}
+
+func TestShutdownStopsWorkersBeforeClosingTheDatabase(t *testing.T) {
+	e := &shutdownLog{}
+	app := newTestApplication()
+	app.startWorkers([]worker{fakeWorker("purger", e), fakeWorker("listener", e)})
+
+	err := app.shutdown(context.Background(), nil, fakeCloseDB(e))
+	if err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	got := e.get()
+	if len(got) != 3 || got[2] != "db closed" {
+		t.Fatalf("expected both workers to stop before the database is closed, got %v", got)
+	}
+	if !slices.Contains(got, "purger stopped") || !slices.Contains(got, "listener stopped") {
+		t.Fatalf("expected both workers to stop, got %v", got)
+	}
+}
+
+func TestShutdownWaitsForPendingWorkBeforeClosingTheDatabase(t *testing.T) {
+	e := &shutdownLog{}
+	app := newTestApplication()
+	app.startWorkers([]worker{fakeWorker("purger", e)})
+
+	pending := []pendingWork{
+		{"emails being sent", func() {
+			time.Sleep(10 * time.Millisecond)
+			e.add("emails sent")
+		}},
+		{"token usage updates", func() {
+			time.Sleep(10 * time.Millisecond)
+			e.add("middleware waited")
+		}},
+	}
+	err := app.shutdown(context.Background(), pending, fakeCloseDB(e))
+	if err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	want := []string{"purger stopped", "emails sent", "middleware waited", "db closed"}
+	if got := e.get(); !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestShutdownClosesTheDatabaseWhenTheContextEnds(t *testing.T) {
+	e := &shutdownLog{}
+	app := newTestApplication()
+
+	release := make(chan struct{})
+	defer close(release)
+	app.startWorkers([]worker{{"stuck worker", func(ctx context.Context) {
+		<-release // ignores the cancellation
+	}}})
+	pending := []pendingWork{{"token usage updates", func() { <-release }}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := app.shutdown(ctx, pending, fakeCloseDB(e))
+
+	if got := e.get(); !slices.Equal(got, []string{"db closed"}) {
+		t.Fatalf("expected the database to be closed anyway, got %v", got)
+	}
+	if err == nil {
+		t.Fatal("expected an error saying what was still running")
+	}
+	for _, what := range []string{"background workers did not stop in time", "token usage updates did not stop in time"} {
+		if !strings.Contains(err.Error(), what) {
+			t.Errorf("expected the error to contain %q, got %q", what, err)
+		}
+	}
+}
+
+func TestShutdownRunsOnce(t *testing.T) {
+	e := &shutdownLog{}
+	app := newTestApplication()
+	app.startWorkers(nil)
+
+	for range 2 {
+		if err := app.shutdown(context.Background(), nil, fakeCloseDB(e)); err != nil {
+			t.Fatalf("shutdown: %v", err)
+		}
+	}
+	if got := e.get(); len(got) != 1 {
+		t.Fatalf("expected the database to be closed once, got %v", got)
+	}
+}
+
+func TestPendingWorkIncludesBackgroundMail(t *testing.T) {
+	app := newTestApplication()
+	app.lifecycle.background = &sync.WaitGroup{}
+
+	pending := app.pendingWork()
+	if len(pending) != 1 || pending[0].what != "emails being sent" {
+		t.Fatalf("expected the background mail to be waited for, got %v", pending)
+	}
+}
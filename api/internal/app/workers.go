@@ -0,0 +1,148 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/events"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/store"
+)
+
+// How often the purger looks for expired trash
+const trashPurgeInterval = time.Hour
+
+// RunTrashPurger permanently deletes notes and folders that have been in the trash for longer than retention.
+// It runs once right away and then every trashPurgeInterval until ctx is cancelled.
+func (a *Application) RunTrashPurger(ctx context.Context, retention time.Duration) {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		notes, folders, err := a.TrashStore.PurgeTrash(time.Now().Add(-retention))
+		if err != nil {
+			a.Logger.Error("Error purging trash", "error", err)
+		} else if purged := len(notes) + len(folders); purged > 0 {
+			for _, note := range notes {
+				a.Auditor.RecordPurge(ctx, store.AuditNotePurged, store.AuditTargetNote, note)
+			}
+			for _, folder := range folders {
+				a.Auditor.RecordPurge(ctx, store.AuditFolderPurged, store.AuditTargetFolder, folder)
+			}
+			a.Logger.Info("Purged the trash", "items", purged)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// How often the account purger looks for accounts whose deletion grace period is over
+const accountPurgeInterval = time.Hour
+
+// RunAccountPurger deletes the accounts whose owners asked for it once the grace period has passed.
+// It runs once right away and then every accountPurgeInterval until ctx is cancelled.
+func (a *Application) RunAccountPurger(ctx context.Context) {
+	ticker := time.NewTicker(accountPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := a.UserStore.PurgeScheduledDeletions()
+		if err != nil {
+			a.Logger.Error("Error purging deleted accounts", "error", err)
+		} else if len(purged) > 0 {
+			for _, user := range purged {
+				a.Auditor.RecordPurge(ctx, store.AuditAccountDeleted, store.AuditTargetUser, user)
+			}
+			a.Logger.Info("Purged deleted accounts", "accounts", len(purged))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// How often forgotten login failures are cleared out
+const loginFailurePruneInterval = time.Hour
+
+// RunLoginFailurePruner drops failed login counts old enough not to matter any more.
+func (a *Application) RunLoginFailurePruner(ctx context.Context) {
+	ticker := time.NewTicker(loginFailurePruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		_, err := a.LoginGuard.Prune(ctx)
+		if err != nil {
+			a.Logger.Error("Error pruning login failures", "error", err)
+		}
+	}
+}
+
+// RunEventListener receives events published by other API instances. Only the Postgres event bus needs it.
+func (a *Application) RunEventListener(ctx context.Context) {
+	if bus, ok := a.EventBus.(*events.PostgresBus); ok {
+		bus.Run(ctx)
+	}
+}
+
+// How often expired tokens are deleted
+const tokenCleanupInterval = time.Hour
+
+// RunTokenCleaner deletes expired tokens, so the tokens table only holds ones that can still be used.
+// It runs once right away and then every tokenCleanupInterval until ctx is cancelled.
+func (a *Application) RunTokenCleaner(ctx context.Context) {
+	ticker := time.NewTicker(tokenCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		deleted, err := a.TokenStore.DeleteExpiredTokens()
+		if err != nil {
+			a.Logger.Error("Error deleting expired tokens", "error", err)
+		} else if deleted > 0 {
+			a.Logger.Info("Deleted expired tokens", "tokens", deleted)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// How often the business gauges of the metrics are recounted
+const metricsRefreshInterval = time.Minute
+
+// RunMetricsRefresher keeps the totals of the metrics (users, notes...) up to date. Counting them on every scrape
+// would let whoever scrapes decide how much load they put on the database.
+// It runs once right away and then every metricsRefreshInterval until ctx is cancelled.
+func (a *Application) RunMetricsRefresher(ctx context.Context) {
+	ticker := time.NewTicker(metricsRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		totals, err := a.AdminStore.GetSiteTotals()
+		if err != nil {
+			a.Logger.Error("Error counting totals for the metrics", "error", err)
+		} else {
+			a.Metrics.SetTotals(totals)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
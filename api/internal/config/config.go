@@ -0,0 +1,330 @@
+// Package config holds the settings the API server runs with. They are read, from lowest to highest priority,
+// from the built-in defaults, an optional config file, NOTES_* environment variables and command line flags,
+// so the same binary runs in development, tests and production.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Event bus backends
+const (
+	EventBusMemory   = "memory"   // single API instance
+	EventBusPostgres = "postgres" // several instances, fanned out with LISTEN/NOTIFY
+)
+
+// Where failed login counts are kept
+const (
+	LoginFailuresMemory   = "memory"   // single API instance, forgotten on restart
+	LoginFailuresPostgres = "postgres" // shared by every instance
+)
+
+// Every environment variable is the flag name in upper case with this prefix, e.g. NOTES_DATABASE_URL for -database-url
+const envPrefix = "NOTES_"
+
+// Config is the effective configuration of the server
+type Config struct {
+	Port         int
+	ReadTimeout  time.Duration // max duration for reading the entire request, including the body
+	WriteTimeout time.Duration // max duration before timing out writes of the response
+	IdleTimeout  time.Duration // how long to wait before closing idle connections
+
+	ShutdownTimeout time.Duration // how long a shutdown waits for in-flight requests, then again for background work
+
+	DatabaseURL string   // Postgres DSN, either key=value pairs or a postgres:// URL
+	CORSOrigins []string // Origins browsers may call the API from
+
+	EventBus string // EventBusMemory or EventBusPostgres
+	AppURL   string // Base URL of the UI, used in links sent by email
+	MailFrom string
+	SMTPAddr string // host:port of an SMTP server. Empty writes mail to MailFile instead
+	MailFile string // Empty logs mail to the application log
+
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	BcryptCost      int // Cost of new password hashes. Existing hashes keep working whatever their cost.
+
+	TrashRetention      time.Duration // How long deleted notes and folders stay in the trash
+	DeletionGracePeriod time.Duration // How long a deleted account can be recovered by logging in
+
+	LoginFailureStore string // LoginFailuresMemory or LoginFailuresPostgres
+
+	LogLevel string // debug, info, warn or error
+
+	// /metrics is served on MetricsAddr when set, only to requests bearing MetricsToken when set. With neither, it is off.
+	MetricsAddr  string
+	MetricsToken string
+}
+
+// Default is the configuration for local development
+func Default() *Config {
+	return &Config{
+		Port:         8080,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+		IdleTimeout:  time.Minute,
+
+		ShutdownTimeout: 20 * time.Second,
+
+		DatabaseURL: "host=localhost port=5432 user=postgres password=postgres dbname=postgres sslmode=disable",
+		CORSOrigins: []string{
+			"http://localhost:5173",
+			"http://127.0.0.1:5173",
+			"http://localhost:3000",
+		},
+
+		EventBus: EventBusMemory,
+		AppURL:   "http://localhost:5173",
+		MailFrom: "Notes App <no-reply@localhost>",
+		MailFile: "mail.log",
+
+		AccessTokenTTL:  15 * time.Minute,
+		RefreshTokenTTL: 30 * 24 * time.Hour,
+		BcryptCost:      12,
+
+		TrashRetention:      30 * 24 * time.Hour,
+		DeletionGracePeriod: 14 * 24 * time.Hour,
+
+		LoginFailureStore: LoginFailuresMemory,
+
+		LogLevel: "info",
+	}
+}
+
+// Settings whose values are never printed in full
+var secrets = map[string]bool{
+	"database-url":  true,
+	"metrics-token": true,
+}
+
+// bind registers one flag per setting on fs, bound to the fields of c and defaulting to their current values.
+// The flag names are also the keys of the config file and, see envPrefix, the names of the environment variables.
+func (c *Config) bind(fs *flag.FlagSet) {
+	fs.IntVar(&c.Port, "port", c.Port, "Port to run the server on")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", c.ReadTimeout, "Max duration for reading an entire request, including the body")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "Max duration for writing a response")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "How long idle keep-alive connections stay open")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "How long a shutdown (SIGINT or SIGTERM) waits for in-flight requests, then again for background work")
+	fs.StringVar(&c.DatabaseURL, "database-url", c.DatabaseURL, "Postgres connection string, key=value pairs or a postgres:// URL")
+	fs.Var((*listValue)(&c.CORSOrigins), "cors-origins", "Comma-separated origins browsers may call the API from")
+	fs.StringVar(&c.EventBus, "event-bus", c.EventBus, "Real-time event bus: memory (single instance) or postgres (LISTEN/NOTIFY across instances)")
+	fs.StringVar(&c.AppURL, "app-url", c.AppURL, "Base URL of the UI, used in links sent by email")
+	fs.StringVar(&c.MailFrom, "mail-from", c.MailFrom, "Sender address for outgoing mail")
+	fs.StringVar(&c.SMTPAddr, "smtp-addr", c.SMTPAddr, "SMTP server (host:port) for outgoing mail, e.g. localhost:1025 for MailHog. Leave empty to write mail to -mail-file")
+	fs.StringVar(&c.MailFile, "mail-file", c.MailFile, "File outgoing mail is written to when no SMTP server is set. Empty logs it instead")
+	fs.DurationVar(&c.AccessTokenTTL, "access-token-ttl", c.AccessTokenTTL, "Lifetime of authentication (access) tokens")
+	fs.DurationVar(&c.RefreshTokenTTL, "refresh-token-ttl", c.RefreshTokenTTL, "Lifetime of refresh tokens")
+	fs.IntVar(&c.BcryptCost, "bcrypt-cost", c.BcryptCost, "bcrypt cost of new password hashes")
+	fs.DurationVar(&c.TrashRetention, "trash-retention", c.TrashRetention, "How long deleted notes and folders stay in the trash before being purged")
+	fs.DurationVar(&c.DeletionGracePeriod, "deletion-grace-period", c.DeletionGracePeriod, "How long a deleted account can still be recovered by logging in before it is purged")
+	fs.StringVar(&c.LoginFailureStore, "login-failure-store", c.LoginFailureStore, "Where failed logins are counted: memory (single instance) or postgres (shared across instances)")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "Lowest level logged: debug, info, warn or error")
+	fs.StringVar(&c.MetricsAddr, "metrics-addr", c.MetricsAddr, "Separate address (host:port) to serve /metrics on, e.g. 127.0.0.1:9090. Leave empty to serve it with the API, which needs -metrics-token")
+	fs.StringVar(&c.MetricsToken, "metrics-token", c.MetricsToken, "Bearer token Prometheus must send to read /metrics")
+}
+
+// Load builds the configuration from args (without the program name), the environment and the config file
+// named by -config or NOTES_CONFIG, then validates it. Flags win over the environment, which wins over the file.
+// It returns flag.ErrHelp when -h or -help is given.
+func Load(args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	c := Default()
+	fs := flag.NewFlagSet("notes_app_api", flag.ContinueOnError)
+	c.bind(fs)
+	var path string
+	fs.StringVar(&path, "config", "", "Optional config file (.yaml, .yml or .toml) with the same settings as the flags, e.g. database_url: ...")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	// Flags already hold their values; the file and the environment only fill in the rest
+	fromFlags := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { fromFlags[f.Name] = true })
+
+	if !fromFlags["config"] {
+		path, _ = lookupEnv(envPrefix + "CONFIG")
+	}
+	if path != "" {
+		settings, err := readFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range settings {
+			name := strings.ReplaceAll(s.key, "_", "-")
+			if name == "config" || fs.Lookup(name) == nil {
+				return nil, fmt.Errorf("%s:%d: unknown setting %q", path, s.line, s.key)
+			}
+			if fromFlags[name] {
+				continue
+			}
+			err := fs.Set(name, s.value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid %s: %w", path, s.line, s.key, err)
+			}
+		}
+	}
+
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || fromFlags[f.Name] {
+			return
+		}
+		env := envName(f.Name)
+		value, ok := lookupEnv(env)
+		if !ok {
+			return
+		}
+		err := f.Value.Set(value)
+		if err != nil {
+			envErr = errors.Join(envErr, fmt.Errorf("invalid %s: %w", env, err))
+		}
+	})
+	if envErr != nil {
+		return nil, envErr
+	}
+
+	err = c.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Validate reports every invalid setting at once
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Port > 0 && c.Port <= 65535, "port must be between 1 and 65535")
+	check(c.ReadTimeout > 0, "read-timeout must be positive")
+	check(c.WriteTimeout > 0, "write-timeout must be positive")
+	check(c.IdleTimeout > 0, "idle-timeout must be positive")
+	check(c.ShutdownTimeout > 0, "shutdown-timeout must be positive")
+
+	check(strings.TrimSpace(c.DatabaseURL) != "", "database-url is required")
+	for _, origin := range c.CORSOrigins {
+		check(origin != "*", "cors-origins cannot be *, requests carry credentials")
+		if origin != "*" {
+			check(isBaseURL(origin, false), "cors-origins: %q is not an origin like https://notes.example.com", origin)
+		}
+	}
+
+	check(c.EventBus == EventBusMemory || c.EventBus == EventBusPostgres, "event-bus must be %s or %s", EventBusMemory, EventBusPostgres)
+	check(isBaseURL(c.AppURL, true), "app-url must be an http or https URL")
+	_, err := mail.ParseAddress(c.MailFrom)
+	check(err == nil, "mail-from must be an email address, optionally with a name")
+
+	check(c.AccessTokenTTL > 0, "access-token-ttl must be positive")
+	check(c.RefreshTokenTTL >= c.AccessTokenTTL, "refresh-token-ttl must be at least access-token-ttl")
+	check(c.BcryptCost >= bcrypt.MinCost && c.BcryptCost <= bcrypt.MaxCost, "bcrypt-cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+
+	check(c.TrashRetention > 0, "trash-retention must be positive")
+	check(c.DeletionGracePeriod > 0, "deletion-grace-period must be positive")
+
+	check(c.LoginFailureStore == LoginFailuresMemory || c.LoginFailureStore == LoginFailuresPostgres, "login-failure-store must be %s or %s", LoginFailuresMemory, LoginFailuresPostgres)
+
+	_, err = c.Level()
+	check(err == nil, "log-level must be debug, info, warn or error")
+
+	if c.MetricsAddr != "" {
+		_, _, err = net.SplitHostPort(c.MetricsAddr)
+		check(err == nil, "metrics-addr must be host:port, or :port")
+		check(c.MetricsAddr != fmt.Sprintf(":%d", c.Port), "metrics-addr must differ from the API port")
+	}
+	check(c.MetricsToken == "" || len(c.MetricsToken) >= 16, "metrics-token must be at least 16 characters")
+
+	return errors.Join(errs...)
+}
+
+// isBaseURL reports whether s is an absolute http(s) URL. Origins cannot have a path, base URLs can.
+func isBaseURL(s string, pathAllowed bool) bool {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+	return pathAllowed || (u.Path == "" && u.RawQuery == "" && u.Fragment == "")
+}
+
+// Level is LogLevel as a slog.Level
+func (c *Config) Level() (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(c.LogLevel))
+	return level, err
+}
+
+// LogValue logs the effective configuration, one attribute per setting, with secrets redacted
+func (c *Config) LogValue() slog.Value {
+	attrs := []slog.Attr{}
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	c.bind(fs)
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if secrets[f.Name] {
+			value = redact(f.Name, value)
+		}
+		attrs = append(attrs, slog.String(f.Name, value))
+	})
+	return slog.GroupValue(attrs...)
+}
+
+// The password of key=value connection strings, quoted or not
+var dsnPasswordRegex = regexp.MustCompile(`(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+
+func redact(name, value string) string {
+	if value == "" {
+		return ""
+	}
+	if name == "database-url" {
+		// Where the database is helps when debugging a deployment, only the password goes
+		if u, err := url.Parse(value); err == nil && u.Scheme != "" {
+			return u.Redacted()
+		}
+		return dsnPasswordRegex.ReplaceAllString(value, "${1}xxxxx")
+	}
+	return "xxxxx"
+}
+
+// listValue is a comma-separated flag. Setting it replaces the whole list.
+type listValue []string
+
+func (l *listValue) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(s string) error {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	*l = list
+	return nil
+}
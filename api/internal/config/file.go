@@ -0,0 +1,179 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// fileSetting is one key and its value as read from a config file, before being parsed by its flag
+type fileSetting struct {
+	key   string
+	value string // lists are joined with commas, like on the command line
+	line  int
+}
+
+// readFile reads a config file. Only flat files are supported: one setting per line, keys being the flag names
+// with dashes or underscores, values plain, quoted or, for lists, inline arrays.
+//
+//	# notes.yaml                       # notes.toml
+//	port: 8080                         port = 8080
+//	database_url: "postgres://..."     database_url = "postgres://..."
+//	cors_origins:                      cors_origins = ["https://notes.example.com"]
+//	  - https://notes.example.com
+func readFile(path string) ([]fileSetting, error) {
+	var separator string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		separator = ":"
+	case ".toml":
+		separator = "="
+	default:
+		return nil, fmt.Errorf("%s: config files must be .yaml, .yml or .toml", path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer file.Close()
+
+	settings := []fileSetting{}
+	var list *fileSetting // the YAML block list being read, if any
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		raw := stripComment(scanner.Text())
+		line := strings.TrimSpace(raw)
+		if line == "" || line == "---" {
+			continue
+		}
+
+		// "  - item" lines of a YAML block list
+		if list != nil && (line == "-" || strings.HasPrefix(line, "- ")) {
+			item, err := parseScalar(strings.TrimSpace(strings.TrimPrefix(line, "-")))
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+			}
+			if list.value != "" {
+				list.value += ","
+			}
+			list.value += item
+			continue
+		}
+		if list != nil {
+			settings = append(settings, *list)
+			list = nil
+		}
+
+		if strings.HasPrefix(line, "[") {
+			return nil, fmt.Errorf("%s:%d: sections are not supported, settings go at the top level", path, lineNumber)
+		}
+		key, value, found := strings.Cut(line, separator)
+		key = strings.TrimSpace(key)
+		if !found || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("%s:%d: expected key%s value", path, lineNumber, separator)
+		}
+		value = strings.TrimSpace(value)
+
+		if value == "" && separator == ":" {
+			list = &fileSetting{key: key, line: lineNumber}
+			continue
+		}
+		parsed, err := parseValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+		settings = append(settings, fileSetting{key: key, value: parsed, line: lineNumber})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	if list != nil {
+		settings = append(settings, *list)
+	}
+	return settings, nil
+}
+
+// stripComment removes a # comment, unless the # is inside quotes or part of a word as in a URL fragment
+func stripComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseValue parses a scalar or an inline array such as ["a", "b"], which becomes "a,b"
+func parseValue(value string) (string, error) {
+	if !strings.HasPrefix(value, "[") {
+		return parseScalar(value)
+	}
+	if !strings.HasSuffix(value, "]") {
+		return "", fmt.Errorf("unterminated list %s", value)
+	}
+
+	items := []string{}
+	for _, item := range splitItems(value[1 : len(value)-1]) {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parsed, err := parseScalar(item)
+		if err != nil {
+			return "", err
+		}
+		items = append(items, parsed)
+	}
+	return strings.Join(items, ","), nil
+}
+
+// splitItems splits the inside of an inline array on the commas that are not quoted
+func splitItems(s string) []string {
+	items := []string{}
+	var quote rune
+	start := 0
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == ',':
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, s[start:])
+}
+
+// parseScalar unquotes "double quoted" (with escapes) and 'single quoted' (literal) values; others are kept as they are
+func parseScalar(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid quoted value %s", value)
+		}
+		return unquoted, nil
+	case strings.HasPrefix(value, "'"):
+		if len(value) < 2 || !strings.HasSuffix(value, "'") {
+			return "", fmt.Errorf("invalid quoted value %s", value)
+		}
+		return value[1 : len(value)-1], nil
+	}
+	return value, nil
+}
@@ -0,0 +1,244 @@
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Line-level diffing for note revisions.
+// Uses the Myers O(ND) algorithm to find the shortest edit script between two texts,
+// then groups the edits into hunks and renders them in unified diff format (like `diff -u`).
+
+type opKind int
+
+const (
+	opEqual opKind = iota
+	opDelete
+	opInsert
+)
+
+type edit struct {
+	kind opKind
+	line string
+}
+
+// Above these limits the texts are not compared line by line, the diff replaces all of a with all of b.
+// maxLines bounds the input, maxEdits the memory kept for backtracking, which grows with the square of the number of edits.
+const (
+	maxLines = 10000
+	maxEdits = 2000
+)
+
+// Unified returns a unified diff turning a into b. fromName and toName are used in the ---/+++ headers.
+// context is the number of unchanged lines to show around each change. Returns "" when the texts are equal.
+func Unified(a, b, fromName, toName string, context int) string {
+	if a == b {
+		return ""
+	}
+
+	edits := myers(splitLines(a), splitLines(b))
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n", fromName)
+	fmt.Fprintf(&sb, "+++ %s\n", toName)
+
+	for _, h := range hunks(edits, context) {
+		sb.WriteString(h)
+	}
+	return sb.String()
+}
+
+// splitLines splits text into lines without their trailing newline.
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// myers computes the shortest edit script between a and b, or replaces all of a with all of b when
+// they are too long or too different to be compared within maxLines and maxEdits.
+func myers(a, b []string) []edit {
+	n, m := len(a), len(b)
+	if n > maxLines || m > maxLines {
+		return replaceAll(a, b)
+	}
+	max := n + m
+	if max > maxEdits {
+		max = maxEdits
+	}
+	offset := max + 1
+
+	// v[k+offset] is the furthest x reached on diagonal k. trace keeps, for each step d, the part of v
+	// the step reads (diagonals -d-1 to d+1) for backtracking.
+	v := make([]int, 2*max+3)
+	var trace [][]int
+
+	for d := 0; d <= max; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[k-1+offset] < v[k+1+offset]) {
+				x = v[k+1+offset] // move down (insert)
+			} else {
+				x = v[k-1+offset] + 1 // move right (delete)
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[k+offset] = x
+			if x >= n && y >= m {
+				return backtrack(a, b, trace, d)
+			}
+		}
+	}
+	return replaceAll(a, b)
+}
+
+// replaceAll is the edit script deleting every line of a, then inserting every line of b
+func replaceAll(a, b []string) []edit {
+	edits := make([]edit, 0, len(a)+len(b))
+	for _, line := range a {
+		edits = append(edits, edit{opDelete, line})
+	}
+	for _, line := range b {
+		edits = append(edits, edit{opInsert, line})
+	}
+	return edits
+}
+
+// backtrack walks the saved traces from the end back to the start to rebuild the edit script.
+func backtrack(a, b []string, trace [][]int, d int) []edit {
+	x, y := len(a), len(b)
+	var edits []edit
+
+	for ; d >= 0; d-- {
+		// trace[d] starts at diagonal -d-1
+		v := trace[d]
+		offset := d + 1
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && v[k-1+offset] < v[k+1+offset]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[prevK+offset]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			edits = append(edits, edit{opEqual, a[x]})
+		}
+		if d > 0 {
+			if x == prevX {
+				y--
+				edits = append(edits, edit{opInsert, b[y]})
+			} else {
+				x--
+				edits = append(edits, edit{opDelete, a[x]})
+			}
+		}
+	}
+
+	// Edits were collected back to front
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
+
+// hunks groups edits into @@ blocks with the given amount of context around each change.
+func hunks(edits []edit, context int) []string {
+	var out []string
+
+	i := 0
+	for i < len(edits) {
+		// Skip to the next change
+		for i < len(edits) && edits[i].kind == opEqual {
+			i++
+		}
+		if i == len(edits) {
+			break
+		}
+
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+
+		// Extend the hunk while changes are close enough to share context
+		end := i
+		equalRun := 0
+		for end < len(edits) {
+			if edits[end].kind == opEqual {
+				equalRun++
+				if equalRun > 2*context {
+					break
+				}
+			} else {
+				equalRun = 0
+			}
+			end++
+		}
+		// Trim trailing context down to the requested size. When the loop broke on an equal line,
+		// that line was counted in equalRun but is not part of edits[start:end].
+		included := equalRun
+		if end < len(edits) {
+			included--
+		}
+		if included > context {
+			end -= included - context
+		}
+
+		out = append(out, renderHunk(edits, start, end))
+		i = end
+	}
+	return out
+}
+
+// renderHunk renders edits[start:end] with its @@ -a,b +c,d @@ header.
+func renderHunk(edits []edit, start, end int) string {
+	// Line numbers where the hunk starts in each file (1-based)
+	oldLine, newLine := 1, 1
+	for _, e := range edits[:start] {
+		if e.kind != opInsert {
+			oldLine++
+		}
+		if e.kind != opDelete {
+			newLine++
+		}
+	}
+
+	var body strings.Builder
+	oldCount, newCount := 0, 0
+	for _, e := range edits[start:end] {
+		switch e.kind {
+		case opEqual:
+			body.WriteString(" " + e.line + "\n")
+			oldCount++
+			newCount++
+		case opDelete:
+			body.WriteString("-" + e.line + "\n")
+			oldCount++
+		case opInsert:
+			body.WriteString("+" + e.line + "\n")
+			newCount++
+		}
+	}
+
+	// An empty range starts one line before, same as GNU diff
+	if oldCount == 0 {
+		oldLine--
+	}
+	if newCount == 0 {
+		newLine--
+	}
+
+	return fmt.Sprintf("@@ -%d,%d +%d,%d @@\n", oldLine, oldCount, newLine, newCount) + body.String()
+}
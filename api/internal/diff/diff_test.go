@@ -0,0 +1,144 @@
+package diff
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// numbered returns the lines 1 to n, with the lines in changed replaced by "changed <n>"
+func numbered(n int, changed ...int) string {
+	var sb strings.Builder
+	for i := 1; i <= n; i++ {
+		line := strconv.Itoa(i)
+		for _, c := range changed {
+			if c == i {
+				line = "changed " + line
+			}
+		}
+		sb.WriteString(line + "\n")
+	}
+	return sb.String()
+}
+
+func TestUnified(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    string
+		context int
+		want    string
+	}{
+		{
+			name:    "equal texts",
+			a:       numbered(5),
+			b:       numbered(5),
+			context: 3,
+			want:    "",
+		},
+		{
+			name:    "context is trimmed around a change",
+			a:       numbered(10),
+			b:       numbered(10, 5),
+			context: 3,
+			want: "@@ -2,7 +2,7 @@\n" +
+				" 2\n 3\n 4\n-5\n+changed 5\n 6\n 7\n 8\n",
+		},
+		{
+			name:    "context is cut at the start and end of the text",
+			a:       numbered(3),
+			b:       numbered(3, 2),
+			context: 3,
+			want: "@@ -1,3 +1,3 @@\n" +
+				" 1\n-2\n+changed 2\n 3\n",
+		},
+		{
+			name:    "changes sharing their context are merged",
+			a:       numbered(10),
+			b:       numbered(10, 2, 7),
+			context: 2,
+			want: "@@ -1,9 +1,9 @@\n" +
+				" 1\n-2\n+changed 2\n 3\n 4\n 5\n 6\n-7\n+changed 7\n 8\n 9\n",
+		},
+		{
+			name:    "changes further apart than twice the context are split",
+			a:       numbered(12),
+			b:       numbered(12, 2, 8),
+			context: 2,
+			want: "@@ -1,4 +1,4 @@\n" +
+				" 1\n-2\n+changed 2\n 3\n 4\n" +
+				"@@ -6,5 +6,5 @@\n" +
+				" 6\n 7\n-8\n+changed 8\n 9\n 10\n",
+		},
+		{
+			name:    "far apart changes keep their full context",
+			a:       numbered(20),
+			b:       numbered(20, 2, 18),
+			context: 3,
+			want: "@@ -1,5 +1,5 @@\n" +
+				" 1\n-2\n+changed 2\n 3\n 4\n 5\n" +
+				"@@ -15,6 +15,6 @@\n" +
+				" 15\n 16\n 17\n-18\n+changed 18\n 19\n 20\n",
+		},
+		{
+			name:    "no context",
+			a:       numbered(5),
+			b:       numbered(5, 3),
+			context: 0,
+			want: "@@ -3,1 +3,1 @@\n" +
+				"-3\n+changed 3\n",
+		},
+		{
+			name:    "lines added to an empty text",
+			a:       "",
+			b:       "x\ny\n",
+			context: 3,
+			want: "@@ -0,0 +1,2 @@\n" +
+				"+x\n+y\n",
+		},
+		{
+			name:    "line removed at the end",
+			a:       numbered(3),
+			b:       numbered(2),
+			context: 3,
+			want: "@@ -1,3 +1,2 @@\n" +
+				" 1\n 2\n-3\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := tt.want
+			if want != "" {
+				want = "--- a\n+++ b\n" + want
+			}
+			got := Unified(tt.a, tt.b, "a", "b", tt.context)
+			if got != want {
+				t.Errorf("Unified() =\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestUnifiedReplacesAllAboveTheLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+	}{
+		{"too many lines", numbered(maxLines + 1), numbered(maxLines+1, 1)},
+		{"too many edits", numbered(maxEdits), strings.ReplaceAll(numbered(maxEdits), "\n", "x\n")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Unified(tt.a, tt.b, "a", "b", 3)
+			lines := strings.Count(tt.a, "\n")
+			header := "@@ -1," + strconv.Itoa(lines) + " +1," + strconv.Itoa(strings.Count(tt.b, "\n")) + " @@\n"
+			if !strings.Contains(got, header) || strings.Count(got, "@@ -") != 1 {
+				t.Fatalf("expected a single hunk replacing everything, got %.200q", got)
+			}
+			if deleted := strings.Count(got, "\n-"); deleted != lines {
+				t.Errorf("expected %d deleted lines, got %d", lines, deleted)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package events
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Event types published by the handlers
+const (
+	NoteCreated   = "note.created"
+	NoteUpdated   = "note.updated"
+	NoteDeleted   = "note.deleted"
+	FolderCreated = "folder.created"
+	FolderUpdated = "folder.updated"
+	FolderDeleted = "folder.deleted"
+	UserCreated   = "user.created"
+	UserUpdated   = "user.updated"
+
+	// Sent by the stream handlers, never published
+	Ready  = "ready"  // first event of every stream, carries the id to resume from
+	Resync = "resync" // the requested Last-Event-ID can no longer be replayed, clients should re-fetch everything
+)
+
+// Event is a change to one of a user's resources. Data is kept small (ids, titles) so clients know what to re-fetch.
+type Event struct {
+	ID        int64     `json:"id"`
+	UserID    int       `json:"-"` // Who the event is delivered to
+	Type      string    `json:"type"`
+	Data      any       `json:"data,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Publisher is the side of the bus the handlers see.
+type Publisher interface {
+	// Publish delivers the event to all of event.UserID's subscriptions. ID and CreatedAt are set by the bus.
+	Publish(ctx context.Context, event Event) error
+}
+
+// Interface for the event bus to allow an in-process or a cross-instance implementation:
+type Bus interface {
+	Publisher
+	// Subscribe starts a subscription for the user. A lastEventID >= 0 asks for every event after it to be replayed first;
+	// -1 means the client is not resuming.
+	Subscribe(userID int, lastEventID int64) *Subscription
+}
+
+// How many events a subscriber may fall behind before it is dropped
+const subscriberBuffer = 64
+
+// Subscription is one connected client.
+type Subscription struct {
+	// Events missed since the requested Last-Event-ID. Send them before reading Events.
+	Replay []Event
+	// The requested Last-Event-ID is too old (or from before a restart) to replay, clients should re-fetch everything
+	Resync bool
+	// Where the stream starts: the id to resume from if the client receives nothing newer
+	LastID int64
+	// Live events. Closed when the subscriber falls too far behind or the bus resets; clients should reconnect.
+	Events <-chan Event
+
+	ch     chan Event
+	userID int
+	bus    *MemoryBus
+	once   sync.Once
+}
+
+// Close unsubscribes. Safe to call more than once.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.bus.unsubscribe(s)
+	})
+}
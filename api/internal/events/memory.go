@@ -0,0 +1,134 @@
+package events
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Number of recent events (across all users) kept for Last-Event-ID replays
+const historySize = 1024
+
+// MemoryBus fans events out to subscribers in this process only.
+type MemoryBus struct {
+	mu          sync.Mutex
+	lastID      int64
+	floor       int64   // history is complete for every id after floor
+	history     []Event // oldest first, at most historySize
+	subscribers map[int]map[*Subscription]struct{}
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{
+		subscribers: make(map[int]map[*Subscription]struct{}),
+	}
+}
+
+func (b *MemoryBus) Publish(ctx context.Context, event Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	event.ID = b.lastID + 1
+	event.CreatedAt = time.Now()
+	b.deliverLocked(event)
+	return nil
+}
+
+// deliver adds an event whose ID was already assigned elsewhere (see PostgresBus). Ids must arrive in increasing
+// order, which PostgresBus guarantees by assigning them under a lock held until the notification is committed.
+func (b *MemoryBus) deliver(event Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if event.ID <= b.lastID {
+		return // already seen
+	}
+	b.deliverLocked(event)
+}
+
+func (b *MemoryBus) deliverLocked(event Event) {
+	b.lastID = event.ID
+
+	if len(b.history) == historySize {
+		b.floor = b.history[0].ID
+		b.history = append(b.history[:0], b.history[1:]...)
+	}
+	b.history = append(b.history, event)
+
+	for sub := range b.subscribers[event.UserID] {
+		select {
+		case sub.ch <- event:
+		default:
+			// Too slow, drop it. The client reconnects with Last-Event-ID and catches up from history.
+			b.removeLocked(sub)
+		}
+	}
+}
+
+func (b *MemoryBus) Subscribe(userID int, lastEventID int64) *Subscription {
+	ch := make(chan Event, subscriberBuffer)
+	sub := &Subscription{
+		Events: ch,
+		ch:     ch,
+		userID: userID,
+		bus:    b,
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub.LastID = b.lastID
+	if lastEventID >= 0 {
+		if lastEventID < b.floor || lastEventID > b.lastID {
+			sub.Resync = true
+		} else {
+			// Replayed events come after the ready event, so the stream starts where the client left off
+			sub.LastID = lastEventID
+			for _, event := range b.history {
+				if event.ID > lastEventID && event.UserID == userID {
+					sub.Replay = append(sub.Replay, event)
+				}
+			}
+		}
+	}
+
+	if b.subscribers[userID] == nil {
+		b.subscribers[userID] = make(map[*Subscription]struct{})
+	}
+	b.subscribers[userID][sub] = struct{}{}
+	return sub
+}
+
+func (b *MemoryBus) unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.removeLocked(sub)
+}
+
+func (b *MemoryBus) removeLocked(sub *Subscription) {
+	subs := b.subscribers[sub.userID]
+	if _, ok := subs[sub]; !ok {
+		return
+	}
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(b.subscribers, sub.userID)
+	}
+	close(sub.ch)
+}
+
+// reset forgets the history and disconnects everyone, so that resuming clients are told to resync.
+// Used when events may have been missed. Ids continue from lastID.
+func (b *MemoryBus) reset(lastID int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.history = nil
+	b.lastID = lastID
+	b.floor = lastID
+	for _, subs := range b.subscribers {
+		for sub := range subs {
+			b.removeLocked(sub)
+		}
+	}
+}
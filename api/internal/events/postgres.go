@@ -0,0 +1,175 @@
+package events
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// Postgres channel the events are sent on
+const notifyChannel = "note_app_events"
+
+// How long to wait before listening again after the connection drops
+const listenRetryDelay = 5 * time.Second
+
+// PostgresBus sends events through Postgres LISTEN/NOTIFY so that every API instance sees every event.
+// Each instance keeps its own MemoryBus for its local subscribers and replays.
+type PostgresBus struct {
+	db     *sql.DB
+	local  *MemoryBus
+	logger *slog.Logger
+}
+
+// What goes over the wire. NOTIFY payloads are limited to 8000 bytes, so keep Data small.
+type notification struct {
+	ID        int64           `json:"id"`
+	UserID    int             `json:"user_id"`
+	Type      string          `json:"type"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+func NewPostgresBus(db *sql.DB, logger *slog.Logger) *PostgresBus {
+	return &PostgresBus{
+		db:     db,
+		local:  NewMemoryBus(),
+		logger: logger,
+	}
+}
+
+func (b *PostgresBus) Publish(ctx context.Context, event Event) error {
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return fmt.Errorf("failed to encode event data: %w", err)
+	}
+
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to publish event: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The id comes from a sequence so it is the same on every instance. It is taken under a lock held until commit,
+	// so ids are in the order the notifications are delivered in (commit order), never a smaller one after a bigger one.
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, notifyChannel)
+	if err != nil {
+		return fmt.Errorf("failed to publish event: %w", err)
+	}
+
+	query := `
+	SELECT pg_notify($1, json_build_object(
+		'id', nextval('event_ids'),
+		'user_id', $2::int,
+		'type', $3::text,
+		'data', $4::json,
+		'created_at', now()
+	)::text)
+	`
+	_, err = tx.ExecContext(ctx, query, notifyChannel, event.UserID, event.Type, string(data))
+	if err != nil {
+		return fmt.Errorf("failed to publish event: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to publish event: %w", err)
+	}
+	return nil
+}
+
+func (b *PostgresBus) Subscribe(userID int, lastEventID int64) *Subscription {
+	return b.local.Subscribe(userID, lastEventID)
+}
+
+// Run listens for events from every instance (including this one) until ctx is cancelled, reconnecting when needed.
+func (b *PostgresBus) Run(ctx context.Context) {
+	for {
+		err := b.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		b.logger.Warn("Event listener disconnected", "error", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(listenRetryDelay):
+		}
+	}
+}
+
+func (b *PostgresBus) listen(ctx context.Context) error {
+	conn, err := b.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn any) error {
+		pgxConn := driverConn.(*stdlib.Conn).Conn()
+
+		_, err := pgxConn.Exec(ctx, "LISTEN "+notifyChannel)
+		if err != nil {
+			return err
+		}
+		// Anything published while we were not listening is lost, so start over from the current id.
+		// It is read under the publishing lock so that every id up to it has been committed: the clients told
+		// to resync then see those changes, and the notifications skipped as already seen are really stale.
+		lastID, err := currentEventID(ctx, pgxConn)
+		if err != nil {
+			return err
+		}
+		b.local.reset(lastID)
+
+		for {
+			n, err := pgxConn.WaitForNotification(ctx)
+			if err != nil {
+				return err
+			}
+
+			var msg notification
+			err = json.Unmarshal([]byte(n.Payload), &msg)
+			if err != nil {
+				b.logger.Error("Invalid event notification", "error", err)
+				continue
+			}
+			var data any
+			if len(msg.Data) > 0 {
+				_ = json.Unmarshal(msg.Data, &data)
+			}
+			b.local.deliver(Event{
+				ID:        msg.ID,
+				UserID:    msg.UserID,
+				Type:      msg.Type,
+				Data:      data,
+				CreatedAt: msg.CreatedAt,
+			})
+		}
+	})
+}
+
+// currentEventID is the last id published, waiting for any publishing in progress to commit
+func currentEventID(ctx context.Context, conn *pgx.Conn) (int64, error) {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, notifyChannel)
+	if err != nil {
+		return 0, err
+	}
+	var lastID int64
+	err = tx.QueryRow(ctx, "SELECT CASE WHEN is_called THEN last_value ELSE 0 END FROM event_ids").Scan(&lastID)
+	if err != nil {
+		return 0, err
+	}
+	return lastID, tx.Commit(ctx)
+}
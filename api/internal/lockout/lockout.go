@@ -0,0 +1,185 @@
+// Package lockout slows down password guessing: failed logins are counted per username and per IP address,
+// each failure past a few free ones doubles the wait before the next attempt, and too many lock the key out for a while.
+package lockout
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// Policy decides how long to wait after a run of failures
+type Policy struct {
+	FreeAttempts    int           // failures allowed before any waiting starts
+	BaseDelay       time.Duration // wait after the first failure past FreeAttempts, doubled for every one after
+	MaxDelay        time.Duration // the backoff never grows past this
+	LockoutAfter    int           // failures after which the key is locked out, 0 to never lock out
+	LockoutDuration time.Duration
+	ResetAfter      time.Duration // failures are forgotten after this long without a new one
+}
+
+// Defaults for the two kinds of keys. Many users can share an IP address, so IPs get more room.
+var (
+	DefaultUserPolicy = Policy{
+		FreeAttempts:    3,
+		BaseDelay:       2 * time.Second,
+		MaxDelay:        time.Minute,
+		LockoutAfter:    10,
+		LockoutDuration: 15 * time.Minute,
+		ResetAfter:      time.Hour,
+	}
+	DefaultIPPolicy = Policy{
+		FreeAttempts:    10,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Minute,
+		LockoutAfter:    50,
+		LockoutDuration: 15 * time.Minute,
+		ResetAfter:      time.Hour,
+	}
+)
+
+// State is what a Store keeps per key
+type State struct {
+	Failures    int
+	LastFailure time.Time
+}
+
+// Wait returns how long after now the next attempt has to wait, 0 if it may go ahead.
+func (p Policy) Wait(s State, now time.Time) time.Duration {
+	if s.Failures == 0 || now.Sub(s.LastFailure) >= p.ResetAfter {
+		return 0
+	}
+
+	var delay time.Duration
+	switch {
+	case p.LockoutAfter > 0 && s.Failures >= p.LockoutAfter:
+		delay = p.LockoutDuration
+	case s.Failures > p.FreeAttempts:
+		delay = p.BaseDelay
+		for i := p.FreeAttempts + 1; i < s.Failures && delay < p.MaxDelay; i++ {
+			delay *= 2
+		}
+		delay = min(delay, p.MaxDelay)
+	}
+
+	return max(s.LastFailure.Add(delay).Sub(now), 0)
+}
+
+// Store keeps the failure count of each key. Implementations must make RecordFailure atomic,
+// since several instances or goroutines may record failures for the same key at once.
+type Store interface {
+	Get(ctx context.Context, key string) (State, error)
+	// RecordFailure adds a failure at now, starting the count over if the last one is older than resetAfter.
+	RecordFailure(ctx context.Context, key string, now time.Time, resetAfter time.Duration) (State, error)
+	// Reserve checks an attempt against the policy of each key and, unless one of them makes it wait, counts it as
+	// a failure on every key, as RecordFailure would. Both happen at once, so concurrent attempts each see the ones
+	// reserved before them. Returns the wait, 0 if the attempt was counted and may go ahead.
+	Reserve(ctx context.Context, now time.Time, policies map[string]Policy) (time.Duration, error)
+	// Release takes back one failure, counted by Reserve for an attempt that turned out to succeed.
+	Release(ctx context.Context, key string) error
+	Reset(ctx context.Context, keys ...string) error
+	// Prune forgets keys whose last failure is before the given time.
+	Prune(ctx context.Context, before time.Time) (int64, error)
+}
+
+// Tracker applies a Policy per username and per IP address on top of a Store.
+// Anything else guarded by a password, like a public link, can stand in for the username.
+type Tracker struct {
+	Store      Store
+	UserPolicy Policy
+	IPPolicy   Policy
+	Prefix     string           // put in front of every key, so trackers for different things can share a Store
+	Now        func() time.Time // replaceable for tests
+}
+
+// NewTracker returns a Tracker using the default policies and the real clock.
+func NewTracker(store Store) *Tracker {
+	return &Tracker{
+		Store:      store,
+		UserPolicy: DefaultUserPolicy,
+		IPPolicy:   DefaultIPPolicy,
+		Now:        time.Now,
+	}
+}
+
+// Usernames are hashed so the store never holds what people typed into the username field, which is
+// sometimes a password
+func userKey(username string) string {
+	sum := sha256.Sum256([]byte(username))
+	return "user:" + hex.EncodeToString(sum[:16])
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+func (t *Tracker) userKey(username string) string {
+	return t.Prefix + userKey(username)
+}
+
+func (t *Tracker) ipKey(ip string) string {
+	return t.Prefix + ipKey(ip)
+}
+
+// Check returns how long the caller has to wait before trying this username from this IP, 0 if it may try now.
+func (t *Tracker) Check(ctx context.Context, username, ip string) (time.Duration, error) {
+	now := t.Now()
+
+	userState, err := t.Store.Get(ctx, t.userKey(username))
+	if err != nil {
+		return 0, err
+	}
+	ipState, err := t.Store.Get(ctx, t.ipKey(ip))
+	if err != nil {
+		return 0, err
+	}
+
+	return max(t.UserPolicy.Wait(userState, now), t.IPPolicy.Wait(ipState, now)), nil
+}
+
+// Fail records a failed attempt and returns the wait it imposes on the next one.
+func (t *Tracker) Fail(ctx context.Context, username, ip string) (time.Duration, error) {
+	now := t.Now()
+
+	userState, err := t.Store.RecordFailure(ctx, t.userKey(username), now, t.UserPolicy.ResetAfter)
+	if err != nil {
+		return 0, err
+	}
+	ipState, err := t.Store.RecordFailure(ctx, t.ipKey(ip), now, t.IPPolicy.ResetAfter)
+	if err != nil {
+		return 0, err
+	}
+
+	return max(t.UserPolicy.Wait(userState, now), t.IPPolicy.Wait(ipState, now)), nil
+}
+
+// Attempt reserves an attempt at this username from this IP. It returns how long the caller has to wait if it may
+// not try now. Otherwise the attempt is counted as a failure up front, so that concurrent guesses cannot all get past
+// the check before any of them is counted, and the caller must call Succeed if it succeeds.
+func (t *Tracker) Attempt(ctx context.Context, username, ip string) (time.Duration, error) {
+	return t.Store.Reserve(ctx, t.Now(), map[string]Policy{
+		t.userKey(username): t.UserPolicy,
+		t.ipKey(ip):         t.IPPolicy,
+	})
+}
+
+// Succeed clears the username's failures after a successful login, and takes back the failure Attempt counted for the IP.
+// The IP's other failures are left to expire, or an attacker could log into their own account now and then to keep guessing others.
+func (t *Tracker) Succeed(ctx context.Context, username, ip string) error {
+	err := t.Store.Reset(ctx, t.userKey(username))
+	if err != nil {
+		return err
+	}
+	return t.Store.Release(ctx, t.ipKey(ip))
+}
+
+// ResetUser clears a username's failures, for when the password has been reset.
+func (t *Tracker) ResetUser(ctx context.Context, username string) error {
+	return t.Store.Reset(ctx, t.userKey(username))
+}
+
+// Prune forgets every key that has gone longer than its policy's ResetAfter without a failure.
+func (t *Tracker) Prune(ctx context.Context) (int64, error) {
+	return t.Store.Prune(ctx, t.Now().Add(-max(t.UserPolicy.ResetAfter, t.IPPolicy.ResetAfter)))
+}
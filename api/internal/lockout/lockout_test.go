@@ -0,0 +1,245 @@
+package lockout
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testPolicy = Policy{
+	FreeAttempts:    2,
+	BaseDelay:       time.Second,
+	MaxDelay:        5 * time.Second,
+	LockoutAfter:    8,
+	LockoutDuration: time.Hour,
+	ResetAfter:      2 * time.Hour,
+}
+
+// clock is a fake Tracker.Now that only moves when told to
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// newTestTracker returns a Tracker on a MemoryStore applying testPolicy to usernames, with an IP policy loose
+// enough to stay out of the way
+func newTestTracker() (*Tracker, *clock) {
+	c := &clock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	return &Tracker{
+		Store:      NewMemoryStore(),
+		UserPolicy: testPolicy,
+		IPPolicy:   Policy{FreeAttempts: 1000, ResetAfter: time.Hour},
+		Now:        c.Now,
+	}, c
+}
+
+func TestFailBacksOff(t *testing.T) {
+	tracker, _ := newTestTracker()
+	ctx := context.Background()
+
+	// Wait imposed by the nth failure
+	want := []time.Duration{
+		0, 0, // free attempts
+		time.Second, 2 * time.Second, 4 * time.Second, // doubling
+		5 * time.Second, 5 * time.Second, // capped at MaxDelay
+		time.Hour, time.Hour, // locked out from LockoutAfter on
+	}
+	for i, w := range want {
+		got, err := tracker.Fail(ctx, "alice", "10.0.0.1")
+		if err != nil {
+			t.Fatalf("Fail: %v", err)
+		}
+		if got != w {
+			t.Errorf("failure %d: expected a wait of %v, got %v", i+1, w, got)
+		}
+	}
+}
+
+func TestCheckCountsDown(t *testing.T) {
+	tracker, c := newTestTracker()
+	ctx := context.Background()
+
+	for range 4 {
+		tracker.Fail(ctx, "alice", "10.0.0.1")
+	}
+
+	tests := []struct {
+		advance time.Duration
+		want    time.Duration
+	}{
+		{0, 2 * time.Second},
+		{500 * time.Millisecond, 1500 * time.Millisecond},
+		{1500 * time.Millisecond, 0},
+		{time.Minute, 0},
+	}
+	for _, tt := range tests {
+		c.advance(tt.advance)
+		got, err := tracker.Check(ctx, "alice", "10.0.0.1")
+		if err != nil {
+			t.Fatalf("Check: %v", err)
+		}
+		if got != tt.want {
+			t.Errorf("at %v: expected a wait of %v, got %v", c.now, tt.want, got)
+		}
+	}
+}
+
+func TestLockoutExpires(t *testing.T) {
+	tracker, c := newTestTracker()
+	ctx := context.Background()
+
+	for range testPolicy.LockoutAfter {
+		tracker.Fail(ctx, "alice", "10.0.0.1")
+	}
+
+	c.advance(59 * time.Minute)
+	got, _ := tracker.Check(ctx, "alice", "10.0.0.1")
+	if got != time.Minute {
+		t.Errorf("expected to still be locked out for a minute, got %v", got)
+	}
+
+	c.advance(time.Minute)
+	got, _ = tracker.Check(ctx, "alice", "10.0.0.1")
+	if got != 0 {
+		t.Errorf("expected the lockout to be over, got %v", got)
+	}
+
+	// The failures are still counted until ResetAfter, so the next one locks out again
+	got, _ = tracker.Fail(ctx, "alice", "10.0.0.1")
+	if got != time.Hour {
+		t.Errorf("expected the next failure to lock out again, got %v", got)
+	}
+}
+
+func TestFailuresAreForgottenAfterResetAfter(t *testing.T) {
+	tracker, c := newTestTracker()
+	ctx := context.Background()
+
+	for range 5 {
+		tracker.Fail(ctx, "alice", "10.0.0.1")
+	}
+
+	c.advance(testPolicy.ResetAfter)
+	got, _ := tracker.Check(ctx, "alice", "10.0.0.1")
+	if got != 0 {
+		t.Errorf("expected no wait after ResetAfter, got %v", got)
+	}
+
+	// The count starts over, so the next failures are free again
+	for i := range testPolicy.FreeAttempts {
+		got, _ = tracker.Fail(ctx, "alice", "10.0.0.1")
+		if got != 0 {
+			t.Errorf("failure %d after the reset: expected no wait, got %v", i+1, got)
+		}
+	}
+}
+
+func TestAttemptCountsUpFront(t *testing.T) {
+	tracker, c := newTestTracker()
+	ctx := context.Background()
+
+	// The free attempts and the one after them go ahead, each counted as a failure
+	for i := range testPolicy.FreeAttempts + 1 {
+		wait, err := tracker.Attempt(ctx, "alice", "10.0.0.1")
+		if err != nil {
+			t.Fatalf("Attempt: %v", err)
+		}
+		if wait != 0 {
+			t.Fatalf("attempt %d: expected no wait, got %v", i+1, wait)
+		}
+	}
+
+	wait, _ := tracker.Attempt(ctx, "alice", "10.0.0.1")
+	if wait != time.Second {
+		t.Errorf("expected a wait of a second, got %v", wait)
+	}
+	// A refused attempt is not counted
+	state, _ := tracker.Store.Get(ctx, userKey("alice"))
+	if state.Failures != testPolicy.FreeAttempts+1 {
+		t.Errorf("expected %d failures, got %d", testPolicy.FreeAttempts+1, state.Failures)
+	}
+
+	c.advance(time.Second)
+	wait, _ = tracker.Attempt(ctx, "alice", "10.0.0.1")
+	if wait != 0 {
+		t.Errorf("expected the attempt to go ahead once the wait is over, got %v", wait)
+	}
+}
+
+func TestConcurrentAttemptsAreCountedOneByOne(t *testing.T) {
+	tracker, _ := newTestTracker()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	var allowed atomic.Int32
+	for range 20 {
+		wg.Go(func() {
+			wait, _ := tracker.Attempt(ctx, "alice", "10.0.0.1")
+			if wait == 0 {
+				allowed.Add(1)
+			}
+		})
+	}
+	wg.Wait()
+
+	if got := int(allowed.Load()); got != testPolicy.FreeAttempts+1 {
+		t.Errorf("expected %d attempts to go ahead, got %d", testPolicy.FreeAttempts+1, got)
+	}
+}
+
+func TestSucceedClearsTheUsernameOnly(t *testing.T) {
+	tracker, _ := newTestTracker()
+	ctx := context.Background()
+
+	for range 2 {
+		tracker.Fail(ctx, "alice", "10.0.0.1")
+	}
+	tracker.Attempt(ctx, "alice", "10.0.0.1")
+	err := tracker.Succeed(ctx, "alice", "10.0.0.1")
+	if err != nil {
+		t.Fatalf("Succeed: %v", err)
+	}
+
+	got, _ := tracker.Check(ctx, "alice", "10.0.0.1")
+	if got != 0 {
+		t.Errorf("expected no wait after a success, got %v", got)
+	}
+	userState, _ := tracker.Store.Get(ctx, userKey("alice"))
+	if userState.Failures != 0 {
+		t.Errorf("expected the username's failures to be cleared, got %d", userState.Failures)
+	}
+
+	// The successful attempt is taken back, the failures before it are kept
+	ipState, _ := tracker.Store.Get(ctx, ipKey("10.0.0.1"))
+	if ipState.Failures != 2 {
+		t.Errorf("expected the IP's 2 failures to be kept, got %d", ipState.Failures)
+	}
+}
+
+func TestIPPolicyAppliesAcrossUsernames(t *testing.T) {
+	tracker, _ := newTestTracker()
+	tracker.IPPolicy = testPolicy
+	ctx := context.Background()
+
+	for _, username := range []string{"alice", "bob", "carol"} {
+		tracker.Fail(ctx, username, "10.0.0.1")
+	}
+
+	got, _ := tracker.Check(ctx, "dave", "10.0.0.1")
+	if got != time.Second {
+		t.Errorf("expected the IP to have to wait a second, got %v", got)
+	}
+	got, _ = tracker.Check(ctx, "dave", "10.0.0.2")
+	if got != 0 {
+		t.Errorf("expected no wait from another IP, got %v", got)
+	}
+}
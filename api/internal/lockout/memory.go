@@ -0,0 +1,98 @@
+package lockout
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps failures in memory. Fine for a single API instance; counts are lost on restart.
+type MemoryStore struct {
+	mu     sync.Mutex
+	states map[string]State
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{states: make(map[string]State)}
+}
+
+func (m *MemoryStore) Get(ctx context.Context, key string) (State, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.states[key], nil
+}
+
+func (m *MemoryStore) RecordFailure(ctx context.Context, key string, now time.Time, resetAfter time.Duration) (State, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.recordFailureLocked(key, now, resetAfter), nil
+}
+
+func (m *MemoryStore) recordFailureLocked(key string, now time.Time, resetAfter time.Duration) State {
+	state := m.states[key]
+	if now.Sub(state.LastFailure) >= resetAfter {
+		state.Failures = 0
+	}
+	state.Failures++
+	state.LastFailure = now
+	m.states[key] = state
+	return state
+}
+
+func (m *MemoryStore) Reserve(ctx context.Context, now time.Time, policies map[string]Policy) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var wait time.Duration
+	for key, policy := range policies {
+		wait = max(wait, policy.Wait(m.states[key], now))
+	}
+	if wait > 0 {
+		return wait, nil
+	}
+
+	for key, policy := range policies {
+		m.recordFailureLocked(key, now, policy.ResetAfter)
+	}
+	return 0, nil
+}
+
+func (m *MemoryStore) Release(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state, ok := m.states[key]
+	if !ok {
+		return nil
+	}
+	state.Failures--
+	if state.Failures <= 0 {
+		delete(m.states, key)
+	} else {
+		m.states[key] = state
+	}
+	return nil
+}
+
+func (m *MemoryStore) Reset(ctx context.Context, keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range keys {
+		delete(m.states, key)
+	}
+	return nil
+}
+
+func (m *MemoryStore) Prune(ctx context.Context, before time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var pruned int64
+	for key, state := range m.states {
+		if state.LastFailure.Before(before) {
+			delete(m.states, key)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
@@ -0,0 +1,125 @@
+package lockout
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// PostgresStore keeps failures in the login_failures table, so that every API instance sees the same counts
+// and they survive restarts.
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+// queryer is what *sql.DB and *sql.Tx have in common, so the queries below run in or out of a transaction
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (pg *PostgresStore) Get(ctx context.Context, key string) (State, error) {
+	return getState(ctx, pg.db, key)
+}
+
+func getState(ctx context.Context, q queryer, key string) (State, error) {
+	var state State
+	query := `
+		SELECT failures, last_failure_at
+		FROM login_failures
+		WHERE key = $1
+	`
+	err := q.QueryRowContext(ctx, query, key).Scan(&state.Failures, &state.LastFailure)
+	if err == sql.ErrNoRows {
+		return State{}, nil
+	}
+	return state, err
+}
+
+// RecordFailure counts a failure in a single upsert, so concurrent failures for the same key are all counted.
+func (pg *PostgresStore) RecordFailure(ctx context.Context, key string, now time.Time, resetAfter time.Duration) (State, error) {
+	return recordFailure(ctx, pg.db, key, now, resetAfter)
+}
+
+func recordFailure(ctx context.Context, q queryer, key string, now time.Time, resetAfter time.Duration) (State, error) {
+	var state State
+	query := `
+		INSERT INTO login_failures (key, failures, last_failure_at)
+		VALUES ($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE
+		SET failures = CASE WHEN login_failures.last_failure_at <= $3 THEN 1 ELSE login_failures.failures + 1 END,
+		    last_failure_at = $2
+		RETURNING failures, last_failure_at
+	`
+	err := q.QueryRowContext(ctx, query, key, now, now.Add(-resetAfter)).Scan(&state.Failures, &state.LastFailure)
+	return state, err
+}
+
+// Reserve holds an advisory lock per key until the end of its transaction, so a concurrent Reserve for one of
+// the same keys waits and then sees this attempt. Keys are locked in sorted order, so two never deadlock.
+func (pg *PostgresStore) Reserve(ctx context.Context, now time.Time, policies map[string]Policy) (time.Duration, error) {
+	tx, err := pg.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	keys := slices.Sorted(maps.Keys(policies))
+	var wait time.Duration
+	for _, key := range keys {
+		_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, key)
+		if err != nil {
+			return 0, err
+		}
+		state, err := getState(ctx, tx, key)
+		if err != nil {
+			return 0, err
+		}
+		wait = max(wait, policies[key].Wait(state, now))
+	}
+	if wait > 0 {
+		return wait, nil
+	}
+
+	for _, key := range keys {
+		_, err = recordFailure(ctx, tx, key, now, policies[key].ResetAfter)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return 0, tx.Commit()
+}
+
+func (pg *PostgresStore) Release(ctx context.Context, key string) error {
+	_, err := pg.db.ExecContext(ctx, `UPDATE login_failures SET failures = failures - 1 WHERE key = $1 AND failures > 0`, key)
+	return err
+}
+
+func (pg *PostgresStore) Reset(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	placeholders := make([]string, len(keys))
+	args := make([]any, len(keys))
+	for i, key := range keys {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = key
+	}
+	_, err := pg.db.ExecContext(ctx, `DELETE FROM login_failures WHERE key IN (`+strings.Join(placeholders, ", ")+`)`, args...)
+	return err
+}
+
+func (pg *PostgresStore) Prune(ctx context.Context, before time.Time) (int64, error) {
+	result, err := pg.db.ExecContext(ctx, `DELETE FROM login_failures WHERE last_failure_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,83 @@
+// Package logging sets up the JSON logs of the API. Every request gets its own logger, carried in its context,
+// so all the lines logged while serving it share its request ID and, once authenticated, its user ID.
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// Value logged in place of secrets
+const redacted = "[REDACTED]"
+
+// Attribute keys that are never logged as they are, whatever the level. Keys containing "password" or "secret" are redacted too.
+var sensitiveKeys = map[string]bool{
+	"token":         true,
+	"access_token":  true,
+	"refresh_token": true,
+	"authorization": true,
+	"cookie":        true,
+	"code":          true,
+	"dsn":           true,
+}
+
+// New returns a logger writing one JSON object per line to w, from level up
+func New(w io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redact,
+	}))
+}
+
+// redact replaces the values of sensitive attributes, a safety net for a careless log call
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindGroup {
+		return a
+	}
+	key := strings.ToLower(a.Key)
+	if sensitiveKeys[key] || strings.Contains(key, "password") || strings.Contains(key, "secret") {
+		return slog.String(a.Key, redacted)
+	}
+	return a
+}
+
+type contextKey string
+
+const loggerContextKey = contextKey("logger")
+
+// requestLogger is the logger of one request. Attributes added along the way, like the user ID by the
+// authentication middleware, are seen by the middleware that came before, like the access log.
+type requestLogger struct {
+	mu     sync.Mutex
+	logger *slog.Logger
+}
+
+// WithLogger returns a copy of ctx carrying logger
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey, &requestLogger{logger: logger})
+}
+
+// FromContext returns the logger of the request ctx belongs to, or slog.Default() outside of requests
+func FromContext(ctx context.Context) *slog.Logger {
+	rl, ok := ctx.Value(loggerContextKey).(*requestLogger)
+	if !ok {
+		return slog.Default()
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.logger
+}
+
+// AddAttrs adds attributes (key-value pairs or slog.Attr, as in slog.Logger.With) to the logger of the request ctx belongs to
+func AddAttrs(ctx context.Context, args ...any) {
+	rl, ok := ctx.Value(loggerContextKey).(*requestLogger)
+	if !ok {
+		return
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.logger = rl.logger.With(args...)
+}
@@ -0,0 +1,106 @@
+// Package mailer sends the emails the API needs (password resets and the like).
+package mailer
+
+import (
+	"fmt"
+	"log/slog"
+	"net/smtp"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string // plain text
+}
+
+// Interface for Mailer so the delivery method can be swapped (and faked in tests):
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// FileMailer appends every message to a local file instead of sending it. Meant for development.
+type FileMailer struct {
+	path string
+	from string
+	mu   sync.Mutex
+}
+
+func NewFileMailer(path, from string) *FileMailer {
+	return &FileMailer{path: path, from: from}
+}
+
+func (m *FileMailer) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, err := os.OpenFile(m.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open mail file: %w", err)
+	}
+	defer file.Close()
+
+	_, err = file.Write(format(m.from, msg))
+	if err == nil {
+		_, err = file.WriteString("\n")
+	}
+	return err
+}
+
+// LogMailer writes messages to the application log. The tokens in links are redacted, since logs are
+// kept and shared far more widely than mailboxes: use a FileMailer or an SMTP stand-in to follow them.
+type LogMailer struct {
+	logger *slog.Logger
+}
+
+func NewLogMailer(logger *slog.Logger) *LogMailer {
+	return &LogMailer{logger: logger}
+}
+
+// The token query parameter of links, as in /reset-password?token=...
+var linkTokenRegex = regexp.MustCompile(`([?&]token=)[^&\s]+`)
+
+func (m *LogMailer) Send(msg Message) error {
+	m.logger.Info("Mail", "to", msg.To, "subject", msg.Subject, "body", linkTokenRegex.ReplaceAllString(msg.Body, "${1}[REDACTED]"))
+	return nil
+}
+
+// SMTPMailer sends through an SMTP server, e.g. a local stand-in like MailHog or Mailpit on localhost:1025.
+type SMTPMailer struct {
+	addr string // host:port
+	from string
+	auth smtp.Auth // nil for servers without authentication
+}
+
+func NewSMTPMailer(addr, from string, auth smtp.Auth) *SMTPMailer {
+	return &SMTPMailer{addr: addr, from: from, auth: auth}
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	err := smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, format(m.from, msg))
+	if err != nil {
+		return fmt.Errorf("failed to send mail: %w", err)
+	}
+	return nil
+}
+
+// format renders a message as RFC 5322 text.
+func format(from string, msg Message) []byte {
+	// Header values must not contain line breaks
+	clean := strings.NewReplacer("\r", "", "\n", "").Replace
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", clean(from))
+	fmt.Fprintf(&b, "To: %s\r\n", clean(msg.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", clean(msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	b.WriteString("\r\n")
+	return []byte(b.String())
+}
@@ -0,0 +1,147 @@
+package metrics
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/store"
+)
+
+// Every metric name starts with this
+const namespace = "notes_"
+
+// Kinds of tokens counted by TokenCreated
+const (
+	TokenAccess         = "access"
+	TokenRefresh        = "refresh"
+	TokenPersonalAccess = "personal_access"
+)
+
+// Metrics are the metrics of the API: HTTP traffic, the database pool, logins, tokens and a few totals
+type Metrics struct {
+	registry *Registry
+
+	httpRequests  *CounterVec
+	httpDurations *HistogramVec
+	logins        *CounterVec
+	loginFailures *CounterVec
+	tokensCreated *CounterVec
+
+	// Refreshed in the background from the database, see SetTotals
+	users        *Gauge
+	notes        *Gauge
+	folders      *Gauge
+	trashedNotes *Gauge
+	sessions     *Gauge
+	apiTokens    *Gauge
+	publicLinks  *Gauge
+	shares       *Gauge
+}
+
+// New registers the metrics of the API, including the connection pool stats of db
+func New(db *sql.DB) *Metrics {
+	r := NewRegistry()
+	m := &Metrics{
+		registry: r,
+
+		httpRequests:  r.NewCounterVec(namespace+"http_requests_total", "HTTP requests served, by method, chi route pattern and status.", "method", "route", "status"),
+		httpDurations: r.NewHistogramVec(namespace+"http_request_duration_seconds", "Time taken to serve HTTP requests, by method, chi route pattern and status.", DefaultBuckets, "method", "route", "status"),
+		logins:        r.NewCounterVec(namespace+"logins_total", "Successful logins, 2FA logins counting once the code is accepted."),
+		loginFailures: r.NewCounterVec(namespace+"login_failures_total", "Failed logins by reason, throttled ones included.", "reason"),
+		tokensCreated: r.NewCounterVec(namespace+"tokens_created_total", "Tokens issued by logins, refreshes and personal access token creation, by kind.", "kind"),
+
+		users:        r.NewGauge(namespace+"users", "Registered users."),
+		notes:        r.NewGauge(namespace+"notes", "Notes, not counting the ones in the trash."),
+		folders:      r.NewGauge(namespace+"folders", "Folders, not counting the ones in the trash."),
+		trashedNotes: r.NewGauge(namespace+"trashed_notes", "Notes in the trash."),
+		sessions:     r.NewGauge(namespace+"active_sessions", "Login sessions that have not expired or been revoked."),
+		apiTokens:    r.NewGauge(namespace+"api_tokens", "Personal access tokens that have not expired."),
+		publicLinks:  r.NewGauge(namespace+"public_links", "Public links to notes that have not expired or been revoked."),
+		shares:       r.NewGauge(namespace+"shares", "Notes and folders shared with other users."),
+	}
+
+	// Read from the pool on every scrape
+	stats := func(value func(sql.DBStats) float64) func() float64 {
+		return func() float64 { return value(db.Stats()) }
+	}
+	r.NewGaugeFunc(namespace+"db_max_open_connections", "Maximum number of open connections to the database, 0 for no limit.",
+		stats(func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }))
+	r.NewGaugeFunc(namespace+"db_open_connections", "Open connections to the database, in use or idle.",
+		stats(func(s sql.DBStats) float64 { return float64(s.OpenConnections) }))
+	r.NewGaugeFunc(namespace+"db_in_use_connections", "Connections to the database currently in use.",
+		stats(func(s sql.DBStats) float64 { return float64(s.InUse) }))
+	r.NewGaugeFunc(namespace+"db_idle_connections", "Idle connections to the database.",
+		stats(func(s sql.DBStats) float64 { return float64(s.Idle) }))
+	r.NewCounterFunc(namespace+"db_wait_count_total", "Times a query had to wait for a free connection.",
+		stats(func(s sql.DBStats) float64 { return float64(s.WaitCount) }))
+	r.NewCounterFunc(namespace+"db_wait_duration_seconds_total", "Total time spent waiting for a free connection.",
+		stats(func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }))
+	r.NewCounterFunc(namespace+"db_max_idle_closed_total", "Connections closed because of the idle connection limit.",
+		stats(func(s sql.DBStats) float64 { return float64(s.MaxIdleClosed) }))
+	r.NewCounterFunc(namespace+"db_max_idle_time_closed_total", "Connections closed because they were idle for too long.",
+		stats(func(s sql.DBStats) float64 { return float64(s.MaxIdleTimeClosed) }))
+	r.NewCounterFunc(namespace+"db_max_lifetime_closed_total", "Connections closed because they reached their maximum lifetime.",
+		stats(func(s sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) }))
+
+	return m
+}
+
+// Handler serves the metrics to Prometheus. With a token, only to requests with an "Authorization: Bearer <token>" header.
+func (m *Metrics) Handler(token string) http.Handler {
+	next := m.registry.Handler()
+	if token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ObserveRequest records a served request. route is the chi route pattern, never the path, to keep the number of series bounded.
+// Methods other than the standard ones are all counted as OTHER, for the same reason.
+func (m *Metrics) ObserveRequest(method, route string, status int, duration time.Duration) {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
+	default:
+		method = "OTHER"
+	}
+	code := strconv.Itoa(status)
+	m.httpRequests.Inc(method, route, code)
+	m.httpDurations.Observe(duration.Seconds(), method, route, code)
+}
+
+func (m *Metrics) LoginSucceeded() {
+	m.logins.Inc()
+}
+
+// LoginFailed counts a failed login. reason is one of a few fixed values, like the ones of the login.failed audit events.
+func (m *Metrics) LoginFailed(reason string) {
+	m.loginFailures.Inc(reason)
+}
+
+// TokenCreated counts an issued token of the given kind (TokenAccess, TokenRefresh or TokenPersonalAccess)
+func (m *Metrics) TokenCreated(kind string) {
+	m.tokensCreated.Inc(kind)
+}
+
+// SetTotals updates the business gauges
+func (m *Metrics) SetTotals(t *store.SiteTotals) {
+	m.users.Set(float64(t.Users))
+	m.notes.Set(float64(t.Notes))
+	m.folders.Set(float64(t.Folders))
+	m.trashedNotes.Set(float64(t.TrashedNotes))
+	m.sessions.Set(float64(t.Sessions))
+	m.apiTokens.Set(float64(t.APITokens))
+	m.publicLinks.Set(float64(t.PublicLinks))
+	m.shares.Set(float64(t.Shares))
+}
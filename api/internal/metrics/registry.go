@@ -0,0 +1,290 @@
+// Package metrics exposes what the API is doing in the Prometheus text format, for /metrics.
+// Only what the API needs is implemented: counters, gauges and histograms, with or without labels.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry holds metrics and writes them all out, in the order they were registered
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// metric is one metric family: its # HELP and # TYPE lines, then its samples
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// Write writes every metric in the Prometheus text format
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler serves the metrics to Prometheus
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+// desc is what every metric family has
+type desc struct {
+	name       string
+	help       string
+	kind       string // counter, gauge or histogram
+	labelNames []string
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.kind)
+}
+
+// writeSample writes one line. extra is an additional label, like the le of histogram buckets, empty for none.
+func (d *desc) writeSample(w *bufio.Writer, suffix string, labelValues []string, extraName, extraValue string, value float64) {
+	w.WriteString(d.name + suffix)
+	if len(labelValues) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, name := range d.labelNames {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(name + `="` + escapeLabel(labelValues[i]) + `"`)
+		}
+		if extraName != "" {
+			if len(labelValues) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extraName + `="` + extraValue + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteString(" " + formatFloat(value) + "\n")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// series keeps the samples of a labelled metric by their label values
+type series[T any] struct {
+	mu     sync.Mutex
+	values map[string]*T
+	labels map[string][]string
+}
+
+// get returns the value for the label values, created with newValue the first time
+func (s *series[T]) get(labelNames, labelValues []string, newValue func() *T) *T {
+	if len(labelValues) != len(labelNames) {
+		panic(fmt.Sprintf("metrics: got %d label values for the labels %v", len(labelValues), labelNames))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]*T)
+		s.labels = make(map[string][]string)
+	}
+	v, ok := s.values[key]
+	if !ok {
+		v = newValue()
+		s.values[key] = v
+		s.labels[key] = append([]string(nil), labelValues...)
+	}
+	return v
+}
+
+// each calls fn for every value, sorted by label values so the output is stable. fn runs with the lock held.
+func (s *series[T]) each(fn func(labelValues []string, v *T)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.values))
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fn(s.labels[key], s.values[key])
+	}
+}
+
+// CounterVec is a counter per combination of label values. Counters only go up.
+type CounterVec struct {
+	desc
+	series series[float64]
+}
+
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{desc: desc{name: name, help: help, kind: "counter", labelNames: labelNames}}
+	if len(labelNames) == 0 {
+		c.Add(0) // a counter without labels is there from the start, at 0
+	}
+	r.register(c)
+	return c
+}
+
+// Inc adds one to the counter with the given label values, in the order of the label names
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic("metrics: counters cannot go down")
+	}
+	v := c.series.get(c.labelNames, labelValues, func() *float64 { return new(float64) })
+	c.series.mu.Lock()
+	*v += delta
+	c.series.mu.Unlock()
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	c.series.each(func(labelValues []string, v *float64) {
+		c.writeSample(w, "", labelValues, "", "", *v)
+	})
+}
+
+// Gauge is a value that goes up and down, set by whoever knows it
+type Gauge struct {
+	desc
+	mu    sync.Mutex
+	value float64
+}
+
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{desc: desc{name: name, help: help, kind: "gauge"}}
+	r.register(g)
+	return g
+}
+
+func (g *Gauge) Set(value float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.value = value
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.mu.Lock()
+	value := g.value
+	g.mu.Unlock()
+	g.writeHeader(w)
+	g.writeSample(w, "", nil, "", "", value)
+}
+
+// funcMetric is a gauge or counter read from fn on every scrape, for values kept elsewhere like sql.DB.Stats()
+type funcMetric struct {
+	desc
+	fn func() float64
+}
+
+// NewGaugeFunc registers a gauge whose value is fn()
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&funcMetric{desc: desc{name: name, help: help, kind: "gauge"}, fn: fn})
+}
+
+// NewCounterFunc registers a counter whose value is fn(), which must never go down
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	r.register(&funcMetric{desc: desc{name: name, help: help, kind: "counter"}, fn: fn})
+}
+
+func (f *funcMetric) write(w *bufio.Writer) {
+	f.writeHeader(w)
+	f.writeSample(w, "", nil, "", "", f.fn())
+}
+
+// HistogramVec counts observations, like request durations, into buckets, per combination of label values
+type HistogramVec struct {
+	desc
+	buckets []float64 // upper bounds, sorted. The +Inf bucket is implicit.
+	series  series[histogram]
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative, the last one being +Inf
+	sum    float64
+	count  uint64
+}
+
+// DefaultBuckets suit request durations in seconds
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &HistogramVec{desc: desc{name: name, help: help, kind: "histogram", labelNames: labelNames}, buckets: buckets}
+	r.register(h)
+	return h
+}
+
+// Observe records value in the histogram with the given label values
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	v := h.series.get(h.labelNames, labelValues, func() *histogram {
+		return &histogram{counts: make([]uint64, len(h.buckets)+1)}
+	})
+	i := sort.SearchFloat64s(h.buckets, value) // first bucket with an upper bound >= value
+
+	h.series.mu.Lock()
+	defer h.series.mu.Unlock()
+	v.counts[i]++
+	v.sum += value
+	v.count++
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.writeHeader(w)
+	h.series.each(func(labelValues []string, v *histogram) {
+		var cumulative uint64
+		for i, upperBound := range h.buckets {
+			cumulative += v.counts[i]
+			h.writeSample(w, "_bucket", labelValues, "le", formatFloat(upperBound), float64(cumulative))
+		}
+		h.writeSample(w, "_bucket", labelValues, "le", "+Inf", float64(v.count))
+		h.writeSample(w, "_sum", labelValues, "", "", v.sum)
+		h.writeSample(w, "_count", labelValues, "", "", float64(v.count))
+	})
+}
@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/logging"
+	"github.com/go-chi/chi/v5"
+)
+
+// Header a request ID is read from, if the client or a proxy sent one, and echoed back in
+const RequestIDHeader = "X-Request-ID"
+
+// Request IDs taken from clients must look like this, so they can't inject anything into the logs
+var requestIDRegex = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// RequestID gives every request an ID, echoed back in the X-Request-ID header, and a logger that includes it
+func (um *UserMiddleware) RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(RequestIDHeader)
+		if !requestIDRegex.MatchString(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, requestID)
+
+		logger := um.Logger.With("request_id", requestID)
+		next.ServeHTTP(w, r.WithContext(logging.WithLogger(r.Context(), logger)))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// AccessLog logs one line per request once it has been served, and records it in the metrics. Only the route
+// pattern is logged, never the path or query, which can hold secrets (public link slugs, tokens of event streams).
+func (um *UserMiddleware) AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rw, r)
+
+		duration := time.Since(start)
+		route := RoutePattern(r)
+		logging.FromContext(r.Context()).Info("request",
+			"method", r.Method,
+			"route", route,
+			"status", rw.status,
+			"bytes", rw.bytes,
+			"duration_ms", float64(duration.Microseconds())/1000,
+		)
+		if um.Metrics != nil {
+			um.Metrics.ObserveRequest(r.Method, route, rw.status, duration)
+		}
+	})
+}
+
+// RoutePattern is the chi route pattern the request matched, like /notes/{id}, or "unmatched"
+func RoutePattern(r *http.Request) string {
+	rctx := chi.RouteContext(r.Context())
+	if rctx == nil || rctx.RoutePattern() == "" {
+		return "unmatched"
+	}
+	return rctx.RoutePattern()
+}
+
+// responseRecorder records the status and size of a response.
+// Unwrap lets http.ResponseController reach the flushing of event streams through it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func (rw *responseRecorder) WriteHeader(status int) {
+	if !rw.wroteHeader {
+		rw.status = status
+		rw.wroteHeader = true
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseRecorder) Write(b []byte) (int, error) {
+	rw.wroteHeader = true
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += n
+	return n, err
+}
+
+func (rw *responseRecorder) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// Hijack takes over the connection for WebSockets, which switch protocols
+func (rw *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buf, err := http.NewResponseController(rw.ResponseWriter).Hijack()
+	if err == nil {
+		rw.status = http.StatusSwitchingProtocols
+		rw.wroteHeader = true
+	}
+	return conn, buf, err
+}
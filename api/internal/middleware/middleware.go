@@ -2,18 +2,41 @@ package middleware
 
 import (
 	"context"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/logging"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/metrics"
 	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/store"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/tokens"
 	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/utils"
 	"github.com/rs/cors"
 )
 
 type UserMiddleware struct {
-	UserStore store.UserStore
+	UserStore  store.UserStore
+	TokenStore store.TokenStore // Optional, records when each session was last used
+	// Optional, accepts personal access tokens (the ones starting with tokens.PersonalAccessTokenPrefix)
+	APITokenStore store.APITokenStore
+	CORSOrigins   []string         // Origins browsers may call the API from
+	Metrics       *metrics.Metrics // Optional, AccessLog records every request in it
+	Logger        *slog.Logger
+
+	touchMu     sync.Mutex
+	lastTouched map[string]time.Time // token key -> last time last_used_at was written
+	touches     sync.WaitGroup       // updates still running in the background
 }
 
+// Returned to suspended users, by Authenticate and at login
+const accountSuspendedMessage = "this account has been suspended"
+
+// last_used_at is written at most this often per token
+const touchInterval = time.Minute
+
 /*
 	Collisions.
 	The reason we store context key in a separate type is to avoid collisions with other context keys.
@@ -25,14 +48,47 @@ type UserMiddleware struct {
 type contextKey string
 
 const userContextKey = contextKey("user")
+const tokenHashContextKey = contextKey("token_hash")
+const scopesContextKey = contextKey("scopes")
 
 func SetUser(r *http.Request, user *store.User) *http.Request {
 	// Insert user into context property of the request. Every http request has a context property:
 	// We will do this even with anonymous users, so that downstream handlers can always expect a user to be present in the context.
 	ctx := context.WithValue(r.Context(), userContextKey, user)
+	if !user.IsAnonymous() {
+		logging.AddAttrs(ctx, "user_id", user.ID)
+	}
 	return r.WithContext(ctx)
 }
 
+// get the hash of the token the request was authenticated with, nil for anonymous requests:
+func GetTokenHash(r *http.Request) []byte {
+	hash, _ := r.Context().Value(tokenHashContextKey).([]byte)
+	return hash
+}
+
+// get the scopes of the personal access token the request was authenticated with.
+// nil means a login token, which is allowed everything.
+func GetScopes(r *http.Request) []string {
+	scopes, _ := r.Context().Value(scopesContextKey).([]string)
+	return scopes
+}
+
+// HasScope reports whether the request's credentials allow the given scope.
+func HasScope(r *http.Request, scope string) bool {
+	scopes, isAPIToken := r.Context().Value(scopesContextKey).([]string)
+	return !isAPIToken || utils.StringInSlice(scope, scopes)
+}
+
+// HasRole reports whether the request's user has the given role (or a higher one).
+// Personal access tokens never act with more than the user role, even when the user is an admin.
+func HasRole(r *http.Request, role store.Role) bool {
+	if role != store.RoleUser && !HasScope(r, store.APIScopeAccountWrite) {
+		return false
+	}
+	return GetUser(r).HasRole(role)
+}
+
 // Log off user:
 func (um *UserMiddleware) Logout(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -59,11 +115,7 @@ func GetUser(r *http.Request) *store.User {
 // CORS middleware function to handle Cross-Origin Resource Sharing
 func (um *UserMiddleware) CORS(next http.Handler) http.Handler {
 	cors := cors.New(cors.Options{
-		AllowedOrigins: []string{
-			"http://localhost:5173",
-			"http://127.0.0.1:5173",
-			"http://localhost:3000",
-		},
+		AllowedOrigins: um.CORSOrigins,
 		AllowedMethods: []string{
 			"GET",
 			"POST",
@@ -78,9 +130,13 @@ func (um *UserMiddleware) CORS(next http.Handler) http.Handler {
 			"Accept",
 			"Origin",
 			"X-Requested-With",
+			"Last-Event-ID",
+			"X-Link-Password",
+			RequestIDHeader,
 		},
 		ExposedHeaders: []string{
 			"Authorization",
+			RequestIDHeader,
 		},
 		AllowCredentials: true,
 		Debug:            false,
@@ -117,6 +173,11 @@ func (um *UserMiddleware) Authenticate(next http.Handler) http.Handler {
 		}
 
 		token := headerParts[1]
+		if strings.HasPrefix(token, tokens.PersonalAccessTokenPrefix) {
+			um.authenticateAPIToken(w, r, next, token)
+			return
+		}
+
 		user, err := um.UserStore.GetUserToken("authentication", token)
 		if err != nil {
 			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to retrieve user"})
@@ -128,13 +189,126 @@ func (um *UserMiddleware) Authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		if user.IsSuspended() {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": accountSuspendedMessage})
+			return
+		}
+
 		// User found, set it in the context and proceed to the next handler:
+		tokenHash := tokens.Hash(token)
+		if um.TokenStore != nil {
+			um.touch("session:"+string(tokenHash), func() error {
+				return um.TokenStore.TouchToken(tokenHash)
+			})
+		}
 		r = SetUser(r, user)
+		r = r.WithContext(context.WithValue(r.Context(), tokenHashContextKey, tokenHash))
 		next.ServeHTTP(w, r)
 
 	})
 }
 
+// authenticateAPIToken is Authenticate for personal access tokens. The token's scopes go into the context for RequireScope.
+func (um *UserMiddleware) authenticateAPIToken(w http.ResponseWriter, r *http.Request, next http.Handler, token string) {
+	if um.APITokenStore == nil {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or expired token"})
+		return
+	}
+
+	apiToken, err := um.APITokenStore.GetAPITokenByPlaintext(token)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to retrieve user"})
+		return
+	}
+	if apiToken == nil {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or expired token"})
+		return
+	}
+
+	user, err := um.UserStore.GetUserById(apiToken.UserID)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to retrieve user"})
+		return
+	}
+	if user == nil {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or expired token"})
+		return
+	}
+
+	if user.IsSuspended() {
+		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": accountSuspendedMessage})
+		return
+	}
+	// Only logging in cancels a deletion, scripts should not keep a doomed account busy in the meantime
+	if user.IsDeletionScheduled() {
+		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "this account is scheduled for deletion, log in to cancel it"})
+		return
+	}
+
+	um.touch(fmt.Sprintf("api:%d", apiToken.ID), func() error {
+		return um.APITokenStore.TouchAPIToken(apiToken.ID)
+	})
+
+	scopes := apiToken.Scopes
+	if scopes == nil {
+		scopes = []string{} // non-nil marks the request as coming from an API token
+	}
+	r = SetUser(r, user)
+	r = r.WithContext(context.WithValue(r.Context(), scopesContextKey, scopes))
+	next.ServeHTTP(w, r)
+}
+
+// TokenFromQuery lets clients that cannot set headers (EventSource, browser WebSockets) send their token as ?access_token=.
+// It must run before Authenticate. Only use it on the routes that need it, since URLs tend to end up in logs.
+func (um *UserMiddleware) TokenFromQuery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("access_token")
+		if token != "" && r.Header.Get("Authorization") == "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// touch runs update (recording a token's last_used_at) in the background, at most once per touchInterval per key,
+// so authenticated requests do not each pay for a database write.
+func (um *UserMiddleware) touch(key string, update func() error) {
+	now := time.Now()
+
+	um.touchMu.Lock()
+	if um.lastTouched == nil {
+		um.lastTouched = make(map[string]time.Time)
+	}
+	if now.Sub(um.lastTouched[key]) < touchInterval {
+		um.touchMu.Unlock()
+		return
+	}
+	um.lastTouched[key] = now
+	// Forget stale entries now and then so the map does not grow forever
+	if len(um.lastTouched) > 10000 {
+		for k, t := range um.lastTouched {
+			if now.Sub(t) >= touchInterval {
+				delete(um.lastTouched, k)
+			}
+		}
+	}
+	um.touchMu.Unlock()
+
+	um.touches.Add(1)
+	go func() {
+		defer um.touches.Done()
+		err := update()
+		if err != nil && um.Logger != nil {
+			um.Logger.Error("Error updating token last_used_at", "error", err)
+		}
+	}()
+}
+
+// Wait blocks until the background last_used_at updates are done. Call it before closing the database.
+func (um *UserMiddleware) Wait() {
+	um.touches.Wait()
+}
+
 // Handler function from routes to protect routes that require authentication:
 func (um *UserMiddleware) RequireUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -146,3 +320,37 @@ func (um *UserMiddleware) RequireUser(next http.HandlerFunc) http.HandlerFunc {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// RequireVerifiedEmail is RequireUser for features that are off limits until the user has verified their email, like sharing.
+func (um *UserMiddleware) RequireVerifiedEmail(next http.HandlerFunc) http.HandlerFunc {
+	return um.RequireUser(func(w http.ResponseWriter, r *http.Request) {
+		if !GetUser(r).IsEmailVerified() {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "you must verify your email address to access this resource"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireScope is RequireUser for routes that personal access tokens need a specific scope for.
+// Login tokens pass every scope check.
+func (um *UserMiddleware) RequireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return um.RequireUser(func(w http.ResponseWriter, r *http.Request) {
+		if !HasScope(r, scope) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "this token is missing the " + scope + " scope"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireRole is RequireUser for routes reserved to a role, such as moderators or admins.
+func (um *UserMiddleware) RequireRole(role store.Role, next http.HandlerFunc) http.HandlerFunc {
+	return um.RequireUser(func(w http.ResponseWriter, r *http.Request) {
+		if !HasRole(r, role) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "you do not have permission to access this resource"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,93 @@
+package policy
+
+import (
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/store"
+)
+
+/*
+	One place to decide who can do what with a note or a folder.
+	Handlers load the resource, ask the policy for the current user's permission on it,
+	and compare it to what the action needs. Ownership always wins; otherwise shares on the
+	item itself or on any folder above it grant viewer or editor access.
+*/
+
+// Permission levels, ordered so a higher level includes everything below it.
+type Permission int
+
+const (
+	None  Permission = iota // no access at all
+	View                    // read only (shared as viewer)
+	Edit                    // change title and content (shared as editor)
+	Owner                   // everything, including delete, move and sharing
+)
+
+// Allows reports whether p is at least the needed level.
+func (p Permission) Allows(needed Permission) bool {
+	return p >= needed
+}
+
+type Policy struct {
+	folderStore store.FolderStore
+	shareStore  store.ShareStore
+}
+
+// Constructor for Policy
+func New(folderStore store.FolderStore, shareStore store.ShareStore) *Policy {
+	return &Policy{
+		folderStore: folderStore,
+		shareStore:  shareStore,
+	}
+}
+
+// fromShare maps a share permission to a policy permission.
+func fromShare(permission string) Permission {
+	switch permission {
+	case store.SharePermissionEditor:
+		return Edit
+	case store.SharePermissionViewer:
+		return View
+	default:
+		return None
+	}
+}
+
+// NotePermission returns what user may do with note.
+func (p *Policy) NotePermission(user *store.User, note *store.Note) (Permission, error) {
+	if user.IsAnonymous() {
+		return None, nil
+	}
+	if note.UserID == user.ID {
+		return Owner, nil
+	}
+	permission, err := p.shareStore.GetNoteSharePermission(note.ID, user.ID)
+	if err != nil {
+		return None, err
+	}
+	return fromShare(permission), nil
+}
+
+// FolderPermission returns what user may do with folder.
+func (p *Policy) FolderPermission(user *store.User, folder *store.Folder) (Permission, error) {
+	if user.IsAnonymous() {
+		return None, nil
+	}
+	if folder.UserID == user.ID {
+		return Owner, nil
+	}
+	permission, err := p.shareStore.GetFolderSharePermission(folder.ID, user.ID)
+	if err != nil {
+		return None, err
+	}
+	return fromShare(permission), nil
+}
+
+// OwnsFolder reports whether folderID is an existing (not trashed) folder owned by userID.
+// Used wherever a request points at a folder by ID: parent folders, note folders, move targets.
+// Shared folders do not count: notes and folders can only be filed under their owner's own folders.
+func (p *Policy) OwnsFolder(folderID, userID int) (bool, error) {
+	folder, err := p.folderStore.GetFolderByID(folderID)
+	if err != nil {
+		return false, err
+	}
+	return folder != nil && folder.UserID == userID, nil
+}
@@ -2,12 +2,17 @@ package routes
 
 import (
 	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/app"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/store"
 	"github.com/go-chi/chi/v5"
 )
 
 func SetupRoutes(app *app.Application) *chi.Mux {
 	r := chi.NewRouter()
 
+	// Request IDs and the access log come first, so they cover every response, CORS preflights included
+	r.Use(app.Middleware.RequestID)
+	r.Use(app.Middleware.AccessLog)
+
 	// Apply CORS middleware to all routes
 	r.Use(app.Middleware.CORS)
 
@@ -19,39 +24,129 @@ func SetupRoutes(app *app.Application) *chi.Mux {
 	r.Group(func(r chi.Router) {
 		r.Use(app.Middleware.Authenticate) // Apply the authentication middleware to all routes in this group
 
+		// RequireScope also accepts login tokens; personal access tokens need the named scope.
+		// Account management uses store.APIScopeAccountWrite, which personal access tokens never get.
+
 		// Note routes
-		r.Get("/notes/{id}", app.Middleware.RequireUser(app.NoteHandler.HandleGetNoteByID))
-		r.Get("/user-notes/{user_id}", app.Middleware.RequireUser(app.NoteHandler.HandleListNotesByUserID))
-		r.Post("/notes", app.Middleware.RequireUser(app.NoteHandler.HandleCreateNote))
-		r.Patch("/notes/{id}", app.Middleware.RequireUser(app.NoteHandler.HandleUpdateNote))
-		r.Delete("/notes/{id}", app.Middleware.RequireUser(app.NoteHandler.HandleDeleteNote))
+		r.Get("/notes/search", app.Middleware.RequireScope(store.APIScopeNotesRead, app.NoteHandler.HandleSearchNotes))
+		r.Get("/notes/{id}", app.Middleware.RequireScope(store.APIScopeNotesRead, app.NoteHandler.HandleGetNoteByID))
+		r.Get("/user-notes/{user_id}", app.Middleware.RequireScope(store.APIScopeNotesRead, app.NoteHandler.HandleListNotesByUserID))
+		r.Post("/notes", app.Middleware.RequireScope(store.APIScopeNotesWrite, app.NoteHandler.HandleCreateNote))
+		r.Patch("/notes/{id}", app.Middleware.RequireScope(store.APIScopeNotesWrite, app.NoteHandler.HandleUpdateNote))
+		r.Delete("/notes/{id}", app.Middleware.RequireScope(store.APIScopeNotesWrite, app.NoteHandler.HandleDeleteNote))
+		r.Get("/notes/{id}/revisions", app.Middleware.RequireScope(store.APIScopeNotesRead, app.NoteHandler.HandleListNoteRevisions))
+		r.Get("/notes/{id}/revisions/{rev}/diff", app.Middleware.RequireScope(store.APIScopeNotesRead, app.NoteHandler.HandleGetNoteRevisionDiff))
+		r.Post("/notes/{id}/revisions/{rev}/restore", app.Middleware.RequireScope(store.APIScopeNotesWrite, app.NoteHandler.HandleRestoreNoteRevision))
 
 		// Folder routes
-		r.Get("/folders/{id}", app.Middleware.RequireUser(app.FolderHandler.HandleGetFolderByID))
-		r.Get("/user-folders/{user_id}", app.Middleware.RequireUser(app.FolderHandler.HandleListFoldersByUserID))
-		r.Post("/folders", app.Middleware.RequireUser(app.FolderHandler.HandleCreateFolder))
-		r.Patch("/folders/{id}", app.Middleware.RequireUser(app.FolderHandler.HandleUpdateFolder))
-		r.Delete("/folders/{id}", app.Middleware.RequireUser(app.FolderHandler.HandleDeleteFolder))
+		r.Get("/folders/tree", app.Middleware.RequireScope(store.APIScopeFoldersRead, app.FolderHandler.HandleGetFolderTree))
+		r.Get("/folders/{id}/path", app.Middleware.RequireScope(store.APIScopeFoldersRead, app.FolderHandler.HandleGetFolderPath))
+		r.Get("/folders/{id}", app.Middleware.RequireScope(store.APIScopeFoldersRead, app.FolderHandler.HandleGetFolderByID))
+		r.Get("/user-folders/{user_id}", app.Middleware.RequireScope(store.APIScopeFoldersRead, app.FolderHandler.HandleListFoldersByUserID))
+		r.Post("/folders", app.Middleware.RequireScope(store.APIScopeFoldersWrite, app.FolderHandler.HandleCreateFolder))
+		r.Patch("/folders/{id}", app.Middleware.RequireScope(store.APIScopeFoldersWrite, app.FolderHandler.HandleUpdateFolder))
+		r.Delete("/folders/{id}", app.Middleware.RequireScope(store.APIScopeFoldersWrite, app.FolderHandler.HandleDeleteFolder))
+		r.Post("/folders/{id}/move", app.Middleware.RequireScope(store.APIScopeFoldersWrite, app.FolderHandler.HandleMoveFolder))
+		r.Get("/folders/{id}/contents", app.Middleware.RequireScope(store.APIScopeFoldersRead, app.FolderHandler.HandleGetFolderContents))
+
+		// Sharing routes. Sharing and creating public links need a verified email.
+		r.Get("/notes/{id}/shares", app.Middleware.RequireScope(store.APIScopeNotesRead, app.ShareHandler.HandleListNoteShares))
+		r.Post("/notes/{id}/shares", app.Middleware.RequireVerifiedEmail(app.Middleware.RequireScope(store.APIScopeNotesWrite, app.ShareHandler.HandleShareNote)))
+		r.Get("/folders/{id}/shares", app.Middleware.RequireScope(store.APIScopeFoldersRead, app.ShareHandler.HandleListFolderShares))
+		r.Post("/folders/{id}/shares", app.Middleware.RequireVerifiedEmail(app.Middleware.RequireScope(store.APIScopeFoldersWrite, app.ShareHandler.HandleShareFolder)))
+		r.Delete("/shares/{id}", app.Middleware.RequireScope(store.APIScopeNotesWrite, app.ShareHandler.HandleDeleteShare))
+		r.Get("/shared-with-me", app.Middleware.RequireScope(store.APIScopeNotesRead, app.ShareHandler.HandleListSharedWithMe))
+
+		// Public link management
+		r.Get("/notes/{id}/public-links", app.Middleware.RequireScope(store.APIScopeNotesRead, app.LinkHandler.HandleListPublicLinks))
+		r.Post("/notes/{id}/public-links", app.Middleware.RequireVerifiedEmail(app.Middleware.RequireScope(store.APIScopeNotesWrite, app.LinkHandler.HandleCreatePublicLink)))
+		r.Delete("/public-links/{id}", app.Middleware.RequireScope(store.APIScopeNotesWrite, app.LinkHandler.HandleRevokePublicLink))
+
+		// Tag routes
+		r.Get("/tags", app.Middleware.RequireScope(store.APIScopeNotesRead, app.TagHandler.HandleListTags))
+		r.Post("/tags", app.Middleware.RequireScope(store.APIScopeNotesWrite, app.TagHandler.HandleCreateTag))
+		r.Patch("/tags/{id}", app.Middleware.RequireScope(store.APIScopeNotesWrite, app.TagHandler.HandleRenameTag))
+		r.Delete("/tags/{id}", app.Middleware.RequireScope(store.APIScopeNotesWrite, app.TagHandler.HandleDeleteTag))
+		r.Post("/tags/{id}/merge", app.Middleware.RequireScope(store.APIScopeNotesWrite, app.TagHandler.HandleMergeTag))
+		r.Post("/notes/{id}/tags", app.Middleware.RequireScope(store.APIScopeNotesWrite, app.TagHandler.HandleAttachTag))
+		r.Delete("/notes/{id}/tags/{tag_id}", app.Middleware.RequireScope(store.APIScopeNotesWrite, app.TagHandler.HandleDetachTag))
+
+		// Trash routes
+		r.Get("/trash", app.Middleware.RequireScope(store.APIScopeNotesRead, app.TrashHandler.HandleListTrash))
+		r.Delete("/trash", app.Middleware.RequireScope(store.APIScopeNotesWrite, app.TrashHandler.HandleEmptyTrash))
+		r.Post("/trash/notes/{id}/restore", app.Middleware.RequireScope(store.APIScopeNotesWrite, app.TrashHandler.HandleRestoreNote))
+		r.Post("/trash/folders/{id}/restore", app.Middleware.RequireScope(store.APIScopeFoldersWrite, app.TrashHandler.HandleRestoreFolder))
 
 		// Users routes
-		r.Get("/users/{id}", app.Middleware.RequireUser(app.UserHandler.HandleGetUserByID))
-		r.Patch("/users/{id}", app.Middleware.RequireUser(app.UserHandler.HandleUpdateUser))
-		r.Get("/users/me", app.Middleware.RequireUser(app.UserHandler.HandleGetSelf))
-		r.Patch("/users/password/{id}", app.Middleware.RequireUser(app.UserHandler.HandleUpdateUserPassword))
-		// r.Delete("/users/{id}", app.Middleware.RequireUser(app.UserHandler.HandleDeleteUser))
+		r.Get("/users/{id}", app.Middleware.RequireScope(store.APIScopeAccountRead, app.UserHandler.HandleGetUserByID))
+		r.Patch("/users/{id}", app.Middleware.RequireScope(store.APIScopeAccountWrite, app.UserHandler.HandleUpdateUser))
+		r.Get("/users/me", app.Middleware.RequireScope(store.APIScopeAccountRead, app.UserHandler.HandleGetSelf))
+		r.Patch("/users/password/{id}", app.Middleware.RequireScope(store.APIScopeAccountWrite, app.UserHandler.HandleUpdateUserPassword))
+		r.Get("/users/me/sessions", app.Middleware.RequireScope(store.APIScopeAccountWrite, app.SessionHandler.HandleListSessions))
+		r.Delete("/users/me/sessions", app.Middleware.RequireScope(store.APIScopeAccountWrite, app.SessionHandler.HandleRevokeOtherSessions)) // all but the current one
+		r.Delete("/users/me/sessions/{id}", app.Middleware.RequireScope(store.APIScopeAccountWrite, app.SessionHandler.HandleRevokeSession))
+		r.Get("/users/me/2fa", app.Middleware.RequireScope(store.APIScopeAccountWrite, app.TwoFactorHandler.HandleGetTwoFactorStatus))
+		r.Post("/users/me/2fa/setup", app.Middleware.RequireScope(store.APIScopeAccountWrite, app.TwoFactorHandler.HandleSetupTwoFactor))
+		r.Post("/users/me/2fa/confirm", app.Middleware.RequireScope(store.APIScopeAccountWrite, app.TwoFactorHandler.HandleConfirmTwoFactor))
+		r.Post("/users/me/2fa/disable", app.Middleware.RequireScope(store.APIScopeAccountWrite, app.TwoFactorHandler.HandleDisableTwoFactor))
+		r.Get("/users/me/api-tokens", app.Middleware.RequireScope(store.APIScopeAccountWrite, app.APITokenHandler.HandleListAPITokens))
+		r.Post("/users/me/api-tokens", app.Middleware.RequireScope(store.APIScopeAccountWrite, app.APITokenHandler.HandleCreateAPIToken))
+		r.Delete("/users/me/api-tokens/{id}", app.Middleware.RequireScope(store.APIScopeAccountWrite, app.APITokenHandler.HandleDeleteAPIToken))
+		r.Post("/users/verify-email/resend", app.Middleware.RequireScope(store.APIScopeAccountWrite, app.EmailVerificationHandler.HandleResendVerification))
+		r.Get("/users/me/export", app.Middleware.RequireScope(store.APIScopeAccountWrite, app.AccountHandler.HandleExportAccount))
+		r.Delete("/users/me", app.Middleware.RequireScope(store.APIScopeAccountWrite, app.AccountHandler.HandleDeleteAccount))
+		r.Get("/users/me/audit", app.Middleware.RequireScope(store.APIScopeAccountRead, app.AuditHandler.HandleListMyAuditEvents))
+
+		// Admin routes. auth_level sent by anyone but an admin to register or PATCH /users/{id} is ignored,
+		// roles are changed here.
+		r.Get("/admin/users", app.Middleware.RequireRole(store.RoleAdmin, app.AdminHandler.HandleListUsers))
+		r.Get("/admin/users/{id}", app.Middleware.RequireRole(store.RoleAdmin, app.AdminHandler.HandleGetUser))
+		r.Put("/admin/users/{id}/role", app.Middleware.RequireRole(store.RoleAdmin, app.AdminHandler.HandleUpdateUserRole))
+		r.Post("/admin/users/{id}/suspend", app.Middleware.RequireRole(store.RoleAdmin, app.AdminHandler.HandleSuspendUser))
+		r.Post("/admin/users/{id}/unsuspend", app.Middleware.RequireRole(store.RoleAdmin, app.AdminHandler.HandleUnsuspendUser))
+		r.Post("/admin/users/{id}/password-reset", app.Middleware.RequireRole(store.RoleAdmin, app.AdminHandler.HandleForcePasswordReset))
+		r.Post("/admin/users/{id}/revoke-tokens", app.Middleware.RequireRole(store.RoleAdmin, app.AdminHandler.HandleRevokeUserTokens))
+		r.Delete("/admin/users/{id}", app.Middleware.RequireRole(store.RoleAdmin, app.AdminHandler.HandleDeleteUser))
+		r.Get("/admin/audit", app.Middleware.RequireRole(store.RoleAdmin, app.AuditHandler.HandleListAuditEvents))
+
+		// Logging user out. Needs Authenticate to know which token to revoke.
+		r.Delete("/tokens/authentication", app.Middleware.RequireUser(app.TokenHandler.HandleRevokeToken))
+	})
+
+	// Real-time events. Browsers cannot set headers on these, so the token may also come from the query string.
+	r.Group(func(r chi.Router) {
+		r.Use(app.Middleware.TokenFromQuery)
+		r.Use(app.Middleware.Authenticate)
+
+		r.Get("/events", app.Middleware.RequireScope(store.APIScopeNotesRead, app.EventHandler.HandleEventStream))
+		r.Get("/events/ws", app.Middleware.RequireScope(store.APIScopeNotesRead, app.EventHandler.HandleEventWebSocket))
 	})
 
 	// Define routes and their handlers here
 	r.Get("/health", app.HealthCheck) // Health check endpoint
 
-	// // User registration route
-	r.Post("/users/register", app.UserHandler.HandleRegisterUser)
+	// Prometheus metrics, when not served on their own address (see main.go). Never without the bearer token here.
+	if app.Config.MetricsAddr == "" && app.Config.MetricsToken != "" {
+		r.Method("GET", "/metrics", app.Metrics.Handler(app.Config.MetricsToken))
+	}
+
+	// Public (read-only) note links, no account needed
+	r.Get("/p/{slug}", app.LinkHandler.HandleViewPublicLink)
+
+	// // User registration route. Authenticate is only there so admins can create users with a role.
+	r.With(app.Middleware.Authenticate).Post("/users/register", app.UserHandler.HandleRegisterUser)
+
+	// Email verification, the token comes from the emailed link
+	r.Post("/users/verify-email", app.EmailVerificationHandler.HandleVerifyEmail)
+
+	// Password reset (forgotten password)
+	r.Post("/users/password-reset/request", app.PasswordResetHandler.HandleRequestPasswordReset)
+	r.Post("/users/password-reset/confirm", app.PasswordResetHandler.HandleConfirmPasswordReset)
 
 	// // Token creation route
 	r.Post("/tokens/authentication", app.TokenHandler.HandleCreateToken)
-
-	// // Logging user out:
-	r.Delete("/tokens/authentication", app.Middleware.RequireUser(app.TokenHandler.HandleRevokeToken))
+	r.Post("/tokens/2fa", app.TokenHandler.HandleVerifyTwoFactor) // Second login step when 2FA is on
+	r.Post("/tokens/refresh", app.TokenHandler.HandleRefreshToken)
 
 	return r
 }
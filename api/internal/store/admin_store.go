@@ -0,0 +1,200 @@
+package store
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/tokens"
+)
+
+// UserListOptions filters and pages the admin user listing. Users are listed by ID.
+type UserListOptions struct {
+	Search    string // matched against username, email, first and last name
+	Suspended *bool
+	Limit     int
+	Cursor    string
+}
+
+// UserStats are the counts shown next to a user in the admin API
+type UserStats struct {
+	Notes          int `json:"notes"`
+	Folders        int `json:"folders"`
+	TrashedNotes   int `json:"trashed_notes"`
+	Sessions       int `json:"sessions"`
+	APITokens      int `json:"api_tokens"`
+	PublicLinks    int `json:"public_links"`
+	SharesReceived int `json:"shares_received"`
+}
+
+// SiteTotals are counts over every user, for the metrics
+type SiteTotals struct {
+	Users        int
+	Notes        int
+	Folders      int
+	TrashedNotes int
+	Sessions     int
+	APITokens    int
+	PublicLinks  int
+	Shares       int
+}
+
+type PostgresAdminStore struct {
+	db *sql.DB
+}
+
+func NewPostgresAdminStore(db *sql.DB) *PostgresAdminStore {
+	return &PostgresAdminStore{db: db}
+}
+
+// Interface for AdminStore to allow decoupling and easier testing:
+type AdminStore interface {
+	ListUsers(opts UserListOptions) ([]*User, string, error)
+	GetUserStats(userID int) (*UserStats, error)
+	GetSiteTotals() (*SiteTotals, error)
+}
+
+// ListUsers returns one page of users and the cursor for the next page ("" on the last page).
+func (pg *PostgresAdminStore) ListUsers(opts UserListOptions) ([]*User, string, error) {
+	page := ListOptions{Limit: opts.Limit, SortBy: "id"}
+	if page.Limit <= 0 || page.Limit > MaxListLimit {
+		page.Limit = DefaultListLimit
+	}
+
+	qb := &queryBuilder{}
+	qb.where("TRUE")
+	if search := strings.TrimSpace(opts.Search); search != "" {
+		pattern := qb.arg("%" + escapeLike(search) + "%")
+		qb.where("(username ILIKE " + pattern + " OR email ILIKE " + pattern +
+			" OR first_name ILIKE " + pattern + " OR last_name ILIKE " + pattern + ")")
+	}
+	if opts.Suspended != nil {
+		if *opts.Suspended {
+			qb.where("suspended_at IS NOT NULL")
+		} else {
+			qb.where("suspended_at IS NULL")
+		}
+	}
+	if opts.Cursor != "" {
+		c, err := decodeCursor(opts.Cursor)
+		if err != nil || c.SortBy != page.SortBy {
+			return nil, "", ErrInvalidCursor
+		}
+		qb.where("id > " + qb.arg(c.ID))
+	}
+
+	query := `
+		SELECT id, username, email, bio, auth_level, first_name, last_name, pfp_url,
+		address_line1, address_line2, address_city, address_state, address_zip_code, address_country,
+		email_verified_at, suspended_at, password_reset_required, deletion_scheduled_at, created_at, updated_at
+		FROM users
+		` + qb.whereClause() + `
+		ORDER BY id
+		LIMIT ` + qb.arg(page.Limit+1)
+	rows, err := pg.db.Query(query, qb.args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		user := &User{}
+		err := rows.Scan(
+			&user.ID,
+			&user.Username,
+			&user.Email,
+			&user.Bio,
+			&user.AuthLevel,
+			&user.FirstName,
+			&user.LastName,
+			&user.PfpURL,
+			&user.AddressLine1,
+			&user.AddressLine2,
+			&user.AddressCity,
+			&user.AddressState,
+			&user.AddressZip,
+			&user.AddressCountry,
+			&user.EmailVerifiedAt,
+			&user.SuspendedAt,
+			&user.PasswordResetRequired,
+			&user.DeletionScheduledAt,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+		)
+		if err != nil {
+			return nil, "", err
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	users, next := nextCursor(users, &page,
+		func(u *User) int { return u.ID },
+		func(u *User) string { return "" },
+	)
+	return users, next, nil
+}
+
+// escapeLike escapes the LIKE wildcards in a search term so it is matched literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func (pg *PostgresAdminStore) GetUserStats(userID int) (*UserStats, error) {
+	query := `
+		SELECT
+		(SELECT COUNT(*) FROM notes WHERE user_id = $1 AND deleted_at IS NULL),
+		(SELECT COUNT(*) FROM folders WHERE user_id = $1 AND deleted_at IS NULL),
+		(SELECT COUNT(*) FROM notes WHERE user_id = $1 AND deleted_at IS NOT NULL),
+		(SELECT COUNT(DISTINCT session_id) FROM tokens WHERE user_id = $1 AND scope IN ($2, $3) AND expiry > NOW() AND used_at IS NULL),
+		(SELECT COUNT(*) FROM api_tokens WHERE user_id = $1),
+		(SELECT COUNT(*) FROM public_links WHERE user_id = $1),
+		(SELECT COUNT(*) FROM note_shares WHERE shared_with_user_id = $1)
+	`
+	stats := &UserStats{}
+	err := pg.db.QueryRow(query, userID, tokens.ScopeAuth, tokens.ScopeRefresh).Scan(
+		&stats.Notes,
+		&stats.Folders,
+		&stats.TrashedNotes,
+		&stats.Sessions,
+		&stats.APITokens,
+		&stats.PublicLinks,
+		&stats.SharesReceived,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// GetSiteTotals counts, over all users, what GetUserStats counts. Expired and revoked tokens and links are left out.
+func (pg *PostgresAdminStore) GetSiteTotals() (*SiteTotals, error) {
+	query := `
+		SELECT
+		(SELECT COUNT(*) FROM users),
+		(SELECT COUNT(*) FROM notes WHERE deleted_at IS NULL),
+		(SELECT COUNT(*) FROM folders WHERE deleted_at IS NULL),
+		(SELECT COUNT(*) FROM notes WHERE deleted_at IS NOT NULL),
+		(SELECT COUNT(DISTINCT session_id) FROM tokens WHERE scope IN ($1, $2) AND expiry > NOW() AND used_at IS NULL),
+		(SELECT COUNT(*) FROM api_tokens WHERE expires_at IS NULL OR expires_at > NOW()),
+		(SELECT COUNT(*) FROM public_links WHERE revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())),
+		(SELECT COUNT(*) FROM note_shares)
+	`
+	totals := &SiteTotals{}
+	err := pg.db.QueryRow(query, tokens.ScopeAuth, tokens.ScopeRefresh).Scan(
+		&totals.Users,
+		&totals.Notes,
+		&totals.Folders,
+		&totals.TrashedNotes,
+		&totals.Sessions,
+		&totals.APITokens,
+		&totals.PublicLinks,
+		&totals.Shares,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return totals, nil
+}
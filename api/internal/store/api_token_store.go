@@ -0,0 +1,183 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/tokens"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// What a personal access token may be allowed to do. Login tokens can do everything.
+const (
+	APIScopeNotesRead    = "notes:read"    // notes, tags, trash, shares and the event stream
+	APIScopeNotesWrite   = "notes:write"   // create, edit, delete, share and tag notes
+	APIScopeFoldersRead  = "folders:read"  // folders, the folder tree and folder contents
+	APIScopeFoldersWrite = "folders:write" // create, rename, move, delete and share folders
+	APIScopeAccountRead  = "account:read"  // the user's own profile
+
+	// Changing the account, its credentials, sessions or tokens. Never granted to personal access tokens.
+	APIScopeAccountWrite = "account:write"
+)
+
+// APIScopes are the scopes a personal access token can be created with.
+var APIScopes = []string{
+	APIScopeNotesRead,
+	APIScopeNotesWrite,
+	APIScopeFoldersRead,
+	APIScopeFoldersWrite,
+	APIScopeAccountRead,
+}
+
+// APIToken is a named personal access token. The plaintext is only known right after creation.
+type APIToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Token      string     `json:"token,omitempty"`
+	Hash       []byte     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+type PostgresAPITokenStore struct {
+	db *sql.DB
+}
+
+func NewPostgresAPITokenStore(db *sql.DB) *PostgresAPITokenStore {
+	return &PostgresAPITokenStore{db: db}
+}
+
+// Interface for APITokenStore to allow decoupling and easier testing:
+type APITokenStore interface {
+	CreateAPIToken(*APIToken) (*APIToken, error)
+	GetAPITokenByPlaintext(plaintext string) (*APIToken, error)
+	ListAPITokens(userID int) ([]*APIToken, error)
+	DeleteAPIToken(userID, id int) error
+	DeleteAllAPITokens(userID int) (int64, error)
+	TouchAPIToken(id int) error
+}
+
+// CreateAPIToken generates the secret and stores the token. The plaintext is set on the returned token.
+func (pg *PostgresAPITokenStore) CreateAPIToken(token *APIToken) (*APIToken, error) {
+	plaintext, hash, err := tokens.GeneratePersonalAccessToken()
+	if err != nil {
+		return nil, err
+	}
+	token.Token = plaintext
+	token.Hash = hash
+
+	query := `
+		INSERT INTO api_tokens (user_id, name, hash, scopes, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, NOW())
+		RETURNING id, created_at
+	`
+	err = pg.db.QueryRow(query, token.UserID, token.Name, token.Hash, token.Scopes, token.ExpiresAt).Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+const apiTokenColumns = `id, user_id, name, hash, scopes, expires_at, last_used_at, created_at`
+
+func scanAPIToken(row interface{ Scan(...any) error }, typeMap *pgtype.Map) (*APIToken, error) {
+	token := &APIToken{}
+	err := row.Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Name,
+		&token.Hash,
+		typeMap.SQLScanner(&token.Scopes),
+		&token.ExpiresAt,
+		&token.LastUsedAt,
+		&token.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// GetAPITokenByPlaintext looks a token up by its secret. Expired tokens are not returned.
+func (pg *PostgresAPITokenStore) GetAPITokenByPlaintext(plaintext string) (*APIToken, error) {
+	query := `
+		SELECT ` + apiTokenColumns + `
+		FROM api_tokens
+		WHERE hash = $1 AND (expires_at IS NULL OR expires_at > NOW())
+	`
+	token, err := scanAPIToken(pg.db.QueryRow(query, tokens.Hash(plaintext)), pgtype.NewMap())
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (pg *PostgresAPITokenStore) ListAPITokens(userID int) ([]*APIToken, error) {
+	query := `
+		SELECT ` + apiTokenColumns + `
+		FROM api_tokens
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+	`
+	rows, err := pg.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	typeMap := pgtype.NewMap()
+	apiTokens := []*APIToken{}
+	for rows.Next() {
+		token, err := scanAPIToken(rows, typeMap)
+		if err != nil {
+			return nil, err
+		}
+		apiTokens = append(apiTokens, token)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return apiTokens, nil
+}
+
+// DeleteAPIToken revokes one of the user's tokens. Returns sql.ErrNoRows if the user has no such token.
+func (pg *PostgresAPITokenStore) DeleteAPIToken(userID, id int) error {
+	result, err := pg.db.Exec(`DELETE FROM api_tokens WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteAllAPITokens revokes every token of the user and returns how many there were.
+func (pg *PostgresAPITokenStore) DeleteAllAPITokens(userID int) (int64, error) {
+	result, err := pg.db.Exec(`DELETE FROM api_tokens WHERE user_id = $1`, userID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// TouchAPIToken records that a token was just used. Callers should throttle it.
+func (pg *PostgresAPITokenStore) TouchAPIToken(id int) error {
+	query := `
+		UPDATE api_tokens
+		SET last_used_at = NOW()
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')
+	`
+	_, err := pg.db.Exec(query, id)
+	return err
+}
@@ -0,0 +1,258 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// AuditEvent is one entry of the audit trail.
+// Before and After summarize the target around the change; they are marshalled to JSON when recorded
+// and come back as json.RawMessage when listed.
+type AuditEvent struct {
+	ID         int64     `json:"id"`
+	ActorID    *int      `json:"actor_id"` // nil when nobody was logged in
+	UserID     *int      `json:"user_id"`  // whose account or data the event concerns
+	Action     string    `json:"action"`
+	TargetType string    `json:"target_type"`
+	TargetID   *int      `json:"target_id"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	Before     any       `json:"before"`
+	After      any       `json:"after"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Audited actions
+const (
+	AuditLoginSucceeded = "login.succeeded"
+	AuditLoginFailed    = "login.failed"
+
+	AuditTokenCreated       = "token.created"
+	AuditTokenRevoked       = "token.revoked"
+	AuditTokenReuseDetected = "token.reuse_detected"
+
+	AuditUserCreated              = "user.created"
+	AuditUserUpdated              = "user.updated"
+	AuditPasswordChanged          = "password.changed"
+	AuditPasswordReset            = "password.reset"
+	AuditTwoFactorEnabled         = "two_factor.enabled"
+	AuditTwoFactorDisabled        = "two_factor.disabled"
+	AuditAccountExported          = "account.exported"
+	AuditAccountDeletionScheduled = "account.deletion_scheduled"
+	AuditAccountDeletionCancelled = "account.deletion_cancelled"
+	AuditAccountDeleted           = "account.deleted"
+
+	AuditNoteCreated    = "note.created"
+	AuditNoteUpdated    = "note.updated"
+	AuditNoteDeleted    = "note.deleted"
+	AuditNoteRestored   = "note.restored"
+	AuditFolderCreated  = "folder.created"
+	AuditFolderUpdated  = "folder.updated"
+	AuditFolderDeleted  = "folder.deleted"
+	AuditFolderRestored = "folder.restored"
+	AuditNotePurged     = "note.purged"
+	AuditFolderPurged   = "folder.purged"
+	AuditTrashEmptied   = "trash.emptied"
+
+	AuditShareCreated      = "share.created"
+	AuditShareDeleted      = "share.deleted"
+	AuditPublicLinkCreated = "public_link.created"
+	AuditPublicLinkRevoked = "public_link.revoked"
+
+	AuditAdminChangeRole    = "admin.change_role"
+	AuditAdminSuspend       = "admin.suspend"
+	AuditAdminUnsuspend     = "admin.unsuspend"
+	AuditAdminPasswordReset = "admin.force_password_reset"
+	AuditAdminRevokeTokens  = "admin.revoke_tokens"
+	AuditAdminDeleteUser    = "admin.delete_user"
+)
+
+// Target types of audit events
+const (
+	AuditTargetUser       = "user"
+	AuditTargetNote       = "note"
+	AuditTargetFolder     = "folder"
+	AuditTargetShare      = "share"
+	AuditTargetPublicLink = "public_link"
+	AuditTargetSession    = "session"
+	AuditTargetAPIToken   = "api_token"
+)
+
+// AuditQuery filters the audit trail. Events are listed newest first.
+type AuditQuery struct {
+	Involving  *int   // events about this user or done by them, for GET /users/me/audit
+	UserID     *int   // events about this user
+	ActorID    *int   // events done by this user
+	Action     string // exact action, or a prefix ending in "." such as "note."
+	TargetType string
+	TargetID   *int
+	Since      *time.Time
+	Until      *time.Time
+	Limit      int
+	Cursor     string
+}
+
+type PostgresAuditStore struct {
+	db *sql.DB
+}
+
+func NewPostgresAuditStore(db *sql.DB) *PostgresAuditStore {
+	return &PostgresAuditStore{db: db}
+}
+
+// Interface for AuditStore to allow decoupling and easier testing.
+// There is deliberately no way to change or delete events.
+type AuditStore interface {
+	RecordAuditEvent(*AuditEvent) error
+	ListAuditEvents(q AuditQuery) ([]*AuditEvent, string, error)
+}
+
+// RecordAuditEvent appends an event to the trail.
+func (pg *PostgresAuditStore) RecordAuditEvent(event *AuditEvent) error {
+	before, err := marshalAuditSummary(event.Before)
+	if err != nil {
+		return err
+	}
+	after, err := marshalAuditSummary(event.After)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO audit_events (actor_id, user_id, action, target_type, target_id, ip, user_agent, before, after)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id, created_at
+	`
+	return pg.db.QueryRow(query,
+		event.ActorID,
+		event.UserID,
+		event.Action,
+		event.TargetType,
+		event.TargetID,
+		event.IP,
+		event.UserAgent,
+		before,
+		after,
+	).Scan(&event.ID, &event.CreatedAt)
+}
+
+// marshalAuditSummary turns a before/after summary into a JSONB parameter, NULL when there is none.
+func marshalAuditSummary(summary any) (sql.NullString, error) {
+	if summary == nil {
+		return sql.NullString{}, nil
+	}
+	js, err := json.Marshal(summary)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(js), Valid: true}, nil
+}
+
+// ListAuditEvents returns one page of matching events and the cursor for the next page ("" on the last page).
+func (pg *PostgresAuditStore) ListAuditEvents(q AuditQuery) ([]*AuditEvent, string, error) {
+	page := ListOptions{Limit: q.Limit, SortBy: "id", SortDesc: true}
+	if page.Limit <= 0 || page.Limit > MaxListLimit {
+		page.Limit = DefaultListLimit
+	}
+
+	qb := &queryBuilder{}
+	qb.where("TRUE")
+	if q.Involving != nil {
+		id := qb.arg(*q.Involving)
+		qb.where("(user_id = " + id + " OR actor_id = " + id + ")")
+	}
+	if q.UserID != nil {
+		qb.where("user_id = " + qb.arg(*q.UserID))
+	}
+	if q.ActorID != nil {
+		qb.where("actor_id = " + qb.arg(*q.ActorID))
+	}
+	if strings.HasSuffix(q.Action, ".") {
+		qb.where("action LIKE " + qb.arg(escapeLike(q.Action)+"%"))
+	} else if q.Action != "" {
+		qb.where("action = " + qb.arg(q.Action))
+	}
+	if q.TargetType != "" {
+		qb.where("target_type = " + qb.arg(q.TargetType))
+	}
+	if q.TargetID != nil {
+		qb.where("target_id = " + qb.arg(*q.TargetID))
+	}
+	if q.Since != nil {
+		qb.where("created_at >= " + qb.arg(*q.Since))
+	}
+	if q.Until != nil {
+		qb.where("created_at < " + qb.arg(*q.Until))
+	}
+	if q.Cursor != "" {
+		c, err := decodeCursor(q.Cursor)
+		if err != nil || c.SortBy != page.SortBy {
+			return nil, "", ErrInvalidCursor
+		}
+		qb.where("id < " + qb.arg(c.ID))
+	}
+
+	query := `
+		SELECT id, actor_id, user_id, action, target_type, target_id, ip, user_agent, before, after, created_at
+		FROM audit_events
+		` + qb.whereClause() + `
+		ORDER BY id DESC
+		LIMIT ` + qb.arg(page.Limit+1)
+	rows, err := pg.db.Query(query, qb.args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	auditEvents := []*AuditEvent{}
+	for rows.Next() {
+		event := &AuditEvent{}
+		var actorID, userID, targetID sql.NullInt64
+		var before, after []byte
+		err := rows.Scan(
+			&event.ID,
+			&actorID,
+			&userID,
+			&event.Action,
+			&event.TargetType,
+			&targetID,
+			&event.IP,
+			&event.UserAgent,
+			&before,
+			&after,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			return nil, "", err
+		}
+		event.ActorID = nullableID(actorID)
+		event.UserID = nullableID(userID)
+		event.TargetID = nullableID(targetID)
+		if before != nil {
+			event.Before = json.RawMessage(before)
+		}
+		if after != nil {
+			event.After = json.RawMessage(after)
+		}
+		auditEvents = append(auditEvents, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	auditEvents, next := nextCursor(auditEvents, &page,
+		func(e *AuditEvent) int { return int(e.ID) },
+		func(e *AuditEvent) string { return "" },
+	)
+	return auditEvents, next, nil
+}
+
+func nullableID(id sql.NullInt64) *int {
+	if !id.Valid {
+		return nil
+	}
+	i := int(id.Int64)
+	return &i
+}
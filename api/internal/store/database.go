@@ -10,12 +10,12 @@ import (
 )
 
 
-func Open() (*sql.DB, error) {
-	db, err := sql.Open("pgx", "host=localhost port=5432 user=postgres password=postgres dbname=postgres sslmode=disable")
+// Open connects to the database at dsn, either key=value pairs ("host=localhost port=5432 ...") or a postgres:// URL
+func Open(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("pgx", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
-	fmt.Println("Database connection established! 🚀")
 	// db.SetMaxOpenConns(), db.SetMaxIdleConns(), and db.SetConnMaxIdleTime()
 	return db, nil
 }
@@ -0,0 +1,116 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// ExportWriter receives a user's data from ExportUserData: all folders first, then the notes one at a time
+// so their content never has to be held in memory all at once.
+type ExportWriter interface {
+	WriteFolders(folders []*Folder) error
+	WriteNote(note *Note) error
+}
+
+type PostgresExportStore struct {
+	db *sql.DB
+}
+
+func NewPostgresExportStore(db *sql.DB) *PostgresExportStore {
+	return &PostgresExportStore{db: db}
+}
+
+// Interface for ExportStore to allow decoupling and easier testing:
+type ExportStore interface {
+	ExportUserData(ctx context.Context, userID int, w ExportWriter) error
+}
+
+// ExportUserData hands every folder and note of the user to w, trashed ones included (with DeletedAt set).
+// Everything is read from one snapshot so notes cannot point at folders missing from the export.
+func (pg *PostgresExportStore) ExportUserData(ctx context.Context, userID int, w ExportWriter) error {
+
+	// Transaction
+	tx, err := pg.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT id, title, user_id, is_favorite, parent_folder_id, created_at, updated_at, deleted_at
+		FROM folders
+		WHERE user_id = $1
+		ORDER BY id
+	`
+	rows, err := tx.QueryContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+	folders := []*Folder{}
+	for rows.Next() {
+		folder := &Folder{}
+		err := rows.Scan(
+			&folder.ID,
+			&folder.Title,
+			&folder.UserID,
+			&folder.IsFavorite,
+			&folder.ParentFolderID,
+			&folder.CreatedAt,
+			&folder.UpdatedAt,
+			&folder.DeletedAt,
+		)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		folders = append(folders, folder)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	err = w.WriteFolders(folders)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		SELECT n.id, n.title, n.content, n.user_id, n.is_favorite, n.folder_id, ` + noteTagsColumn + `, n.created_at, n.updated_at, n.deleted_at
+		FROM notes n
+		WHERE n.user_id = $1
+		ORDER BY n.id
+	`
+	rows, err = tx.QueryContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	typeMap := pgtype.NewMap()
+	for rows.Next() {
+		note := &Note{}
+		err := rows.Scan(
+			&note.ID,
+			&note.Title,
+			&note.Content,
+			&note.UserID,
+			&note.IsFavorite,
+			&note.FolderID,
+			typeMap.SQLScanner(&note.Tags),
+			&note.CreatedAt,
+			&note.UpdatedAt,
+			&note.DeletedAt,
+		)
+		if err != nil {
+			return err
+		}
+		err = w.WriteNote(note)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -2,6 +2,7 @@ package store
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 )
 
@@ -13,8 +14,12 @@ type Folder struct {
 	ParentFolderID sql.NullInt64 `json:"parent_folder_id"`
 	CreatedAt      string        `json:"created_at"`
 	UpdatedAt      string        `json:"updated_at"`
+	DeletedAt      *string       `json:"deleted_at,omitempty"` // only set on folders in the trash
 }
 
+// ErrFolderCycle is returned when a folder would be moved into itself or one of its own subfolders.
+var ErrFolderCycle = errors.New("a folder cannot be moved into itself or one of its subfolders")
+
 type PostgresFolderStore struct {
 	db *sql.DB
 }
@@ -29,8 +34,11 @@ type FolderStore interface {
 	GetFolderByID(id int) (*Folder, error)
 	UpdateFolder(*Folder) error
 	DeleteFolder(id int) error
-	ListFoldersByUserID(userID int) ([]*Folder, error)
+	ListFoldersByUserID(opts FolderListOptions) ([]*Folder, string, error)
 	GetFolderOwner(id int) (int, error)
+	MoveFolder(id int, parentID *int) error
+	GetFolderTree(userID int) ([]*FolderTreeNode, error)
+	GetFolderPath(id int) ([]*Breadcrumb, error)
 }
 
 // CRUD operations:
@@ -69,7 +77,7 @@ func (pg *PostgresFolderStore) GetFolderByID(id int) (*Folder, error) {
 	query := `
 		SELECT id, title, user_id, is_favorite, parent_folder_id, created_at, updated_at
 		FROM folders
-		WHERE id = $1
+		WHERE id = $1 AND deleted_at IS NULL
 	`
 	err := pg.db.QueryRow(query, id).Scan(
 		&folder.ID,
@@ -102,7 +110,7 @@ func (pg *PostgresFolderStore) UpdateFolder(folder *Folder) error {
 		    is_favorite = $2,
 		    parent_folder_id = $3,
 		    updated_at = NOW()
-		WHERE id = $4
+		WHERE id = $4 AND deleted_at IS NULL
 	`
 	_, err = tx.Exec(query, folder.Title, folder.IsFavorite, folder.ParentFolderID, folder.ID)
 	if err != nil {
@@ -114,13 +122,34 @@ func (pg *PostgresFolderStore) UpdateFolder(folder *Folder) error {
 	}
 	return nil
 }
+
+// DeleteFolder moves the folder to the trash together with its subfolders and their notes.
+// Everything trashed along with it is tagged with deleted_by_folder_id so a restore can bring it all back.
 func (pg *PostgresFolderStore) DeleteFolder(id int) error {
 
+	// Transaction
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Walk down the tree, stopping at anything that was already in the trash
 	query := `
-		DELETE FROM folders
-		WHERE id = $1
+		WITH RECURSIVE subtree AS (
+			SELECT id FROM folders WHERE id = $1 AND deleted_at IS NULL
+			UNION ALL
+			SELECT f.id
+			FROM folders f
+			INNER JOIN subtree s ON f.parent_folder_id = s.id
+			WHERE f.deleted_at IS NULL
+		)
+		UPDATE folders
+		SET deleted_at = NOW(),
+		    deleted_by_folder_id = CASE WHEN id = $1 THEN NULL ELSE $1 END
+		WHERE id IN (SELECT id FROM subtree)
 	`
-	res, err := pg.db.Exec(query, id)
+	res, err := tx.Exec(query, id)
 	if err != nil {
 		return err
 	}
@@ -132,7 +161,81 @@ func (pg *PostgresFolderStore) DeleteFolder(id int) error {
 	if rowsAffected == 0 {
 		return sql.ErrNoRows // Folder not found
 	}
-	return nil
+
+	// Notes inside any folder trashed above. NOW() is the same for the whole transaction.
+	query = `
+		UPDATE notes
+		SET deleted_at = NOW(),
+		    deleted_by_folder_id = $1
+		WHERE deleted_at IS NULL
+		  AND folder_id IN (SELECT id FROM folders WHERE id = $1 OR deleted_by_folder_id = $1)
+	`
+	_, err = tx.Exec(query, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MoveFolder re-parents a folder. A nil parentID moves it to the root.
+// Moves are serialized per user so two concurrent moves cannot sneak a cycle past each other's check.
+func (pg *PostgresFolderStore) MoveFolder(id int, parentID *int) error {
+
+	// Transaction
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRow(`SELECT user_id FROM folders WHERE id = $1 AND deleted_at IS NULL`, id).Scan(&userID)
+	if err != nil {
+		return err // sql.ErrNoRows if the folder does not exist
+	}
+
+	// Released automatically when the transaction ends
+	_, err = tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('folders'), $1)`, userID)
+	if err != nil {
+		return err
+	}
+
+	if parentID != nil {
+		// The target parent must not be the folder itself or anywhere below it
+		var isDescendant bool
+		query := `
+			WITH RECURSIVE subtree AS (
+				SELECT id, 0 AS depth FROM folders WHERE id = $1
+				UNION ALL
+				SELECT f.id, s.depth + 1
+				FROM folders f
+				INNER JOIN subtree s ON f.parent_folder_id = s.id
+				WHERE s.depth < $3
+			)
+			SELECT EXISTS (SELECT 1 FROM subtree WHERE id = $2)
+		`
+		err = tx.QueryRow(query, id, *parentID, maxFolderDepth).Scan(&isDescendant)
+		if err != nil {
+			return err
+		}
+		if isDescendant {
+			return ErrFolderCycle
+		}
+	}
+
+	query := `
+		UPDATE folders
+		SET parent_folder_id = $1,
+		    updated_at = NOW()
+		WHERE id = $2
+	`
+	_, err = tx.Exec(query, parentID, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 func (pg *PostgresFolderStore) GetFolderOwner(id int) (int, error) {
@@ -140,7 +243,7 @@ func (pg *PostgresFolderStore) GetFolderOwner(id int) (int, error) {
 	query := `
 		SELECT user_id
 		FROM folders
-		WHERE id = $1
+		WHERE id = $1 AND deleted_at IS NULL
 	`
 	err := pg.db.QueryRow(query, id).Scan(&userID)
 	if err != nil {
@@ -152,16 +255,29 @@ func (pg *PostgresFolderStore) GetFolderOwner(id int) (int, error) {
 	return userID, nil
 }
 
-func (pg *PostgresFolderStore) ListFoldersByUserID(userID int) ([]*Folder, error) {
+// ListFoldersByUserID returns one page of the user's folders and the cursor for the next page ("" on the last page).
+func (pg *PostgresFolderStore) ListFoldersByUserID(opts FolderListOptions) ([]*Folder, string, error) {
+	qb := &queryBuilder{}
+	orderBy, err := qb.applyListOptions("f", &opts.ListOptions)
+	if err != nil {
+		return nil, "", err
+	}
+	qb.where("f.deleted_at IS NULL")
+
+	if opts.RootOnly {
+		qb.where("f.parent_folder_id IS NULL")
+	} else if opts.ParentFolderID != nil {
+		qb.where("f.parent_folder_id = " + qb.arg(*opts.ParentFolderID))
+	}
+
 	query := `
-		SELECT id, title, user_id, is_favorite, parent_folder_id, created_at, updated_at
-		FROM folders
-		WHERE user_id = $1
-		ORDER BY created_at DESC
-	`
-	rows, err := pg.db.Query(query, userID)
+		SELECT f.id, f.title, f.user_id, f.is_favorite, f.parent_folder_id, f.created_at, f.updated_at
+		FROM folders f
+		` + qb.whereClause() + `
+		` + orderBy
+	rows, err := pg.db.Query(query, qb.args...)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	defer rows.Close()
 
@@ -178,12 +294,29 @@ func (pg *PostgresFolderStore) ListFoldersByUserID(userID int) ([]*Folder, error
 			&folder.UpdatedAt,
 		)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 		folders = append(folders, folder)
 	}
 	if err := rows.Err(); err != nil {
-		return nil, err
+		return nil, "", err
+	}
+
+	folders, next := nextCursor(folders, &opts.ListOptions,
+		func(f *Folder) int { return f.ID },
+		func(f *Folder) string { return f.sortValue(opts.SortBy) },
+	)
+	return folders, next, nil
+}
+
+// sortValue returns the folder's value for the given sort field, as stored in a cursor.
+func (f *Folder) sortValue(sortBy string) string {
+	switch sortBy {
+	case SortByUpdatedAt:
+		return f.UpdatedAt
+	case SortByTitle:
+		return f.Title
+	default:
+		return f.CreatedAt
 	}
-	return folders, nil
 }
@@ -0,0 +1,128 @@
+package store
+
+// FolderTreeNode is a folder with its subfolders nested under it.
+// NoteCount counts the notes directly in the folder; TotalNoteCount includes every subfolder too.
+type FolderTreeNode struct {
+	ID             int               `json:"id"`
+	Title          string            `json:"title"`
+	IsFavorite     bool              `json:"is_favorite"`
+	ParentFolderID *int              `json:"parent_folder_id"`
+	NoteCount      int               `json:"note_count"`
+	TotalNoteCount int               `json:"total_note_count"`
+	Children       []*FolderTreeNode `json:"children"`
+}
+
+// Breadcrumb is one step on the path from a root folder down to a given folder.
+type Breadcrumb struct {
+	ID    int    `json:"id"`
+	Title string `json:"title"`
+}
+
+// Guards the recursive queries against runaway recursion if a cycle ever slips into the data
+const maxFolderDepth = 100
+
+// GetFolderTree returns the user's folders as a forest of root folders with their children nested inside.
+func (pg *PostgresFolderStore) GetFolderTree(userID int) ([]*FolderTreeNode, error) {
+	// Walk down from the root folders. Ordering by depth guarantees parents are read before their children.
+	query := `
+		WITH RECURSIVE tree AS (
+			SELECT id, title, is_favorite, parent_folder_id, 0 AS depth
+			FROM folders
+			WHERE user_id = $1 AND parent_folder_id IS NULL AND deleted_at IS NULL
+			UNION ALL
+			SELECT f.id, f.title, f.is_favorite, f.parent_folder_id, t.depth + 1
+			FROM folders f
+			INNER JOIN tree t ON f.parent_folder_id = t.id
+			WHERE f.deleted_at IS NULL AND t.depth < $2
+		)
+		SELECT t.id, t.title, t.is_favorite, t.parent_folder_id,
+		       (SELECT COUNT(*) FROM notes n WHERE n.folder_id = t.id AND n.deleted_at IS NULL)
+		FROM tree t
+		ORDER BY t.depth, t.title, t.id
+	`
+	rows, err := pg.db.Query(query, userID, maxFolderDepth)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roots := []*FolderTreeNode{}
+	nodes := map[int]*FolderTreeNode{}
+	var ordered []*FolderTreeNode
+	for rows.Next() {
+		node := &FolderTreeNode{Children: []*FolderTreeNode{}}
+		err := rows.Scan(
+			&node.ID,
+			&node.Title,
+			&node.IsFavorite,
+			&node.ParentFolderID,
+			&node.NoteCount,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		nodes[node.ID] = node
+		ordered = append(ordered, node)
+		if node.ParentFolderID == nil {
+			roots = append(roots, node)
+		} else if parent, ok := nodes[*node.ParentFolderID]; ok {
+			parent.Children = append(parent.Children, node)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Roll note counts up the tree, deepest folders first
+	for i := len(ordered) - 1; i >= 0; i-- {
+		node := ordered[i]
+		node.TotalNoteCount += node.NoteCount
+		if node.ParentFolderID != nil {
+			if parent, ok := nodes[*node.ParentFolderID]; ok {
+				parent.TotalNoteCount += node.TotalNoteCount
+			}
+		}
+	}
+
+	return roots, nil
+}
+
+// GetFolderPath returns the breadcrumbs from the root folder down to (and including) the given folder.
+// Returns nil if the folder does not exist or is in the trash.
+func (pg *PostgresFolderStore) GetFolderPath(id int) ([]*Breadcrumb, error) {
+	// Walk up through the parents, then flip the order so the root comes first
+	query := `
+		WITH RECURSIVE path AS (
+			SELECT id, title, parent_folder_id, 0 AS depth
+			FROM folders
+			WHERE id = $1 AND deleted_at IS NULL
+			UNION ALL
+			SELECT f.id, f.title, f.parent_folder_id, p.depth + 1
+			FROM folders f
+			INNER JOIN path p ON f.id = p.parent_folder_id
+			WHERE p.depth < $2
+		)
+		SELECT id, title
+		FROM path
+		ORDER BY depth DESC
+	`
+	rows, err := pg.db.Query(query, id, maxFolderDepth)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var path []*Breadcrumb
+	for rows.Next() {
+		crumb := &Breadcrumb{}
+		if err := rows.Scan(&crumb.ID, &crumb.Title); err != nil {
+			return nil, err
+		}
+		path = append(path, crumb)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return path, nil
+}
@@ -0,0 +1,182 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Sortable columns shared by note and folder listings
+const (
+	SortByCreatedAt = "created_at"
+	SortByUpdatedAt = "updated_at"
+	SortByTitle     = "title"
+)
+
+// Page size limits
+const (
+	DefaultListLimit = 50
+	MaxListLimit     = 200
+)
+
+// ErrInvalidCursor is returned when a cursor cannot be decoded or was issued for a different sort order.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ListOptions holds the pagination, sorting and filtering shared by note and folder listings.
+// Zero values mean "no filter"; an empty SortBy sorts by created_at.
+type ListOptions struct {
+	UserID   int
+	Limit    int
+	Cursor   string
+	SortBy   string
+	SortDesc bool
+
+	IsFavorite    *bool
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	UpdatedAfter  *time.Time
+	UpdatedBefore *time.Time
+}
+
+// NoteListOptions adds note-specific filters to ListOptions.
+type NoteListOptions struct {
+	ListOptions
+	FolderID  *int // only notes in this folder
+	NoFolder  bool // only notes that are not in any folder
+	TagFilter TagFilter
+}
+
+// FolderListOptions adds folder-specific filters to ListOptions.
+type FolderListOptions struct {
+	ListOptions
+	ParentFolderID *int // only direct children of this folder
+	RootOnly       bool // only top-level folders
+}
+
+// cursor is the decoded form of the opaque pagination cursor: the sort key and ID of the last row on the previous page.
+// SortBy and SortDesc are kept so a cursor cannot be replayed against a different ordering.
+type cursor struct {
+	SortBy   string `json:"s"`
+	SortDesc bool   `json:"d"`
+	Value    string `json:"v"`
+	ID       int    `json:"i"`
+}
+
+func encodeCursor(c cursor) string {
+	js, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(js)
+}
+
+func decodeCursor(s string) (*cursor, error) {
+	js, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	c := &cursor{}
+	if err := json.Unmarshal(js, c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+// queryBuilder collects WHERE conditions and their positional arguments.
+type queryBuilder struct {
+	conditions []string
+	args       []any
+}
+
+// arg adds a query argument and returns its placeholder ($1, $2, ...).
+func (qb *queryBuilder) arg(value any) string {
+	qb.args = append(qb.args, value)
+	return fmt.Sprintf("$%d", len(qb.args))
+}
+
+func (qb *queryBuilder) where(condition string) {
+	qb.conditions = append(qb.conditions, condition)
+}
+
+func (qb *queryBuilder) whereClause() string {
+	return "WHERE " + strings.Join(qb.conditions, " AND ")
+}
+
+// applyListOptions adds the shared filters, the cursor condition and returns the ORDER BY/LIMIT clause.
+// alias is the table alias used in the query. The query fetches one extra row so the caller can tell whether
+// there is a next page.
+func (qb *queryBuilder) applyListOptions(alias string, opts *ListOptions) (string, error) {
+	if opts.SortBy == "" {
+		opts.SortBy = SortByCreatedAt
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = DefaultListLimit
+	}
+	if opts.Limit > MaxListLimit {
+		opts.Limit = MaxListLimit
+	}
+
+	var sortColumn, sortCast string
+	switch opts.SortBy {
+	case SortByCreatedAt, SortByUpdatedAt:
+		sortColumn, sortCast = alias+"."+opts.SortBy, "timestamptz"
+	case SortByTitle:
+		sortColumn, sortCast = alias+".title", "text"
+	default:
+		return "", fmt.Errorf("unsupported sort field %q", opts.SortBy)
+	}
+
+	qb.where(alias + ".user_id = " + qb.arg(opts.UserID))
+	if opts.IsFavorite != nil {
+		qb.where(alias + ".is_favorite = " + qb.arg(*opts.IsFavorite))
+	}
+	if opts.CreatedAfter != nil {
+		qb.where(alias + ".created_at >= " + qb.arg(*opts.CreatedAfter))
+	}
+	if opts.CreatedBefore != nil {
+		qb.where(alias + ".created_at < " + qb.arg(*opts.CreatedBefore))
+	}
+	if opts.UpdatedAfter != nil {
+		qb.where(alias + ".updated_at >= " + qb.arg(*opts.UpdatedAfter))
+	}
+	if opts.UpdatedBefore != nil {
+		qb.where(alias + ".updated_at < " + qb.arg(*opts.UpdatedBefore))
+	}
+
+	direction, comparison := "ASC", ">"
+	if opts.SortDesc {
+		direction, comparison = "DESC", "<"
+	}
+
+	// Keyset pagination: continue strictly after the last (sort value, id) pair of the previous page
+	if opts.Cursor != "" {
+		c, err := decodeCursor(opts.Cursor)
+		if err != nil {
+			return "", err
+		}
+		if c.SortBy != opts.SortBy || c.SortDesc != opts.SortDesc {
+			return "", ErrInvalidCursor
+		}
+		qb.where(fmt.Sprintf("(%s, %s.id) %s (%s::%s, %s)",
+			sortColumn, alias, comparison, qb.arg(c.Value), sortCast, qb.arg(c.ID)))
+	}
+
+	return fmt.Sprintf("ORDER BY %s %s, %s.id %s LIMIT %s",
+		sortColumn, direction, alias, direction, qb.arg(opts.Limit+1)), nil
+}
+
+// nextCursor returns the cursor pointing after the last row when a full page plus one was fetched, or "".
+// sortValue extracts the sort key from a row.
+func nextCursor[T any](rows []T, opts *ListOptions, id func(T) int, sortValue func(T) string) ([]T, string) {
+	if len(rows) <= opts.Limit {
+		return rows, ""
+	}
+	rows = rows[:opts.Limit]
+	last := rows[len(rows)-1]
+	return rows, encodeCursor(cursor{
+		SortBy:   opts.SortBy,
+		SortDesc: opts.SortDesc,
+		Value:    sortValue(last),
+		ID:       id(last),
+	})
+}
@@ -0,0 +1,150 @@
+package store
+
+import (
+	"database/sql"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// NoteRevision is a snapshot of a note's title and content before it was changed.
+type NoteRevision struct {
+	ID        int    `json:"id"`
+	NoteID    int    `json:"note_id"`
+	Revision  int    `json:"revision"`
+	Title     string `json:"title"`
+	Content   string `json:"content"`
+	CreatedAt string `json:"created_at"`
+}
+
+// snapshotNote stores the note's current title and content as its next revision.
+// It runs inside the caller's transaction so the snapshot and the overwrite succeed or fail together.
+func snapshotNote(tx *sql.Tx, noteID int) error {
+	// Lock the note until the transaction ends, so concurrent updates take turns and never compute the same revision number
+	_, err := tx.Exec(`SELECT id FROM notes WHERE id = $1 FOR UPDATE`, noteID)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO note_revisions (note_id, revision, title, content, created_at)
+		SELECT n.id,
+		       COALESCE((SELECT MAX(revision) FROM note_revisions WHERE note_id = n.id), 0) + 1,
+		       n.title,
+		       n.content,
+		       NOW()
+		FROM notes n
+		WHERE n.id = $1
+	`
+	_, err = tx.Exec(query, noteID)
+	return err
+}
+
+func (pg *PostgresNoteStore) ListNoteRevisions(noteID int) ([]*NoteRevision, error) {
+	query := `
+		SELECT id, note_id, revision, title, content, created_at
+		FROM note_revisions
+		WHERE note_id = $1
+		ORDER BY revision DESC
+	`
+	rows, err := pg.db.Query(query, noteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []*NoteRevision
+	for rows.Next() {
+		revision := &NoteRevision{}
+		err := rows.Scan(
+			&revision.ID,
+			&revision.NoteID,
+			&revision.Revision,
+			&revision.Title,
+			&revision.Content,
+			&revision.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
+
+func (pg *PostgresNoteStore) GetNoteRevision(noteID, revisionNumber int) (*NoteRevision, error) {
+	revision := &NoteRevision{}
+	query := `
+		SELECT id, note_id, revision, title, content, created_at
+		FROM note_revisions
+		WHERE note_id = $1 AND revision = $2
+	`
+	err := pg.db.QueryRow(query, noteID, revisionNumber).Scan(
+		&revision.ID,
+		&revision.NoteID,
+		&revision.Revision,
+		&revision.Title,
+		&revision.Content,
+		&revision.CreatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil // Revision not found
+	}
+	if err != nil {
+		return nil, err
+	}
+	return revision, nil
+}
+
+// RestoreNoteRevision puts a revision's title and content back on the note.
+// The current version is snapshotted first, so a restore can itself be undone.
+func (pg *PostgresNoteStore) RestoreNoteRevision(noteID, revisionNumber int) (*Note, error) {
+
+	// Transaction
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	err = snapshotNote(tx, noteID)
+	if err != nil {
+		return nil, err
+	}
+
+	note := &Note{}
+	query := `
+		UPDATE notes n
+		SET title = r.title,
+		    content = r.content,
+		    updated_at = NOW()
+		FROM note_revisions r
+		WHERE n.id = $1 AND n.deleted_at IS NULL AND r.note_id = n.id AND r.revision = $2
+		RETURNING n.id, n.title, n.content, n.user_id, n.is_favorite, n.folder_id, ` + noteTagsColumn + `, n.created_at, n.updated_at
+	`
+	typeMap := pgtype.NewMap()
+	err = tx.QueryRow(query, noteID, revisionNumber).Scan(
+		&note.ID,
+		&note.Title,
+		&note.Content,
+		&note.UserID,
+		&note.IsFavorite,
+		&note.FolderID,
+		typeMap.SQLScanner(&note.Tags),
+		&note.CreatedAt,
+		&note.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil // Note or revision not found
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return note, nil
+}
@@ -2,21 +2,61 @@ package store
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"html"
+	"strings"
+	"unicode"
+
+	"github.com/jackc/pgx/v5/pgtype"
 )
 
 type Note struct {
-	ID         int    `json:"id"`
-	Title      string `json:"title"`
-	Content    string `json:"content"`
-	UserID     int    `json:"user_id"`
-	IsFavorite bool   `json:"is_favorite"`
-	FolderID   *int   `json:"folder_id"` // can be null:
+	ID         int      `json:"id"`
+	Title      string   `json:"title"`
+	Content    string   `json:"content"`
+	UserID     int      `json:"user_id"`
+	IsFavorite bool     `json:"is_favorite"`
+	FolderID   *int     `json:"folder_id"` // can be null:
+	Tags       []string `json:"tags"`
+
+	CreatedAt string  `json:"created_at"`
+	UpdatedAt string  `json:"updated_at"`
+	DeletedAt *string `json:"deleted_at,omitempty"` // only set on notes in the trash
+}
+
+// NoteSearchResult is a single full-text search hit. Content is replaced by a highlighted snippet.
+type NoteSearchResult struct {
+	ID         int     `json:"id"`
+	Title      string  `json:"title"`
+	Snippet    string  `json:"snippet"`
+	Rank       float64 `json:"rank"`
+	UserID     int     `json:"user_id"`
+	IsFavorite bool    `json:"is_favorite"`
+	FolderID   *int    `json:"folder_id"`
 
 	CreatedAt string `json:"created_at"`
 	UpdatedAt string `json:"updated_at"`
 }
 
+// TagFilter narrows a note listing down to notes carrying the given tag names.
+// With MatchAll a note needs every tag, otherwise any one of them is enough. An empty filter matches everything.
+type TagFilter struct {
+	Names    []string
+	MatchAll bool
+}
+
+// noteTagsColumn selects a note's tag names as a sorted text array. Expects the notes table to be aliased as n.
+const noteTagsColumn = `COALESCE((
+			SELECT array_agg(t.name ORDER BY t.name)
+			FROM note_tags nt
+			INNER JOIN tags t ON t.id = nt.tag_id
+			WHERE nt.note_id = n.id
+		), '{}')`
+
+// ErrEmptySearchQuery is returned when a search query has no searchable words in it.
+var ErrEmptySearchQuery = errors.New("search query has no searchable terms")
+
 type PostgresNoteStore struct {
 	db *sql.DB
 }
@@ -32,7 +72,11 @@ type NoteStore interface {
 	UpdateNote(*Note) error
 	DeleteNote(id int) error
 	GetNoteOwner(id int) (int, error)
-	ListNotesByUserID(userID int) ([]*Note, error)
+	ListNotesByUserID(opts NoteListOptions) ([]*Note, string, error)
+	SearchNotes(userID int, query string, limit int) ([]*NoteSearchResult, error)
+	ListNoteRevisions(noteID int) ([]*NoteRevision, error)
+	GetNoteRevision(noteID, revision int) (*NoteRevision, error)
+	RestoreNoteRevision(noteID, revision int) (*Note, error)
 }
 
 // CRUD operations:
@@ -62,6 +106,7 @@ func (pg *PostgresNoteStore) CreateNote(note *Note) (*Note, error) {
 		return nil, err
 	}
 
+	note.Tags = []string{} // new notes start without tags
 	return note, nil
 }
 
@@ -69,10 +114,11 @@ func (pg *PostgresNoteStore) GetNoteByID(id int) (*Note, error) {
 	// Create a note instance first:
 	note := &Note{}
 	query := `
-		SELECT id, title, content, user_id, is_favorite, folder_id, created_at, updated_at
-		FROM notes	
-		WHERE id = $1 
+		SELECT n.id, n.title, n.content, n.user_id, n.is_favorite, n.folder_id, ` + noteTagsColumn + `, n.created_at, n.updated_at
+		FROM notes n
+		WHERE n.id = $1 AND n.deleted_at IS NULL
 	`
+	typeMap := pgtype.NewMap()
 	err := pg.db.QueryRow(query, id).Scan(
 		&note.ID,
 		&note.Title,
@@ -80,6 +126,7 @@ func (pg *PostgresNoteStore) GetNoteByID(id int) (*Note, error) {
 		&note.UserID,
 		&note.IsFavorite,
 		&note.FolderID,
+		typeMap.SQLScanner(&note.Tags),
 		&note.CreatedAt,
 		&note.UpdatedAt,
 	)
@@ -99,6 +146,12 @@ func (pg *PostgresNoteStore) UpdateNote(note *Note) error {
 	}
 	defer tx.Rollback()
 
+	// Keep the previous version around before overwriting it
+	err = snapshotNote(tx, note.ID)
+	if err != nil {
+		return err
+	}
+
 	query := `
 		UPDATE notes
 		SET title = $1,
@@ -106,7 +159,7 @@ func (pg *PostgresNoteStore) UpdateNote(note *Note) error {
 		    is_favorite = $3,
 		    folder_id = $4,
 		    updated_at = NOW()
-		WHERE id = $5
+		WHERE id = $5 AND deleted_at IS NULL
 	`
 	_, err = tx.Exec(query, note.Title, note.Content, note.IsFavorite, note.FolderID, note.ID)
 	if err != nil {
@@ -121,9 +174,11 @@ func (pg *PostgresNoteStore) UpdateNote(note *Note) error {
 
 func (pg *PostgresNoteStore) DeleteNote(id int) error {
 
+	// Soft delete: the note goes to the trash and is purged later
 	query := `
-		DELETE FROM notes
-		WHERE id = $1
+		UPDATE notes
+		SET deleted_at = NOW()
+		WHERE id = $1 AND deleted_at IS NULL
 	`
 	res, err := pg.db.Exec(query, id)
 	if err != nil {
@@ -145,31 +200,60 @@ func (pg *PostgresNoteStore) GetNoteOwner(id int) (int, error) {
 	query := `
 		SELECT user_id
 		FROM notes
-		WHERE id = $1
+		WHERE id = $1 AND deleted_at IS NULL
 	`
 	err := pg.db.QueryRow(query, id).Scan(&userID)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return 0, fmt.Errorf("no note found with id %d", id)
+			return 0, fmt.Errorf("no note found with id %d: %w", id, err)
 		}
 		return 0, err
 	}
 	return userID, nil
 }
 
-func (pg *PostgresNoteStore) ListNotesByUserID(userID int) ([]*Note, error) {
+// ListNotesByUserID returns one page of the user's notes and the cursor for the next page ("" on the last page).
+func (pg *PostgresNoteStore) ListNotesByUserID(opts NoteListOptions) ([]*Note, string, error) {
+	qb := &queryBuilder{}
+	orderBy, err := qb.applyListOptions("n", &opts.ListOptions)
+	if err != nil {
+		return nil, "", err
+	}
+	qb.where("n.deleted_at IS NULL")
+
+	if opts.NoFolder {
+		qb.where("n.folder_id IS NULL")
+	} else if opts.FolderID != nil {
+		qb.where("n.folder_id = " + qb.arg(*opts.FolderID))
+	}
+
+	// Tag filtering: "any" needs one matching tag, "all" needs as many distinct matches as there are names
+	if len(opts.TagFilter.Names) > 0 {
+		tagMatches := `(
+			SELECT COUNT(DISTINCT t.name)
+			FROM note_tags nt
+			INNER JOIN tags t ON t.id = nt.tag_id
+			WHERE nt.note_id = n.id AND t.name = ANY(` + qb.arg(opts.TagFilter.Names) + `)
+		)`
+		if opts.TagFilter.MatchAll {
+			qb.where(tagMatches + " = " + qb.arg(len(opts.TagFilter.Names)))
+		} else {
+			qb.where(tagMatches + " > 0")
+		}
+	}
+
 	query := `
-		SELECT id, title, content, user_id, is_favorite, folder_id, created_at, updated_at
-		FROM notes
-		WHERE user_id = $1
-		ORDER BY created_at DESC
-	`
-	rows, err := pg.db.Query(query, userID)
+		SELECT n.id, n.title, n.content, n.user_id, n.is_favorite, n.folder_id, ` + noteTagsColumn + `, n.created_at, n.updated_at
+		FROM notes n
+		` + qb.whereClause() + `
+		` + orderBy
+	rows, err := pg.db.Query(query, qb.args...)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	defer rows.Close()
 
+	typeMap := pgtype.NewMap()
 	var notes []*Note
 	for rows.Next() {
 		note := &Note{}
@@ -180,16 +264,170 @@ func (pg *PostgresNoteStore) ListNotesByUserID(userID int) ([]*Note, error) {
 			&note.UserID,
 			&note.IsFavorite,
 			&note.FolderID,
+			typeMap.SQLScanner(&note.Tags),
 			&note.CreatedAt,
 			&note.UpdatedAt,
 		)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 		notes = append(notes, note)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	notes, next := nextCursor(notes, &opts.ListOptions,
+		func(n *Note) int { return n.ID },
+		func(n *Note) string { return n.sortValue(opts.SortBy) },
+	)
+	return notes, next, nil
+}
+
+// sortValue returns the note's value for the given sort field, as stored in a cursor.
+func (n *Note) sortValue(sortBy string) string {
+	switch sortBy {
+	case SortByUpdatedAt:
+		return n.UpdatedAt
+	case SortByTitle:
+		return n.Title
+	default:
+		return n.CreatedAt
+	}
+}
+
+// Full-text search:
+
+// SearchNotes runs a ranked full-text search over the notes owned by userID.
+// The query supports plain words (all must match), "quoted phrases" and prefix terms ending in *.
+func (pg *PostgresNoteStore) SearchNotes(userID int, query string, limit int) ([]*NoteSearchResult, error) {
+	tsQuery := buildTSQuery(query)
+	if tsQuery == "" {
+		return nil, ErrEmptySearchQuery
+	}
+
+	// ts_headline wraps matches in sentinels, swapped for <mark> tags once the rest is escaped (see highlightSnippet)
+	sqlQuery := `
+		SELECT id, title,
+		       ts_headline('english', content, q, $4),
+		       ts_rank(search_vector, q) AS rank,
+		       user_id, is_favorite, folder_id, created_at, updated_at
+		FROM notes, to_tsquery('english', $2) q
+		WHERE user_id = $1 AND deleted_at IS NULL AND search_vector @@ q
+		ORDER BY rank DESC, updated_at DESC
+		LIMIT $3
+	`
+	rows, err := pg.db.Query(sqlQuery, userID, tsQuery, limit, headlineOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []*NoteSearchResult
+	for rows.Next() {
+		result := &NoteSearchResult{}
+		err := rows.Scan(
+			&result.ID,
+			&result.Title,
+			&result.Snippet,
+			&result.Rank,
+			&result.UserID,
+			&result.IsFavorite,
+			&result.FolderID,
+			&result.CreatedAt,
+			&result.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		result.Snippet = highlightSnippet(result.Snippet)
+		results = append(results, result)
+	}
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
-	return notes, nil
+	return results, nil
+}
+
+// Put around matches by ts_headline. They are private use characters, which nothing in a note should contain.
+const (
+	headlineStart = "\uE000"
+	headlineStop  = "\uE001"
+)
+
+var headlineOptions = fmt.Sprintf(`StartSel="%s", StopSel="%s", MaxFragments=2, MaxWords=30, MinWords=10`, headlineStart, headlineStop)
+
+var headlineReplacer = strings.NewReplacer(headlineStart, "<mark>", headlineStop, "</mark>")
+
+// highlightSnippet escapes a ts_headline snippet, which is an excerpt of the raw content and can hold any HTML,
+// then turns its sentinels into <mark> tags, so the snippet is safe to render with only the matches highlighted.
+func highlightSnippet(headline string) string {
+	return headlineReplacer.Replace(html.EscapeString(headline))
+}
+
+// buildTSQuery turns user input into a to_tsquery expression.
+// Words are AND-ed together, "quoted phrases" use the followed-by operator (<->),
+// and a trailing * turns a word into a prefix match (:*).
+// Anything that is not a letter or digit is dropped, so the result is always valid tsquery syntax.
+func buildTSQuery(input string) string {
+	var terms []string
+
+	rest := strings.TrimSpace(input)
+	for rest != "" {
+		var chunk string
+
+		if rest[0] == '"' {
+			// Phrase: read until the closing quote (or the end of the input)
+			end := strings.IndexByte(rest[1:], '"')
+			if end == -1 {
+				chunk, rest = rest[1:], ""
+			} else {
+				chunk, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			end := strings.IndexFunc(rest, unicode.IsSpace)
+			if end == -1 {
+				chunk, rest = rest, ""
+			} else {
+				chunk, rest = rest[:end], rest[end:]
+			}
+		}
+		rest = strings.TrimSpace(rest)
+
+		if term := phraseToTSQuery(chunk); term != "" {
+			terms = append(terms, term)
+		}
+	}
+
+	return strings.Join(terms, " & ")
+}
+
+// phraseToTSQuery converts a single word or phrase into tsquery syntax.
+// A bare word with punctuation inside (e.g. "e-mail") is treated like a phrase, the same way to_tsquery would.
+func phraseToTSQuery(chunk string) string {
+	fields := strings.Fields(chunk)
+
+	var words []string
+	for _, field := range fields {
+		prefix := strings.HasSuffix(field, "*")
+		parts := strings.FieldsFunc(field, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for i, part := range parts {
+			word := strings.ToLower(part)
+			if prefix && i == len(parts)-1 {
+				word += ":*"
+			}
+			words = append(words, word)
+		}
+	}
+
+	switch len(words) {
+	case 0:
+		return ""
+	case 1:
+		return words[0]
+	default:
+		return "(" + strings.Join(words, " <-> ") + ")"
+	}
 }
@@ -0,0 +1,214 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/tokens"
+)
+
+// PublicLink is a read-only link to a note that works without an account.
+// Password, ExpiresAt and MaxViews are all optional.
+type PublicLink struct {
+	ID          int        `json:"id"`
+	NoteID      int        `json:"note_id"`
+	UserID      int        `json:"user_id"`
+	Slug        string     `json:"slug,omitempty"` // plaintext, only known right after creation
+	SlugHash    []byte     `json:"-"`
+	Password    password   `json:"-"`
+	HasPassword bool       `json:"has_password"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	MaxViews    *int       `json:"max_views"`
+	ViewCount   int        `json:"view_count"`
+	RevokedAt   *time.Time `json:"revoked_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// IsActive reports whether the link can still be used: not revoked, not expired and not out of views.
+func (l *PublicLink) IsActive(now time.Time) bool {
+	if l.RevokedAt != nil {
+		return false
+	}
+	if l.ExpiresAt != nil && !now.Before(*l.ExpiresAt) {
+		return false
+	}
+	if l.MaxViews != nil && l.ViewCount >= *l.MaxViews {
+		return false
+	}
+	return true
+}
+
+type PostgresPublicLinkStore struct {
+	db         *sql.DB
+	bcryptCost int // cost of the link password hashes
+}
+
+func NewPostgresPublicLinkStore(db *sql.DB, bcryptCost int) *PostgresPublicLinkStore {
+	return &PostgresPublicLinkStore{db: db, bcryptCost: bcryptCost}
+}
+
+// Interface for PublicLinkStore to allow decoupling and easier testing:
+type PublicLinkStore interface {
+	CreatePublicLink(*PublicLink) (*PublicLink, error)
+	GetPublicLinkByID(id int) (*PublicLink, error)
+	GetPublicLinkBySlug(slug string) (*PublicLink, error)
+	ListPublicLinksForNote(noteID int) ([]*PublicLink, error)
+	RevokePublicLink(id int) error
+	RecordView(id int) (bool, error)
+}
+
+// CreatePublicLink generates a new slug and stores the link. The plaintext slug is set on the returned link.
+func (pg *PostgresPublicLinkStore) CreatePublicLink(link *PublicLink) (*PublicLink, error) {
+	slug, slugHash, err := tokens.GenerateSlug()
+	if err != nil {
+		return nil, err
+	}
+	link.Slug = slug
+	link.SlugHash = slugHash
+	err = link.Password.hashWith(pg.bcryptCost)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO public_links (note_id, user_id, slug_hash, password_hash, expires_at, max_views, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NOW())
+		RETURNING id, created_at
+	`
+	err = pg.db.QueryRow(query,
+		link.NoteID,
+		link.UserID,
+		link.SlugHash,
+		link.Password.hash, // nil (NULL) when the link has no password
+		link.ExpiresAt,
+		link.MaxViews,
+	).Scan(&link.ID, &link.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	link.HasPassword = link.Password.hash != nil
+	return link, nil
+}
+
+const publicLinkColumns = `id, note_id, user_id, slug_hash, password_hash, expires_at, max_views, view_count, revoked_at, created_at`
+
+func scanPublicLink(row interface{ Scan(...any) error }) (*PublicLink, error) {
+	link := &PublicLink{
+		Password: password{},
+	}
+	err := row.Scan(
+		&link.ID,
+		&link.NoteID,
+		&link.UserID,
+		&link.SlugHash,
+		&link.Password.hash,
+		&link.ExpiresAt,
+		&link.MaxViews,
+		&link.ViewCount,
+		&link.RevokedAt,
+		&link.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	link.HasPassword = link.Password.hash != nil
+	return link, nil
+}
+
+func (pg *PostgresPublicLinkStore) GetPublicLinkByID(id int) (*PublicLink, error) {
+	query := `
+		SELECT ` + publicLinkColumns + `
+		FROM public_links
+		WHERE id = $1
+	`
+	link, err := scanPublicLink(pg.db.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, nil // Link not found
+	}
+	return link, err
+}
+
+// GetPublicLinkBySlug looks a link up by the plaintext slug from the URL.
+func (pg *PostgresPublicLinkStore) GetPublicLinkBySlug(slug string) (*PublicLink, error) {
+	query := `
+		SELECT ` + publicLinkColumns + `
+		FROM public_links
+		WHERE slug_hash = $1
+	`
+	link, err := scanPublicLink(pg.db.QueryRow(query, tokens.Hash(slug)))
+	if err == sql.ErrNoRows {
+		return nil, nil // Link not found
+	}
+	return link, err
+}
+
+func (pg *PostgresPublicLinkStore) ListPublicLinksForNote(noteID int) ([]*PublicLink, error) {
+	query := `
+		SELECT ` + publicLinkColumns + `
+		FROM public_links
+		WHERE note_id = $1
+		ORDER BY created_at DESC
+	`
+	rows, err := pg.db.Query(query, noteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []*PublicLink{}
+	for rows.Next() {
+		link, err := scanPublicLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+// RevokePublicLink disables a link. The row is kept so the owner can still see it in the list.
+func (pg *PostgresPublicLinkStore) RevokePublicLink(id int) error {
+	query := `
+		UPDATE public_links
+		SET revoked_at = NOW()
+		WHERE id = $1 AND revoked_at IS NULL
+	`
+	res, err := pg.db.Exec(query, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows // Link not found or already revoked
+	}
+	return nil
+}
+
+// RecordView counts one view of the link. It returns false without counting if the link stopped being usable
+// in the meantime, so concurrent requests cannot go over the view limit.
+func (pg *PostgresPublicLinkStore) RecordView(id int) (bool, error) {
+	query := `
+		UPDATE public_links
+		SET view_count = view_count + 1
+		WHERE id = $1
+		  AND revoked_at IS NULL
+		  AND (expires_at IS NULL OR expires_at > NOW())
+		  AND (max_views IS NULL OR view_count < max_views)
+	`
+	res, err := pg.db.Exec(query, id)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
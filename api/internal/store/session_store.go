@@ -0,0 +1,139 @@
+package store
+
+import (
+	"bytes"
+	"database/sql"
+	"time"
+
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/tokens"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Session is one login as shown to its owner: the access and refresh tokens it has gone through.
+// The tokens themselves are never exposed.
+type Session struct {
+	ID         string     `json:"id"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	Current    bool       `json:"current"` // the session making the request
+
+	hashes [][]byte
+}
+
+// IsToken reports whether the token with the given hash belongs to the session.
+func (s *Session) IsToken(tokenHash []byte) bool {
+	for _, hash := range s.hashes {
+		if bytes.Equal(hash, tokenHash) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListSessions returns the user's logins that still have an unexpired token, most recently used first.
+func (t *PostgresTokenStore) ListSessions(userID int) ([]*Session, error) {
+	query := `
+		SELECT session_id,
+			(array_agg(user_agent ORDER BY created_at DESC))[1],
+			(array_agg(ip ORDER BY created_at DESC))[1],
+			MIN(created_at),
+			MAX(last_used_at),
+			MAX(expiry),
+			array_agg(hash)
+		FROM tokens
+		WHERE user_id = $1 AND scope IN ($2, $3) AND expiry > NOW() AND used_at IS NULL
+		GROUP BY session_id
+		ORDER BY COALESCE(MAX(last_used_at), MIN(created_at)) DESC
+	`
+	rows, err := t.db.Query(query, userID, tokens.ScopeAuth, tokens.ScopeRefresh)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	typeMap := pgtype.NewMap()
+	sessions := []*Session{}
+	for rows.Next() {
+		session := &Session{}
+		err := rows.Scan(
+			&session.ID,
+			&session.UserAgent,
+			&session.IP,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.ExpiresAt,
+			typeMap.SQLScanner(&session.hashes),
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// DeleteSession logs one of the user's sessions out, refresh tokens included. sessionID must be a UUID.
+// Returns sql.ErrNoRows if the user has no such session.
+func (t *PostgresTokenStore) DeleteSession(userID int, sessionID string) error {
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1 AND scope IN ($2, $3) AND session_id = $4
+	`
+	result, err := t.db.Exec(query, userID, tokens.ScopeAuth, tokens.ScopeRefresh, sessionID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteOtherSessions logs the user out everywhere except the session the token with currentTokenHash belongs to.
+func (t *PostgresTokenStore) DeleteOtherSessions(userID int, currentTokenHash []byte) (int64, error) {
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1 AND scope IN ($2, $3)
+		AND session_id <> (SELECT session_id FROM tokens WHERE hash = $4)
+	`
+	result, err := t.db.Exec(query, userID, tokens.ScopeAuth, tokens.ScopeRefresh, currentTokenHash)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// DeleteAllSessions logs the user out everywhere, including logins waiting for their second factor.
+func (t *PostgresTokenStore) DeleteAllSessions(userID int) (int64, error) {
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1 AND scope IN ($2, $3, $4)
+	`
+	result, err := t.db.Exec(query, userID, tokens.ScopeAuth, tokens.ScopeRefresh, tokens.ScopeTwoFactorPending)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// TouchToken records that a token was just used. Callers should throttle it;
+// the WHERE clause also skips the write when the last update is recent.
+func (t *PostgresTokenStore) TouchToken(tokenHash []byte) error {
+	query := `
+		UPDATE tokens
+		SET last_used_at = NOW()
+		WHERE hash = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')
+	`
+	_, err := t.db.Exec(query, tokenHash)
+	return err
+}
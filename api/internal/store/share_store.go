@@ -0,0 +1,317 @@
+package store
+
+import (
+	"database/sql"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Share permission levels
+const (
+	SharePermissionViewer = "viewer"
+	SharePermissionEditor = "editor"
+)
+
+// Share gives another user access to a note or to a folder and everything inside it.
+// Exactly one of NoteID and FolderID is set.
+type Share struct {
+	ID                 int    `json:"id"`
+	OwnerID            int    `json:"owner_id"`
+	SharedWithUserID   int    `json:"shared_with_user_id"`
+	SharedWithUsername string `json:"shared_with_username"`
+	NoteID             *int   `json:"note_id"`
+	FolderID           *int   `json:"folder_id"`
+	Permission         string `json:"permission"`
+	CreatedAt          string `json:"created_at"`
+}
+
+// SharedNote is a note someone else shared with the current user, directly.
+type SharedNote struct {
+	*Note
+	Permission    string `json:"permission"`
+	OwnerUsername string `json:"owner_username"`
+}
+
+// SharedFolder is a folder someone else shared with the current user, directly.
+type SharedFolder struct {
+	*Folder
+	Permission    string `json:"permission"`
+	OwnerUsername string `json:"owner_username"`
+}
+
+type PostgresShareStore struct {
+	db *sql.DB
+}
+
+func NewPostgresShareStore(db *sql.DB) *PostgresShareStore {
+	return &PostgresShareStore{db: db}
+}
+
+// Interface for ShareStore to allow decoupling and easier testing:
+type ShareStore interface {
+	CreateShare(*Share) (*Share, error)
+	GetShareByID(id int) (*Share, error)
+	DeleteShare(id int) error
+	ListSharesForNote(noteID int) ([]*Share, error)
+	ListSharesForFolder(folderID int) ([]*Share, error)
+	ListSharedWithUser(userID int) ([]*SharedNote, []*SharedFolder, error)
+	GetNoteSharePermission(noteID, userID int) (string, error)
+	GetFolderSharePermission(folderID, userID int) (string, error)
+}
+
+// CreateShare shares a note or folder. Sharing the same item with the same user again updates the permission.
+func (pg *PostgresShareStore) CreateShare(share *Share) (*Share, error) {
+	conflictTarget := "(note_id, shared_with_user_id)"
+	if share.FolderID != nil {
+		conflictTarget = "(folder_id, shared_with_user_id)"
+	}
+
+	query := `
+		INSERT INTO note_shares (owner_id, shared_with_user_id, note_id, folder_id, permission, created_at)
+		VALUES ($1, $2, $3, $4, $5, NOW())
+		ON CONFLICT ` + conflictTarget + ` DO UPDATE SET permission = EXCLUDED.permission
+		RETURNING id, created_at
+	`
+	err := pg.db.QueryRow(query,
+		share.OwnerID,
+		share.SharedWithUserID,
+		share.NoteID,
+		share.FolderID,
+		share.Permission,
+	).Scan(&share.ID, &share.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return share, nil
+}
+
+// Columns selected for a Share, with the recipient's username joined in as u
+const shareColumns = `s.id, s.owner_id, s.shared_with_user_id, u.username, s.note_id, s.folder_id, s.permission, s.created_at`
+
+func scanShare(row interface{ Scan(...any) error }) (*Share, error) {
+	share := &Share{}
+	err := row.Scan(
+		&share.ID,
+		&share.OwnerID,
+		&share.SharedWithUserID,
+		&share.SharedWithUsername,
+		&share.NoteID,
+		&share.FolderID,
+		&share.Permission,
+		&share.CreatedAt,
+	)
+	return share, err
+}
+
+func (pg *PostgresShareStore) GetShareByID(id int) (*Share, error) {
+	query := `
+		SELECT ` + shareColumns + `
+		FROM note_shares s
+		INNER JOIN users u ON u.id = s.shared_with_user_id
+		WHERE s.id = $1
+	`
+	share, err := scanShare(pg.db.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, nil // Share not found
+	}
+	if err != nil {
+		return nil, err
+	}
+	return share, nil
+}
+
+func (pg *PostgresShareStore) DeleteShare(id int) error {
+	query := `
+		DELETE FROM note_shares
+		WHERE id = $1
+	`
+	res, err := pg.db.Exec(query, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows // Share not found
+	}
+	return nil
+}
+
+func (pg *PostgresShareStore) ListSharesForNote(noteID int) ([]*Share, error) {
+	return pg.listShares(`s.note_id = $1`, noteID)
+}
+
+func (pg *PostgresShareStore) ListSharesForFolder(folderID int) ([]*Share, error) {
+	return pg.listShares(`s.folder_id = $1`, folderID)
+}
+
+func (pg *PostgresShareStore) listShares(condition string, id int) ([]*Share, error) {
+	query := `
+		SELECT ` + shareColumns + `
+		FROM note_shares s
+		INNER JOIN users u ON u.id = s.shared_with_user_id
+		WHERE ` + condition + `
+		ORDER BY u.username
+	`
+	rows, err := pg.db.Query(query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := []*Share{}
+	for rows.Next() {
+		share, err := scanShare(rows)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return shares, nil
+}
+
+// ListSharedWithUser returns the notes and folders other users shared directly with userID.
+// Notes that are only reachable through a shared folder are not repeated here.
+func (pg *PostgresShareStore) ListSharedWithUser(userID int) ([]*SharedNote, []*SharedFolder, error) {
+	query := `
+		SELECT n.id, n.title, n.content, n.user_id, n.is_favorite, n.folder_id, ` + noteTagsColumn + `, n.created_at, n.updated_at,
+		       s.permission, u.username
+		FROM note_shares s
+		INNER JOIN notes n ON n.id = s.note_id
+		INNER JOIN users u ON u.id = n.user_id
+		WHERE s.shared_with_user_id = $1 AND n.deleted_at IS NULL
+		ORDER BY n.updated_at DESC
+	`
+	rows, err := pg.db.Query(query, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	typeMap := pgtype.NewMap()
+	notes := []*SharedNote{}
+	for rows.Next() {
+		shared := &SharedNote{Note: &Note{}}
+		err := rows.Scan(
+			&shared.ID,
+			&shared.Title,
+			&shared.Content,
+			&shared.UserID,
+			&shared.IsFavorite,
+			&shared.FolderID,
+			typeMap.SQLScanner(&shared.Tags),
+			&shared.CreatedAt,
+			&shared.UpdatedAt,
+			&shared.Permission,
+			&shared.OwnerUsername,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		notes = append(notes, shared)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	query = `
+		SELECT f.id, f.title, f.user_id, f.is_favorite, f.parent_folder_id, f.created_at, f.updated_at,
+		       s.permission, u.username
+		FROM note_shares s
+		INNER JOIN folders f ON f.id = s.folder_id
+		INNER JOIN users u ON u.id = f.user_id
+		WHERE s.shared_with_user_id = $1 AND f.deleted_at IS NULL
+		ORDER BY f.title
+	`
+	folderRows, err := pg.db.Query(query, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer folderRows.Close()
+
+	folders := []*SharedFolder{}
+	for folderRows.Next() {
+		shared := &SharedFolder{Folder: &Folder{}}
+		err := folderRows.Scan(
+			&shared.ID,
+			&shared.Title,
+			&shared.UserID,
+			&shared.IsFavorite,
+			&shared.ParentFolderID,
+			&shared.CreatedAt,
+			&shared.UpdatedAt,
+			&shared.Permission,
+			&shared.OwnerUsername,
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		folders = append(folders, shared)
+	}
+	if err := folderRows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return notes, folders, nil
+}
+
+// GetNoteSharePermission returns the strongest permission userID has on a note, either from a share on the note
+// itself or inherited from a share on any folder above it. Returns "" when the note is not shared with the user.
+func (pg *PostgresShareStore) GetNoteSharePermission(noteID, userID int) (string, error) {
+	query := `
+		WITH RECURSIVE ancestors AS (
+			SELECT folder_id AS id, 0 AS depth FROM notes WHERE id = $1 AND folder_id IS NOT NULL
+			UNION ALL
+			SELECT f.parent_folder_id, a.depth + 1
+			FROM folders f
+			INNER JOIN ancestors a ON f.id = a.id
+			WHERE f.parent_folder_id IS NOT NULL AND a.depth < $3
+		)
+		SELECT permission
+		FROM note_shares
+		WHERE shared_with_user_id = $2
+		  AND (note_id = $1 OR folder_id IN (SELECT id FROM ancestors))
+		ORDER BY CASE permission WHEN 'editor' THEN 0 ELSE 1 END
+		LIMIT 1
+	`
+	return pg.sharePermission(query, noteID, userID)
+}
+
+// GetFolderSharePermission returns the strongest permission userID has on a folder through a share on it or on
+// any folder above it. Returns "" when the folder is not shared with the user.
+func (pg *PostgresShareStore) GetFolderSharePermission(folderID, userID int) (string, error) {
+	query := `
+		WITH RECURSIVE ancestors AS (
+			SELECT $1::integer AS id, 0 AS depth
+			UNION ALL
+			SELECT f.parent_folder_id, a.depth + 1
+			FROM folders f
+			INNER JOIN ancestors a ON f.id = a.id
+			WHERE f.parent_folder_id IS NOT NULL AND a.depth < $3
+		)
+		SELECT permission
+		FROM note_shares
+		WHERE shared_with_user_id = $2
+		  AND folder_id IN (SELECT id FROM ancestors)
+		ORDER BY CASE permission WHEN 'editor' THEN 0 ELSE 1 END
+		LIMIT 1
+	`
+	return pg.sharePermission(query, folderID, userID)
+}
+
+func (pg *PostgresShareStore) sharePermission(query string, id, userID int) (string, error) {
+	var permission string
+	err := pg.db.QueryRow(query, id, userID, maxFolderDepth).Scan(&permission)
+	if err == sql.ErrNoRows {
+		return "", nil // Not shared
+	}
+	if err != nil {
+		return "", err
+	}
+	return permission, nil
+}
@@ -0,0 +1,273 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+type Tag struct {
+	ID        int    `json:"id"`
+	UserID    int    `json:"user_id"`
+	Name      string `json:"name"`
+	NoteCount int    `json:"note_count"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+// ErrTagExists is returned when a tag is created or renamed to a name the user already has.
+var ErrTagExists = errors.New("a tag with this name already exists")
+
+type PostgresTagStore struct {
+	db *sql.DB
+}
+
+func NewPostgresTagStore(db *sql.DB) *PostgresTagStore {
+	return &PostgresTagStore{db: db}
+}
+
+// Interface for TagStore to allow decoupling and easier testing:
+type TagStore interface {
+	CreateTag(*Tag) (*Tag, error)
+	GetTagByID(id int) (*Tag, error)
+	ListTagsByUserID(userID int) ([]*Tag, error)
+	RenameTag(id int, name string) error
+	DeleteTag(id int) error
+	MergeTags(sourceID, targetID int) error
+	AttachTag(noteID int, userID int, name string) (*Tag, error)
+	DetachTag(noteID, tagID int) error
+}
+
+// isUniqueViolation reports whether err is a Postgres unique constraint violation.
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+// CRUD operations:
+
+func (pg *PostgresTagStore) CreateTag(tag *Tag) (*Tag, error) {
+	query := `
+		INSERT INTO tags (user_id, name, created_at, updated_at)
+		VALUES ($1, $2, NOW(), NOW())
+		RETURNING id, created_at, updated_at
+	`
+	err := pg.db.QueryRow(query, tag.UserID, tag.Name).Scan(&tag.ID, &tag.CreatedAt, &tag.UpdatedAt)
+	if isUniqueViolation(err) {
+		return nil, ErrTagExists
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tag, nil
+}
+
+func (pg *PostgresTagStore) GetTagByID(id int) (*Tag, error) {
+	tag := &Tag{}
+	query := `
+		SELECT t.id, t.user_id, t.name,
+		       (SELECT COUNT(*) FROM note_tags nt INNER JOIN notes n ON n.id = nt.note_id WHERE nt.tag_id = t.id AND n.deleted_at IS NULL),
+		       t.created_at, t.updated_at
+		FROM tags t
+		WHERE t.id = $1
+	`
+	err := pg.db.QueryRow(query, id).Scan(
+		&tag.ID,
+		&tag.UserID,
+		&tag.Name,
+		&tag.NoteCount,
+		&tag.CreatedAt,
+		&tag.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil // Tag not found
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tag, nil
+}
+
+func (pg *PostgresTagStore) ListTagsByUserID(userID int) ([]*Tag, error) {
+	query := `
+		SELECT t.id, t.user_id, t.name,
+		       (SELECT COUNT(*) FROM note_tags nt INNER JOIN notes n ON n.id = nt.note_id WHERE nt.tag_id = t.id AND n.deleted_at IS NULL),
+		       t.created_at, t.updated_at
+		FROM tags t
+		WHERE t.user_id = $1
+		ORDER BY t.name ASC
+	`
+	rows, err := pg.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []*Tag
+	for rows.Next() {
+		tag := &Tag{}
+		err := rows.Scan(
+			&tag.ID,
+			&tag.UserID,
+			&tag.Name,
+			&tag.NoteCount,
+			&tag.CreatedAt,
+			&tag.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// RenameTag changes a tag's name. Notes reference tags by ID, so every tagged note picks up the new name.
+func (pg *PostgresTagStore) RenameTag(id int, name string) error {
+	query := `
+		UPDATE tags
+		SET name = $1, updated_at = NOW()
+		WHERE id = $2
+	`
+	res, err := pg.db.Exec(query, name, id)
+	if isUniqueViolation(err) {
+		return ErrTagExists
+	}
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows // Tag not found
+	}
+	return nil
+}
+
+func (pg *PostgresTagStore) DeleteTag(id int) error {
+	query := `
+		DELETE FROM tags
+		WHERE id = $1
+	`
+	res, err := pg.db.Exec(query, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows // Tag not found
+	}
+	return nil
+}
+
+// MergeTags moves every note tagged with sourceID over to targetID, then deletes the source tag.
+func (pg *PostgresTagStore) MergeTags(sourceID, targetID int) error {
+
+	// Transaction
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO note_tags (note_id, tag_id)
+		SELECT note_id, $2
+		FROM note_tags
+		WHERE tag_id = $1
+		ON CONFLICT DO NOTHING
+	`
+	_, err = tx.Exec(query, sourceID, targetID)
+	if err != nil {
+		return err
+	}
+
+	// note_tags rows for the source go with it (ON DELETE CASCADE)
+	query = `
+		DELETE FROM tags
+		WHERE id = $1
+	`
+	_, err = tx.Exec(query, sourceID)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		UPDATE tags
+		SET updated_at = NOW()
+		WHERE id = $1
+	`
+	_, err = tx.Exec(query, targetID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// AttachTag tags a note by name, creating the user's tag first if it does not exist yet.
+func (pg *PostgresTagStore) AttachTag(noteID int, userID int, name string) (*Tag, error) {
+
+	// Transaction
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// The no-op update makes RETURNING work when the tag already exists
+	tag := &Tag{}
+	query := `
+		INSERT INTO tags (user_id, name, created_at, updated_at)
+		VALUES ($1, $2, NOW(), NOW())
+		ON CONFLICT (user_id, name) DO UPDATE SET name = EXCLUDED.name
+		RETURNING id, user_id, name, created_at, updated_at
+	`
+	err = tx.QueryRow(query, userID, name).Scan(&tag.ID, &tag.UserID, &tag.Name, &tag.CreatedAt, &tag.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+		INSERT INTO note_tags (note_id, tag_id)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING
+	`
+	_, err = tx.Exec(query, noteID, tag.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return tag, nil
+}
+
+func (pg *PostgresTagStore) DetachTag(noteID, tagID int) error {
+	query := `
+		DELETE FROM note_tags
+		WHERE note_id = $1 AND tag_id = $2
+	`
+	res, err := pg.db.Exec(query, noteID, tagID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows // Tag was not on the note
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package store
 
 import (
 	"database/sql"
+	"errors"
 	"time"
 
 	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/tokens"
@@ -20,9 +21,20 @@ type TokenStore interface {
 	Insert(token *tokens.Token) error
 	CreateNewToken(userID int, ttl time.Duration, scope string) (*tokens.Token, error)
 	DeleteAllTokensForUser(scope string, userID int) error
-	RevokeToken(tokenHash string) error
+	RevokeToken(tokenHash []byte) error
+	ListSessions(userID int) ([]*Session, error)
+	DeleteSession(userID int, sessionID string) error
+	DeleteOtherSessions(userID int, currentTokenHash []byte) (int64, error)
+	DeleteAllSessions(userID int) (int64, error)
+	TouchToken(tokenHash []byte) error
+	RotateRefreshToken(plaintext string, accessTTL, refreshTTL time.Duration) (*tokens.Token, *tokens.Token, error)
+	DeleteExpiredTokens() (int64, error)
 }
 
+// ErrRefreshTokenReused is returned when a refresh token that was already rotated is presented again.
+// The whole login it belonged to has been revoked by then, since the token has probably been stolen.
+var ErrRefreshTokenReused = errors.New("refresh token has already been used")
+
 // Insert a new token into the database
 func (t *PostgresTokenStore) CreateNewToken(userID int, ttl time.Duration, scope string) (*tokens.Token, error) {
 	token, err := tokens.GenerateToken(userID, ttl, scope)
@@ -36,10 +48,10 @@ func (t *PostgresTokenStore) CreateNewToken(userID int, ttl time.Duration, scope
 
 func (t *PostgresTokenStore) Insert(token *tokens.Token) error {
 	query := `
-		INSERT INTO tokens (hash, user_id, expiry, scope)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO tokens (hash, user_id, expiry, scope, user_agent, ip, session_id)
+		VALUES ($1, $2, $3, $4, $5, $6, COALESCE($7::uuid, gen_random_uuid()))
 	`
-	_, err := t.db.Exec(query, token.Hash, token.UserID, token.Expiry, token.Scope)
+	_, err := t.db.Exec(query, token.Hash, token.UserID, token.Expiry, token.Scope, token.UserAgent, token.IP, sql.NullString{String: token.SessionID, Valid: token.SessionID != ""})
 	return err
 }
 
@@ -53,12 +65,138 @@ func (t *PostgresTokenStore) DeleteAllTokensForUser(scope string, userID int) er
 }
 
 // Logging out:
-// RevokeToken
-func (t *PostgresTokenStore) RevokeToken(tokenHash string) error {
+// RevokeToken deletes the token and every other token of the same login, refresh tokens included
+func (t *PostgresTokenStore) RevokeToken(tokenHash []byte) error {
 	query := `
 		DELETE FROM tokens
-		WHERE hash = $1
+		WHERE session_id = (SELECT session_id FROM tokens WHERE hash = $1)
 	`
 	_, err := t.db.Exec(query, tokenHash)
 	return err
-}
\ No newline at end of file
+}
+// RotateRefreshToken trades a refresh token for a new access token and a new refresh token in the same login.
+// The old refresh token is marked used rather than deleted so that a second use can be caught:
+// that revokes the whole login and returns ErrRefreshTokenReused, along with a token holding just
+// the user and session ID of the revoked login in place of the access token.
+// Returns nil tokens if the refresh token is unknown or expired.
+func (t *PostgresTokenStore) RotateRefreshToken(plaintext string, accessTTL, refreshTTL time.Duration) (*tokens.Token, *tokens.Token, error) {
+	// Transaction
+	tx, err := t.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	access, refresh, err := rotateRefreshToken(postgresRefreshTx{tx}, plaintext, accessTTL, refreshTTL)
+	if err != nil && err != ErrRefreshTokenReused {
+		return nil, nil, err
+	}
+	// A reuse is committed too, that is what revokes the login
+	commitErr := tx.Commit()
+	if commitErr != nil {
+		return nil, nil, commitErr
+	}
+	return access, refresh, err
+}
+
+// refreshTx is what the rotation does within its transaction, kept apart from the SQL so it can be tested without a database
+type refreshTx interface {
+	// lockRefreshToken locks the unexpired refresh token with the given hash. Returns a nil token if there is none.
+	lockRefreshToken(hash []byte) (token *tokens.Token, usedAt *time.Time, err error)
+	markUsed(hash []byte) error
+	deleteSession(sessionID string) error
+	insert(token *tokens.Token) error
+}
+
+func rotateRefreshToken(tx refreshTx, plaintext string, accessTTL, refreshTTL time.Duration) (*tokens.Token, *tokens.Token, error) {
+	hash := tokens.Hash(plaintext)
+	old, usedAt, err := tx.lockRefreshToken(hash)
+	if err != nil || old == nil {
+		return nil, nil, err
+	}
+
+	if usedAt != nil {
+		err = tx.deleteSession(old.SessionID)
+		if err != nil {
+			return nil, nil, err
+		}
+		return old, nil, ErrRefreshTokenReused
+	}
+
+	err = tx.markUsed(hash)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	issued := make([]*tokens.Token, 0, 2)
+	for _, next := range []struct {
+		scope string
+		ttl   time.Duration
+	}{{tokens.ScopeAuth, accessTTL}, {tokens.ScopeRefresh, refreshTTL}} {
+		token, err := tokens.GenerateToken(old.UserID, next.ttl, next.scope)
+		if err != nil {
+			return nil, nil, err
+		}
+		token.SessionID = old.SessionID
+		token.UserAgent = old.UserAgent
+		token.IP = old.IP
+
+		err = tx.insert(token)
+		if err != nil {
+			return nil, nil, err
+		}
+		issued = append(issued, token)
+	}
+	return issued[0], issued[1], nil
+}
+
+type postgresRefreshTx struct {
+	tx *sql.Tx
+}
+
+func (p postgresRefreshTx) lockRefreshToken(hash []byte) (*tokens.Token, *time.Time, error) {
+	var old tokens.Token
+	var usedAt *time.Time
+	query := `
+		SELECT user_id, session_id, user_agent, ip, used_at
+		FROM tokens
+		WHERE hash = $1 AND scope = $2 AND expiry > NOW()
+		FOR UPDATE
+	`
+	err := p.tx.QueryRow(query, hash, tokens.ScopeRefresh).Scan(&old.UserID, &old.SessionID, &old.UserAgent, &old.IP, &usedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return &old, usedAt, nil
+}
+
+func (p postgresRefreshTx) markUsed(hash []byte) error {
+	_, err := p.tx.Exec(`UPDATE tokens SET used_at = NOW() WHERE hash = $1`, hash)
+	return err
+}
+
+func (p postgresRefreshTx) deleteSession(sessionID string) error {
+	_, err := p.tx.Exec(`DELETE FROM tokens WHERE session_id = $1`, sessionID)
+	return err
+}
+
+func (p postgresRefreshTx) insert(token *tokens.Token) error {
+	_, err := p.tx.Exec(`
+		INSERT INTO tokens (hash, user_id, expiry, scope, user_agent, ip, session_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, token.Hash, token.UserID, token.Expiry, token.Scope, token.UserAgent, token.IP, token.SessionID)
+	return err
+}
+
+// DeleteExpiredTokens removes every token past its expiry, of any scope. Used refresh tokens are kept
+// until then on purpose, so that presenting one again is still caught as reuse.
+func (t *PostgresTokenStore) DeleteExpiredTokens() (int64, error) {
+	result, err := t.db.Exec(`DELETE FROM tokens WHERE expiry < NOW()`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
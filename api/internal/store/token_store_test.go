@@ -0,0 +1,166 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/tokens"
+)
+
+// memoryRefreshTx is a refreshTx over an in-memory tokens table
+type memoryRefreshTx struct {
+	rows map[string]*tokenRow // by hash
+}
+
+type tokenRow struct {
+	token  *tokens.Token
+	usedAt *time.Time
+}
+
+func newMemoryRefreshTx() *memoryRefreshTx {
+	return &memoryRefreshTx{rows: make(map[string]*tokenRow)}
+}
+
+func (m *memoryRefreshTx) lockRefreshToken(hash []byte) (*tokens.Token, *time.Time, error) {
+	row, ok := m.rows[string(hash)]
+	if !ok || row.token.Scope != tokens.ScopeRefresh || !row.token.Expiry.After(time.Now()) {
+		return nil, nil, nil
+	}
+	old := *row.token
+	return &old, row.usedAt, nil
+}
+
+func (m *memoryRefreshTx) markUsed(hash []byte) error {
+	now := time.Now()
+	m.rows[string(hash)].usedAt = &now
+	return nil
+}
+
+func (m *memoryRefreshTx) deleteSession(sessionID string) error {
+	for hash, row := range m.rows {
+		if row.token.SessionID == sessionID {
+			delete(m.rows, hash)
+		}
+	}
+	return nil
+}
+
+func (m *memoryRefreshTx) insert(token *tokens.Token) error {
+	m.rows[string(token.Hash)] = &tokenRow{token: token}
+	return nil
+}
+
+// login inserts an access and a refresh token for a new session and returns the refresh token
+func (m *memoryRefreshTx) login(t *testing.T, userID int, sessionID string) *tokens.Token {
+	t.Helper()
+	var refresh *tokens.Token
+	for _, scope := range []string{tokens.ScopeAuth, tokens.ScopeRefresh} {
+		token, err := tokens.GenerateToken(userID, time.Hour, scope)
+		if err != nil {
+			t.Fatalf("GenerateToken: %v", err)
+		}
+		token.SessionID = sessionID
+		m.insert(token)
+		refresh = token
+	}
+	return refresh
+}
+
+func (m *memoryRefreshTx) countSession(sessionID string) int {
+	count := 0
+	for _, row := range m.rows {
+		if row.token.SessionID == sessionID {
+			count++
+		}
+	}
+	return count
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	tx := newMemoryRefreshTx()
+	refresh := tx.login(t, 1, "session-1")
+
+	access, next, err := rotateRefreshToken(tx, refresh.Plaintext, time.Minute, time.Hour)
+	if err != nil {
+		t.Fatalf("rotateRefreshToken: %v", err)
+	}
+	if access.Scope != tokens.ScopeAuth || next.Scope != tokens.ScopeRefresh {
+		t.Fatalf("expected an access and a refresh token, got %q and %q", access.Scope, next.Scope)
+	}
+	if access.SessionID != "session-1" || next.SessionID != "session-1" || access.UserID != 1 {
+		t.Errorf("expected the new tokens to stay in the same login, got %+v and %+v", access, next)
+	}
+	if tx.rows[string(refresh.Hash)].usedAt == nil {
+		t.Error("expected the old refresh token to be marked used")
+	}
+
+	// The new refresh token rotates in turn
+	_, _, err = rotateRefreshToken(tx, next.Plaintext, time.Minute, time.Hour)
+	if err != nil {
+		t.Errorf("expected the new refresh token to rotate, got %v", err)
+	}
+}
+
+func TestRotateRefreshTokenReuseRevokesTheLogin(t *testing.T) {
+	tx := newMemoryRefreshTx()
+	stolen := tx.login(t, 1, "session-1")
+	other := tx.login(t, 1, "session-2")
+
+	// The legitimate client rotates twice, then the stolen token is presented again
+	_, next, err := rotateRefreshToken(tx, stolen.Plaintext, time.Minute, time.Hour)
+	if err != nil {
+		t.Fatalf("rotateRefreshToken: %v", err)
+	}
+	_, _, err = rotateRefreshToken(tx, next.Plaintext, time.Minute, time.Hour)
+	if err != nil {
+		t.Fatalf("rotateRefreshToken: %v", err)
+	}
+
+	revoked, refresh, err := rotateRefreshToken(tx, stolen.Plaintext, time.Minute, time.Hour)
+	if !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("expected ErrRefreshTokenReused, got %v", err)
+	}
+	if refresh != nil || revoked == nil || revoked.UserID != 1 || revoked.SessionID != "session-1" {
+		t.Errorf("expected only the user and session of the revoked login, got %+v and %+v", revoked, refresh)
+	}
+	if n := tx.countSession("session-1"); n != 0 {
+		t.Errorf("expected every token of the login to be deleted, %d left", n)
+	}
+	if n := tx.countSession("session-2"); n != 2 {
+		t.Errorf("expected the user's other login to be kept, got %d tokens", n)
+	}
+
+	// The tokens issued to the legitimate client went with the login
+	_, _, err = rotateRefreshToken(tx, next.Plaintext, time.Minute, time.Hour)
+	if err != nil {
+		t.Errorf("expected the deleted token to be unknown rather than an error, got %v", err)
+	}
+	if _, _, err = rotateRefreshToken(tx, other.Plaintext, time.Minute, time.Hour); err != nil {
+		t.Errorf("expected the other login to keep working, got %v", err)
+	}
+}
+
+func TestRotateRefreshTokenIgnoresUnknownTokens(t *testing.T) {
+	tx := newMemoryRefreshTx()
+	refresh := tx.login(t, 1, "session-1")
+
+	var accessPlaintext string
+	for _, row := range tx.rows {
+		if row.token.Scope == tokens.ScopeAuth {
+			accessPlaintext = row.token.Plaintext
+		}
+	}
+	tx.rows[string(refresh.Hash)].token.Expiry = time.Now().Add(-time.Second)
+
+	for name, plaintext := range map[string]string{
+		"unknown":       "NOTAREALTOKEN",
+		"access token":  accessPlaintext,
+		"expired token": refresh.Plaintext,
+	} {
+		access, next, err := rotateRefreshToken(tx, plaintext, time.Minute, time.Hour)
+		if access != nil || next != nil || err != nil {
+			t.Errorf("%s: expected nothing, got %v, %v, %v", name, access, next, err)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Trash holds the notes and folders a user deleted directly.
+// Items that were trashed along with a parent folder are not listed; they come back when that folder is restored.
+type Trash struct {
+	Notes   []*Note   `json:"notes"`
+	Folders []*Folder `json:"folders"`
+}
+
+// PurgedRow is a note, folder or user deleted for good by a background purge, kept for the audit trail
+type PurgedRow struct {
+	ID     int
+	UserID int
+}
+
+type PostgresTrashStore struct {
+	db *sql.DB
+}
+
+func NewPostgresTrashStore(db *sql.DB) *PostgresTrashStore {
+	return &PostgresTrashStore{db: db}
+}
+
+// Interface for TrashStore to allow decoupling and easier testing:
+type TrashStore interface {
+	ListTrash(userID int) (*Trash, error)
+	RestoreNote(userID, noteID int) error
+	RestoreFolder(userID, folderID int) error
+	EmptyTrash(userID int) (int64, error)
+	PurgeTrash(deletedBefore time.Time) (notes, folders []PurgedRow, err error)
+}
+
+func (pg *PostgresTrashStore) ListTrash(userID int) (*Trash, error) {
+	trash := &Trash{
+		Notes:   []*Note{},
+		Folders: []*Folder{},
+	}
+
+	query := `
+		SELECT n.id, n.title, n.content, n.user_id, n.is_favorite, n.folder_id, ` + noteTagsColumn + `, n.created_at, n.updated_at, n.deleted_at
+		FROM notes n
+		WHERE n.user_id = $1 AND n.deleted_at IS NOT NULL AND n.deleted_by_folder_id IS NULL
+		ORDER BY n.deleted_at DESC
+	`
+	rows, err := pg.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	typeMap := pgtype.NewMap()
+	for rows.Next() {
+		note := &Note{}
+		err := rows.Scan(
+			&note.ID,
+			&note.Title,
+			&note.Content,
+			&note.UserID,
+			&note.IsFavorite,
+			&note.FolderID,
+			typeMap.SQLScanner(&note.Tags),
+			&note.CreatedAt,
+			&note.UpdatedAt,
+			&note.DeletedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		trash.Notes = append(trash.Notes, note)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = `
+		SELECT id, title, user_id, is_favorite, parent_folder_id, created_at, updated_at, deleted_at
+		FROM folders
+		WHERE user_id = $1 AND deleted_at IS NOT NULL AND deleted_by_folder_id IS NULL
+		ORDER BY deleted_at DESC
+	`
+	folderRows, err := pg.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer folderRows.Close()
+
+	for folderRows.Next() {
+		folder := &Folder{}
+		err := folderRows.Scan(
+			&folder.ID,
+			&folder.Title,
+			&folder.UserID,
+			&folder.IsFavorite,
+			&folder.ParentFolderID,
+			&folder.CreatedAt,
+			&folder.UpdatedAt,
+			&folder.DeletedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		trash.Folders = append(trash.Folders, folder)
+	}
+	if err := folderRows.Err(); err != nil {
+		return nil, err
+	}
+
+	return trash, nil
+}
+
+// RestoreNote takes a note the user trashed directly out of the trash.
+// If its folder is still in the trash, the note is moved to the root instead.
+func (pg *PostgresTrashStore) RestoreNote(userID, noteID int) error {
+	query := `
+		UPDATE notes n
+		SET deleted_at = NULL,
+		    folder_id = CASE
+		        WHEN EXISTS (SELECT 1 FROM folders f WHERE f.id = n.folder_id AND f.deleted_at IS NOT NULL) THEN NULL
+		        ELSE n.folder_id
+		    END
+		WHERE n.id = $1 AND n.user_id = $2 AND n.deleted_at IS NOT NULL AND n.deleted_by_folder_id IS NULL
+	`
+	res, err := pg.db.Exec(query, noteID, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows // Not in the trash
+	}
+	return nil
+}
+
+// RestoreFolder takes a folder out of the trash along with everything that was trashed with it.
+// If its parent is still in the trash, the folder is moved to the root instead.
+func (pg *PostgresTrashStore) RestoreFolder(userID, folderID int) error {
+
+	// Transaction
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE folders f
+		SET deleted_at = NULL,
+		    parent_folder_id = CASE
+		        WHEN EXISTS (SELECT 1 FROM folders p WHERE p.id = f.parent_folder_id AND p.deleted_at IS NOT NULL) THEN NULL
+		        ELSE f.parent_folder_id
+		    END
+		WHERE f.id = $1 AND f.user_id = $2 AND f.deleted_at IS NOT NULL AND f.deleted_by_folder_id IS NULL
+	`
+	res, err := tx.Exec(query, folderID, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows // Not in the trash
+	}
+
+	// Subfolders and notes that went to the trash with this folder
+	query = `
+		UPDATE folders
+		SET deleted_at = NULL, deleted_by_folder_id = NULL
+		WHERE deleted_by_folder_id = $1
+	`
+	_, err = tx.Exec(query, folderID)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		UPDATE notes
+		SET deleted_at = NULL, deleted_by_folder_id = NULL
+		WHERE deleted_by_folder_id = $1
+	`
+	_, err = tx.Exec(query, folderID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// EmptyTrash permanently deletes everything in the user's trash. Returns the number of rows removed.
+func (pg *PostgresTrashStore) EmptyTrash(userID int) (int64, error) {
+	return pg.hardDelete(`
+		DELETE FROM notes
+		WHERE user_id = $1 AND deleted_at IS NOT NULL
+	`, `
+		DELETE FROM folders
+		WHERE user_id = $1 AND deleted_at IS NOT NULL
+	`, userID)
+}
+
+// PurgeTrash permanently deletes everything that has been in the trash since before deletedBefore, for all users.
+// Called periodically by the background purger, which audits each row returned.
+// Notes go first so the ones in a purged folder are returned rather than removed by the ON DELETE CASCADE.
+func (pg *PostgresTrashStore) PurgeTrash(deletedBefore time.Time) ([]PurgedRow, []PurgedRow, error) {
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	notes, err := scanPurgedRows(tx.Query(`
+		DELETE FROM notes
+		WHERE deleted_at < $1
+		RETURNING id, user_id
+	`, deletedBefore))
+	if err != nil {
+		return nil, nil, err
+	}
+	folders, err := scanPurgedRows(tx.Query(`
+		DELETE FROM folders
+		WHERE deleted_at < $1
+		RETURNING id, user_id
+	`, deletedBefore))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return notes, folders, nil
+}
+
+// scanPurgedRows collects the rows of a DELETE ... RETURNING id, user_id query.
+// Takes the results of Query directly: scanPurgedRows(tx.Query(...)).
+func scanPurgedRows(rows *sql.Rows, err error) ([]PurgedRow, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deleted []PurgedRow
+	for rows.Next() {
+		var row PurgedRow
+		if err := rows.Scan(&row.ID, &row.UserID); err != nil {
+			return nil, err
+		}
+		deleted = append(deleted, row)
+	}
+	return deleted, rows.Err()
+}
+
+// hardDelete runs the note and folder DELETE queries in one transaction.
+// Notes go first so the count is not skewed by the folder ON DELETE CASCADE.
+func (pg *PostgresTrashStore) hardDelete(notesQuery, foldersQuery string, arg any) (int64, error) {
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var total int64
+	for _, query := range []string{notesQuery, foldersQuery} {
+		res, err := tx.Exec(query, arg)
+		if err != nil {
+			return 0, err
+		}
+		rowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		total += rowsAffected
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
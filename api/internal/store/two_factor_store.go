@@ -0,0 +1,218 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+)
+
+// TwoFactor is a user's TOTP enrollment. The secret never leaves the API after setup.
+type TwoFactor struct {
+	UserID         int
+	Secret         string // base32, stored as is since it is needed to check codes
+	EnabledAt      *time.Time
+	LastUsedStep   *int64
+	FailedAttempts int // wrong codes since the last accepted one
+	LastFailedAt   *time.Time
+}
+
+// IsEnabled reports whether setup was confirmed, i.e. logins need a code.
+func (tf *TwoFactor) IsEnabled() bool {
+	return tf != nil && tf.EnabledAt != nil
+}
+
+type PostgresTwoFactorStore struct {
+	db *sql.DB
+}
+
+func NewPostgresTwoFactorStore(db *sql.DB) *PostgresTwoFactorStore {
+	return &PostgresTwoFactorStore{db: db}
+}
+
+// Interface for TwoFactorStore to allow decoupling and easier testing:
+type TwoFactorStore interface {
+	GetTwoFactor(userID int) (*TwoFactor, error)
+	StartSetup(userID int, secret string) error
+	Enable(userID int, recoveryCodeHashes [][]byte) error
+	Disable(userID int) error
+	UseStep(userID int, step int64) (bool, error)
+	UseRecoveryCode(userID int, codeHash []byte) (bool, error)
+	CountRecoveryCodes(userID int) (int, error)
+	ReserveAttempt(userID int, maxAttempts int, lockout time.Duration) (bool, error)
+}
+
+func (pg *PostgresTwoFactorStore) GetTwoFactor(userID int) (*TwoFactor, error) {
+	query := `
+		SELECT user_id, secret, enabled_at, last_used_step, failed_attempts, last_failed_at
+		FROM two_factor
+		WHERE user_id = $1
+	`
+	tf := &TwoFactor{}
+	err := pg.db.QueryRow(query, userID).Scan(&tf.UserID, &tf.Secret, &tf.EnabledAt, &tf.LastUsedStep, &tf.FailedAttempts, &tf.LastFailedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tf, nil
+}
+
+// StartSetup stores a new, not yet enabled secret, replacing any earlier unconfirmed one.
+// It does nothing if 2FA is already enabled (returns sql.ErrNoRows).
+func (pg *PostgresTwoFactorStore) StartSetup(userID int, secret string) error {
+	query := `
+		INSERT INTO two_factor (user_id, secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, last_used_step = NULL, failed_attempts = 0, created_at = CURRENT_TIMESTAMP
+		WHERE two_factor.enabled_at IS NULL
+	`
+	result, err := pg.db.Exec(query, userID, secret)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Enable confirms the setup and replaces the user's recovery codes.
+func (pg *PostgresTwoFactorStore) Enable(userID int, recoveryCodeHashes [][]byte) error {
+	// Transaction
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE two_factor
+		SET enabled_at = CURRENT_TIMESTAMP, failed_attempts = 0
+		WHERE user_id = $1 AND enabled_at IS NULL
+	`, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	err = replaceRecoveryCodes(tx, userID, recoveryCodeHashes)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID int, codeHashes [][]byte) error {
+	_, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	for _, hash := range codeHashes {
+		_, err = tx.Exec(`INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)`, userID, hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Disable removes the enrollment and the recovery codes.
+func (pg *PostgresTwoFactorStore) Disable(userID int) error {
+	// Transaction
+	tx, err := pg.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM two_factor WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseStep records that the code for step was accepted. It returns false if that code (or a later one)
+// was already used, which stops a code from being replayed within its validity window.
+func (pg *PostgresTwoFactorStore) UseStep(userID int, step int64) (bool, error) {
+	query := `
+		UPDATE two_factor
+		SET last_used_step = $2, failed_attempts = 0
+		WHERE user_id = $1 AND (last_used_step IS NULL OR last_used_step < $2)
+	`
+	result, err := pg.db.Exec(query, userID, step)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
+
+// UseRecoveryCode marks a recovery code as used. It returns false if the code is unknown or already used.
+func (pg *PostgresTwoFactorStore) UseRecoveryCode(userID int, codeHash []byte) (bool, error) {
+	query := `
+		UPDATE recovery_codes
+		SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`
+	result, err := pg.db.Exec(query, userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if rowsAffected == 0 {
+		return false, nil
+	}
+
+	_, err = pg.db.Exec(`UPDATE two_factor SET failed_attempts = 0 WHERE user_id = $1`, userID)
+	return true, err
+}
+
+// CountRecoveryCodes returns how many unused recovery codes the user has left.
+func (pg *PostgresTwoFactorStore) CountRecoveryCodes(userID int) (int, error) {
+	var count int
+	err := pg.db.QueryRow(`SELECT COUNT(*) FROM recovery_codes WHERE user_id = $1 AND used_at IS NULL`, userID).Scan(&count)
+	return count, err
+}
+
+// ReserveAttempt counts an attempt at a code as a failure before it is checked, unless there were already maxAttempts
+// failures in a row, the last one less than lockout ago. It returns false when locked out. Checking and counting in
+// one statement means concurrent guesses cannot all get in before the lockout; the accepted code resets the count.
+func (pg *PostgresTwoFactorStore) ReserveAttempt(userID int, maxAttempts int, lockout time.Duration) (bool, error) {
+	query := `
+		UPDATE two_factor
+		SET failed_attempts = failed_attempts + 1, last_failed_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1
+		AND NOT (failed_attempts >= $2 AND last_failed_at IS NOT NULL AND last_failed_at > CURRENT_TIMESTAMP - make_interval(secs => $3))
+		RETURNING failed_attempts
+	`
+	var attempts int
+	err := pg.db.QueryRow(query, userID, maxAttempts, lockout.Seconds()).Scan(&attempts)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
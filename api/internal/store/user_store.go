@@ -14,6 +14,12 @@ type password struct {
 	hash      []byte
 }
 
+// Set records a new password. It is hashed by the store that saves it, at the bcrypt cost that store was given.
+func (p *password) Set(plainText string) {
+	p.plainText = &plainText
+	p.hash = nil
+}
+
 // Password hashing and verification methods can be added here
 /*
 	In software development, a salt is a value that determins the computational complexity of the hashing algorithm.
@@ -24,12 +30,15 @@ type password struct {
 	The default cost is 10, but it can be increased for added security.
 	However, increasing the cost also increases the time it takes to hash a password, so it's important to find a balance between security and performance.
 */
-func (p *password) Set(plainText string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plainText), 12)
+// hashWith hashes the password given to Set. A password loaded from the database is already hashed and left as is.
+func (p *password) hashWith(cost int) error {
+	if p.plainText == nil || p.hash != nil {
+		return nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(*p.plainText), cost)
 	if err != nil {
 		return err
 	}
-	p.plainText = &plainText
 	p.hash = hash
 	return nil
 }
@@ -70,24 +79,102 @@ type User struct {
 	AddressZip     string   `json:"zip"`
 	AddressCountry string   `json:"country"`
 
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	EmailVerifiedAt       *time.Time `json:"email_verified_at"`       // nil until the user follows the link in the verification email
+	SuspendedAt           *time.Time `json:"suspended_at"`            // set while an admin has suspended the account
+	PasswordResetRequired bool       `json:"password_reset_required"` // set by admins, login is refused until the password is reset
+	DeletionScheduledAt   *time.Time `json:"deletion_scheduled_at"`   // set when the user asked for their account to be deleted, logging in cancels it
+	CreatedAt             time.Time  `json:"created_at"`
+	UpdatedAt             time.Time  `json:"updated_at"`
 }
 
 // AnonymousUser is a placeholder for unauthenticated users.
 var AnonymousUser = &User{}
 
+// IsEmailVerified reports whether the user has confirmed their current email address.
+func (u *User) IsEmailVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+// IsSuspended reports whether an admin has suspended the account. Suspended users cannot log in or use their tokens.
+func (u *User) IsSuspended() bool {
+	return u.SuspendedAt != nil
+}
+
+// IsDeletionScheduled reports whether the user asked for their account to be deleted and has not logged in since.
+func (u *User) IsDeletionScheduled() bool {
+	return u.DeletionScheduledAt != nil
+}
+
 // IsAnonymous checks if the user is anonymous.
 func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
 }
 
+// Role is a named permission level, stored in users.auth_level. Each role includes everything the ones below it can do.
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+// auth_level values for each role. New users get AuthLevelUser.
+const (
+	AuthLevelUser      = 1
+	AuthLevelModerator = 2
+	AuthLevelAdmin     = 3
+)
+
+var roleAuthLevels = map[Role]int{
+	RoleUser:      AuthLevelUser,
+	RoleModerator: AuthLevelModerator,
+	RoleAdmin:     AuthLevelAdmin,
+}
+
+// ParseRole returns the role with the given name.
+func ParseRole(name string) (Role, bool) {
+	_, ok := roleAuthLevels[Role(name)]
+	return Role(name), ok
+}
+
+// RoleForAuthLevel maps an auth_level to its role. Unknown levels below admin round down, anything above counts as admin.
+func RoleForAuthLevel(level int) Role {
+	switch {
+	case level >= AuthLevelAdmin:
+		return RoleAdmin
+	case level >= AuthLevelModerator:
+		return RoleModerator
+	default:
+		return RoleUser
+	}
+}
+
+// AuthLevel is the auth_level stored for the role.
+func (r Role) AuthLevel() int {
+	return roleAuthLevels[r]
+}
+
+// Role returns the user's role. Anonymous users have none.
+func (u *User) Role() Role {
+	if u.IsAnonymous() {
+		return ""
+	}
+	return RoleForAuthLevel(u.AuthLevel)
+}
+
+// HasRole reports whether the user has the given role or a higher one.
+func (u *User) HasRole(role Role) bool {
+	return !u.IsAnonymous() && u.AuthLevel >= role.AuthLevel()
+}
+
 type PostgresUserStore struct {
-	db *sql.DB
+	db         *sql.DB
+	bcryptCost int // cost of the password hashes the store makes
 }
 
-func NewPostgresUserStore(db *sql.DB) *PostgresUserStore {
-	return &PostgresUserStore{db: db}
+func NewPostgresUserStore(db *sql.DB, bcryptCost int) *PostgresUserStore {
+	return &PostgresUserStore{db: db, bcryptCost: bcryptCost}
 }
 
 // Interface for UserStore to allow decoupling and easier testing:
@@ -95,15 +182,28 @@ type UserStore interface {
 	CreateUser(*User) (*User, error)
 	GetUserById(id int) (*User, error)
 	GetUserByUsername(username string) (*User, error)
+	GetUserByEmail(email string) (*User, error)
 	UpdateUser(*User) (*User, error)
 	GetUserToken(scope, tokenPlaintext string) (*User, error)
 	UpdateUserPassword(userID int, newPassword string) error
+	MarkEmailVerified(userID int) error
+	UpdateUserRole(userID int, role Role) error
+	SetUserSuspended(userID int, suspended bool) error
+	RequirePasswordReset(userID int) error
+	DeleteUser(userID int) error
+	ScheduleUserDeletion(userID int, at time.Time) error
+	CancelUserDeletion(userID int) (bool, error)
+	PurgeScheduledDeletions() ([]PurgedRow, error)
 }
 
 // CRUUD operations:
 
 // Create user:
 func (s *PostgresUserStore) CreateUser(user *User) (*User, error) {
+	err := user.PasswordHash.hashWith(s.bcryptCost)
+	if err != nil {
+		return nil, err
+	}
 
 	query := `
 		INSERT INTO users (
@@ -126,7 +226,7 @@ func (s *PostgresUserStore) CreateUser(user *User) (*User, error) {
 		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
 		RETURNING id, created_at, updated_at
 	`
-	err := s.db.QueryRow(query,
+	err = s.db.QueryRow(query,
 		user.Username,
 		user.Email,
 		user.PasswordHash.hash,
@@ -166,6 +266,10 @@ func (s *PostgresUserStore) GetUserById(id int) (*User, error) {
 		address_state, 
 		address_zip_code, 
 		address_country, 
+		email_verified_at,
+		suspended_at,
+		password_reset_required,
+		deletion_scheduled_at,
 		created_at, 
 		updated_at
 		FROM users
@@ -190,6 +294,10 @@ func (s *PostgresUserStore) GetUserById(id int) (*User, error) {
 		&user.AddressState,
 		&user.AddressZip,
 		&user.AddressCountry,
+		&user.EmailVerifiedAt,
+		&user.SuspendedAt,
+		&user.PasswordResetRequired,
+		&user.DeletionScheduledAt,
 		&user.CreatedAt,
 		&user.UpdatedAt)
 	if err == sql.ErrNoRows {
@@ -218,6 +326,10 @@ func (s *PostgresUserStore) GetUserByUsername(username string) (*User, error) {
 		address_state,
 		address_zip_code,
 		address_country,
+		email_verified_at,
+		suspended_at,
+		password_reset_required,
+		deletion_scheduled_at,
 		created_at,
 		updated_at
 		FROM users
@@ -242,6 +354,72 @@ func (s *PostgresUserStore) GetUserByUsername(username string) (*User, error) {
 		&user.AddressState,
 		&user.AddressZip,
 		&user.AddressCountry,
+		&user.EmailVerifiedAt,
+		&user.SuspendedAt,
+		&user.PasswordResetRequired,
+		&user.DeletionScheduledAt,
+		&user.CreatedAt,
+		&user.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil // No user found
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// Read (Get) user by Email. Emails are matched case-insensitively:
+func (s *PostgresUserStore) GetUserByEmail(email string) (*User, error) {
+	query := `
+		SELECT id,
+		username,
+		email,
+		password_hash,
+		bio,
+		auth_level,
+		first_name,
+		last_name,
+		pfp_url,
+		address_line1,
+		address_line2,
+		address_city,
+		address_state,
+		address_zip_code,
+		address_country,
+		email_verified_at,
+		suspended_at,
+		password_reset_required,
+		deletion_scheduled_at,
+		created_at,
+		updated_at
+		FROM users
+		WHERE LOWER(email) = LOWER($1)
+	`
+	user := &User{
+		PasswordHash: password{},
+	}
+	err := s.db.QueryRow(query, email).Scan(
+		&user.ID,
+		&user.Username,
+		&user.Email,
+		&user.PasswordHash.hash,
+		&user.Bio,
+		&user.AuthLevel,
+		&user.FirstName,
+		&user.LastName,
+		&user.PfpURL,
+		&user.AddressLine1,
+		&user.AddressLine2,
+		&user.AddressCity,
+		&user.AddressState,
+		&user.AddressZip,
+		&user.AddressCountry,
+		&user.EmailVerifiedAt,
+		&user.SuspendedAt,
+		&user.PasswordResetRequired,
+		&user.DeletionScheduledAt,
 		&user.CreatedAt,
 		&user.UpdatedAt)
 	if err == sql.ErrNoRows {
@@ -254,11 +432,12 @@ func (s *PostgresUserStore) GetUserByUsername(username string) (*User, error) {
 	return user, nil
 }
 
-// Update user:
+// Update user. Changing the email clears email_verified_at, the new address has to be verified again:
 func (s *PostgresUserStore) UpdateUser(user *User) (*User, error) {
 	query := `
 		UPDATE users
 		SET username = $1, 
+		email_verified_at = CASE WHEN LOWER(email) = LOWER($2) THEN email_verified_at ELSE NULL END,
 		email = $2, 
 		bio = $3, 
 		auth_level = $4, 
@@ -273,8 +452,9 @@ func (s *PostgresUserStore) UpdateUser(user *User) (*User, error) {
 		address_country = $13, 
 		updated_at = NOW()
 		WHERE id = $14
+		RETURNING email_verified_at
 	`
-	result, err := s.db.Exec(
+	err := s.db.QueryRow(
 		query,
 		user.Username,
 		user.Email,
@@ -289,21 +469,12 @@ func (s *PostgresUserStore) UpdateUser(user *User) (*User, error) {
 		user.AddressState,
 		user.AddressZip,
 		user.AddressCountry,
-		user.ID)
-	if err != nil {
-		return nil, err
-	}
-	// rows:
-	rowsAffected, err := result.RowsAffected()
+		user.ID).Scan(&user.EmailVerifiedAt)
 	if err != nil {
+		// sql.ErrNoRows when no user has that ID
 		return nil, err
 	}
 
-	// Check if any row was actually updated
-	if rowsAffected == 0 {
-		return nil, sql.ErrNoRows
-	}
-
 	return user, nil
 }
 
@@ -331,6 +502,10 @@ func (s *PostgresUserStore) GetUserToken(scope, plaintextPassword string) (*User
 		u.address_state, 
 		u.address_zip_code, 
 		u.address_country, 
+		u.email_verified_at, 
+		u.suspended_at, 
+		u.password_reset_required, 
+		u.deletion_scheduled_at, 
 		u.created_at, 
 		u.updated_at
 		FROM users u
@@ -357,6 +532,10 @@ func (s *PostgresUserStore) GetUserToken(scope, plaintextPassword string) (*User
 		&user.AddressState,
 		&user.AddressZip,
 		&user.AddressCountry,
+		&user.EmailVerifiedAt,
+		&user.SuspendedAt,
+		&user.PasswordResetRequired,
+		&user.DeletionScheduledAt,
 		&user.CreatedAt,
 		&user.UpdatedAt)
 	if err == sql.ErrNoRows {
@@ -371,17 +550,54 @@ func (s *PostgresUserStore) GetUserToken(scope, plaintextPassword string) (*User
 
 // Update user password:
 func (s *PostgresUserStore) UpdateUserPassword(userID int, newPassword string) error {
-	newPasswordHash, err := bcrypt.GenerateFromPassword([]byte(newPassword), 12)
+	var newPasswordHash password
+	newPasswordHash.Set(newPassword)
+	err := newPasswordHash.hashWith(s.bcryptCost)
 	if err != nil {
 		return err
 	}
 
 	query := `
 		UPDATE users
-		SET password_hash = $1, updated_at = NOW()
+		SET password_hash = $1, password_reset_required = FALSE, updated_at = NOW()
+		WHERE id = $2
+	`
+	result, err := s.db.Exec(query, newPasswordHash.hash, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// Records that the user confirmed their email address:
+func (s *PostgresUserStore) MarkEmailVerified(userID int) error {
+	query := `
+		UPDATE users
+		SET email_verified_at = NOW()
+		WHERE id = $1 AND email_verified_at IS NULL
+	`
+	_, err := s.db.Exec(query, userID)
+	return err
+}
+
+// Changes the user's role. Only admins get to call this, see UserHandler.HandleUpdateUserRole:
+func (s *PostgresUserStore) UpdateUserRole(userID int, role Role) error {
+	query := `
+		UPDATE users
+		SET auth_level = $1, updated_at = NOW()
 		WHERE id = $2
 	`
-	result, err := s.db.Exec(query, newPasswordHash, userID)
+	result, err := s.db.Exec(query, role.AuthLevel(), userID)
 	if err != nil {
 		return err
 	}
@@ -397,3 +613,87 @@ func (s *PostgresUserStore) UpdateUserPassword(userID int, newPassword string) e
 
 	return nil
 }
+
+// Suspends the user, or lifts the suspension:
+func (s *PostgresUserStore) SetUserSuspended(userID int, suspended bool) error {
+	query := `
+		UPDATE users
+		SET suspended_at = CASE WHEN $1 THEN COALESCE(suspended_at, NOW()) ELSE NULL END,
+		updated_at = NOW()
+		WHERE id = $2
+	`
+	return s.execForUser(query, suspended, userID)
+}
+
+// Refuses logins until the user has set a new password through a password reset:
+func (s *PostgresUserStore) RequirePasswordReset(userID int) error {
+	query := `
+		UPDATE users
+		SET password_reset_required = TRUE, updated_at = NOW()
+		WHERE id = $1
+	`
+	return s.execForUser(query, userID)
+}
+
+// Delete user. Their notes, folders, tokens and everything else go with them through ON DELETE CASCADE:
+func (s *PostgresUserStore) DeleteUser(userID int) error {
+	query := `
+		DELETE FROM users
+		WHERE id = $1
+	`
+	return s.execForUser(query, userID)
+}
+
+// execForUser runs an UPDATE or DELETE on a single user, returning sql.ErrNoRows if there is no such user.
+func (s *PostgresUserStore) execForUser(query string, args ...any) error {
+	result, err := s.db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// Marks the user for deletion at the given time. PurgeScheduledDeletions does the actual deleting:
+func (s *PostgresUserStore) ScheduleUserDeletion(userID int, at time.Time) error {
+	query := `
+		UPDATE users
+		SET deletion_scheduled_at = $1, updated_at = NOW()
+		WHERE id = $2
+	`
+	return s.execForUser(query, at, userID)
+}
+
+// Cancels a pending deletion. Reports whether there was one:
+func (s *PostgresUserStore) CancelUserDeletion(userID int) (bool, error) {
+	query := `
+		UPDATE users
+		SET deletion_scheduled_at = NULL, updated_at = NOW()
+		WHERE id = $1 AND deletion_scheduled_at IS NOT NULL
+	`
+	err := s.execForUser(query, userID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Deletes every user whose grace period is over, along with all their data (ON DELETE CASCADE).
+// Returns the deleted users so the purger can audit them:
+func (s *PostgresUserStore) PurgeScheduledDeletions() ([]PurgedRow, error) {
+	query := `
+		DELETE FROM users
+		WHERE deletion_scheduled_at <= NOW()
+		RETURNING id, id
+	`
+	return scanPurgedRows(s.db.Query(query))
+}
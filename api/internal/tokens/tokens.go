@@ -4,12 +4,17 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base32"
+	"fmt"
 	"time"
 )
 
 // Scope
 const (
-	ScopeAuth = "authentication"
+	ScopeAuth              = "authentication"
+	ScopePasswordReset     = "password_reset"
+	ScopeEmailVerification = "email_verification"
+	ScopeTwoFactorPending  = "2fa_pending" // Password was right, waiting for the second factor
+	ScopeRefresh           = "refresh"     // Long-lived, only good for getting a new authentication token
 )
 
 type Token struct {
@@ -18,6 +23,9 @@ type Token struct {
 	UserID    int       `json:"-"`      // ID of the user the token is associated with
 	Expiry    time.Time `json:"expiry"` // Unix timestamp
 	Scope     string    `json:"-"`      // e.g., "authentication", "password_reset". Different levels of access, etc
+	UserAgent string    `json:"-"`      // Client that logged in, shown in the session list
+	IP        string    `json:"-"`      // Address the login came from
+	SessionID string    `json:"-"`      // Shared by the access and refresh tokens of one login. Empty gets a new one
 }
 
 func GenerateToken(userID int, ttl time.Duration, scope string) (*Token, error) {
@@ -32,17 +40,67 @@ func GenerateToken(userID int, ttl time.Duration, scope string) (*Token, error)
 		Scope:  scope,
 	}
 
-	emptyBytes := make([]byte, 16) // Placeholder for random bytes
-	_, err := rand.Read(emptyBytes)
+	plaintext, err := randomPlaintext()
 	if err != nil {
 		return nil, err
 	}
 
-	// Encode to base32 to get a user-friendly string
-	token.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(emptyBytes)
-	hash := sha256.Sum256([]byte(token.Plaintext)) // Hash the plaintext token using SHA-256
-	token.Hash = hash[:]
+	token.Plaintext = plaintext
+	token.Hash = Hash(plaintext) // Hash the plaintext token using SHA-256
 
 	return token, nil
 
+}
+
+// GenerateSlug creates an unguessable identifier for public share links, the same way tokens are generated.
+// Only the hash should be stored; the plaintext goes into the URL handed to the user.
+func GenerateSlug() (plaintext string, hash []byte, err error) {
+	plaintext, err = randomPlaintext()
+	if err != nil {
+		return "", nil, err
+	}
+	return plaintext, Hash(plaintext), nil
+}
+
+// NewSessionID returns a random (version 4) UUID, used to tie the tokens of one login together.
+func NewSessionID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// Personal access tokens start with this so Authenticate can tell them apart from login tokens
+const PersonalAccessTokenPrefix = "pat_"
+
+// GeneratePersonalAccessToken creates the secret for a long-lived API token. Only the hash should be stored.
+func GeneratePersonalAccessToken() (plaintext string, hash []byte, err error) {
+	random, err := randomPlaintext()
+	if err != nil {
+		return "", nil, err
+	}
+	plaintext = PersonalAccessTokenPrefix + random
+	return plaintext, Hash(plaintext), nil
+}
+
+// Hash returns the SHA-256 hash of a token or slug plaintext, as stored in the database.
+func Hash(plaintext string) []byte {
+	hash := sha256.Sum256([]byte(plaintext))
+	return hash[:]
+}
+
+// randomPlaintext returns 16 random bytes encoded as unpadded base32.
+func randomPlaintext() (string, error) {
+	emptyBytes := make([]byte, 16) // Placeholder for random bytes
+	_, err := rand.Read(emptyBytes)
+	if err != nil {
+		return "", err
+	}
+
+	// Encode to base32 to get a user-friendly string
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(emptyBytes), nil
 }
\ No newline at end of file
@@ -0,0 +1,138 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// The ASCII secret "12345678901234567890" of the RFC 6238 test vectors, base32 encoded
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeMatchesRFC6238(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1. The RFC gives 8 digits, the last 6 are the 6-digit codes.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, tt := range tests {
+		want := tt.want[len(tt.want)-Digits:]
+		got, err := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatalf("Code: %v", err)
+		}
+		if got != want {
+			t.Errorf("at %d: expected %s, got %s", tt.unix, want, got)
+		}
+	}
+}
+
+func TestCodeAcceptsLowerCaseSecrets(t *testing.T) {
+	got, err := Code(strings.ToLower(rfcSecret), Step(time.Unix(59, 0)))
+	if err != nil || got != "287082" {
+		t.Errorf("expected 287082, got %q (%v)", got, err)
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+
+	tests := []struct {
+		offset int64 // steps between the code and now
+		valid  bool
+	}{
+		{-2, false},
+		{-1, true},
+		{0, true},
+		{1, true},
+		{2, false},
+	}
+
+	for _, tt := range tests {
+		codeStep := Step(now) + tt.offset
+		code, err := Code(rfcSecret, codeStep)
+		if err != nil {
+			t.Fatalf("Code: %v", err)
+		}
+		step, ok := Validate(rfcSecret, code, now)
+		if ok != tt.valid {
+			t.Errorf("code %+d steps away: expected valid=%v, got %v", tt.offset, tt.valid, ok)
+		}
+		if ok && step != codeStep {
+			t.Errorf("code %+d steps away: expected step %d, got %d", tt.offset, codeStep, step)
+		}
+	}
+}
+
+func TestValidateReturnsTheSameStepForTheSameCode(t *testing.T) {
+	// What the replay guard keys on: within its window a code always maps to the step it was made for
+	now := time.Unix(1234567890, 0)
+	code, _ := Code(rfcSecret, Step(now))
+
+	first, _ := Validate(rfcSecret, code, now)
+	second, ok := Validate(rfcSecret, code, now.Add(Period))
+	if !ok || second != first {
+		t.Errorf("expected step %d both times, got %d (valid=%v)", first, second, ok)
+	}
+}
+
+func TestValidateInput(t *testing.T) {
+	now := time.Unix(59, 0)
+
+	tests := []struct {
+		name  string
+		code  string
+		valid bool
+	}{
+		{"exact", "287082", true},
+		{"spaces", " 287 082 ", true},
+		{"wrong code", "287083", false},
+		{"too short", "28708", false},
+		{"too long", "2870820", false},
+		{"8 digit code", "94287082", false},
+		{"empty", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ok := Validate(rfcSecret, tt.code, now)
+			if ok != tt.valid {
+				t.Errorf("expected valid=%v, got %v", tt.valid, ok)
+			}
+		})
+	}
+
+	if _, ok := Validate("not base32!", "287082", now); ok {
+		t.Error("expected an invalid secret to validate nothing")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(10)
+	if err != nil {
+		t.Fatalf("GenerateRecoveryCodes: %v", err)
+	}
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if len(code) != 11 || code[5] != '-' {
+			t.Errorf("expected a code like ABCDE-FGHIJ, got %q", code)
+		}
+		if seen[code] {
+			t.Errorf("duplicate code %q", code)
+		}
+		seen[code] = true
+
+		typed := strings.ToLower(code[:5]) + " " + code[6:]
+		if NormalizeRecoveryCode(typed) != NormalizeRecoveryCode(code) {
+			t.Errorf("expected %q to normalize like %q", typed, code)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	// Marshaling and Unmarshaling JSON
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"strconv"
 
@@ -42,6 +43,19 @@ func ReadIDParam(r *http.Request, param string) (int64, error) {
 	return id, nil
 }
 
+// ReadIntQueryParam reads an optional integer from the query string, falling back to defaultValue when it is absent.
+func ReadIntQueryParam(r *http.Request, param string, defaultValue int) (int, error) {
+	value := r.URL.Query().Get(param)
+	if value == "" {
+		return defaultValue, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s parameter", param)
+	}
+	return i, nil
+}
+
 func StringInSlice(str string, list []string) bool {
 	for _, v := range list {
 		if v == str {
@@ -50,3 +64,12 @@ func StringInSlice(str string, list []string) bool {
 	}
 	return false
 }
+
+// ClientIP returns the address the request came from, without the port.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,266 @@
+// Package websocket is a small server-side WebSocket (RFC 6455) implementation.
+// It only does what the event stream needs: text messages out, pings, and handling the client's control frames.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fixed GUID from the RFC, used to compute Sec-WebSocket-Accept
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Frame opcodes
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Close codes
+const (
+	CloseNormal      = 1000
+	CloseGoingAway   = 1001
+	CloseProtocol    = 1002
+	CloseTooLarge    = 1009
+	closeNoStatus    = 1005
+	maxControlLength = 125
+)
+
+// Largest message accepted from the client. We do not expect any, so keep it small.
+const maxMessageSize = 64 * 1024
+
+// How long a single write may take
+const writeTimeout = 10 * time.Second
+
+var ErrClosed = errors.New("websocket: connection closed")
+
+// Conn is an upgraded connection. Writes are safe from multiple goroutines; reads must happen on one.
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	writeMu sync.Mutex
+	closed  bool
+}
+
+// IsUpgradeRequest reports whether r asks for a WebSocket.
+func IsUpgradeRequest(r *http.Request) bool {
+	return headerContainsToken(r.Header, "Connection", "upgrade") && headerContainsToken(r.Header, "Upgrade", "websocket")
+}
+
+// Upgrade performs the opening handshake. On failure it has already written an error response.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, errors.New("websocket: method is not GET")
+	}
+	if !IsUpgradeRequest(r) {
+		http.Error(w, "websocket upgrade required", http.StatusUpgradeRequired)
+		return nil, errors.New("websocket: not an upgrade request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("websocket: unsupported version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("websocket: missing key")
+	}
+
+	netConn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, err
+	}
+	// The server's read/write timeouts still apply to a hijacked connection
+	netConn.SetDeadline(time.Time{})
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	_, err = rw.WriteString(response)
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+
+	return &Conn{conn: netConn, reader: rw.Reader}, nil
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WriteText sends one text message.
+func (c *Conn) WriteText(data []byte) error {
+	return c.writeFrame(opText, data)
+}
+
+// Ping sends a ping; the client answers with a pong that ReadLoop consumes.
+func (c *Conn) Ping() error {
+	return c.writeFrame(opPing, nil)
+}
+
+// Close sends a close frame with the given code and closes the connection.
+func (c *Conn) Close(code int) error {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	c.writeFrame(opClose, payload)
+
+	c.writeMu.Lock()
+	c.closed = true
+	c.writeMu.Unlock()
+	return c.conn.Close()
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+
+	// Server frames are never masked
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode // FIN
+	switch n := len(payload); {
+	case n <= 125:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := c.conn.Write(append(header, payload...))
+	return err
+}
+
+// ReadLoop reads frames until the connection ends, answering pings and close frames.
+// Messages from the client are discarded. It returns nil when the client closed the connection normally.
+func (c *Conn) ReadLoop() error {
+	for {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			var tooLarge errTooLarge
+			if errors.As(err, &tooLarge) {
+				c.Close(CloseTooLarge)
+			} else {
+				c.conn.Close()
+			}
+			return err
+		}
+
+		switch opcode {
+		case opPing:
+			err = c.writeFrame(opPong, payload)
+			if err != nil {
+				return err
+			}
+		case opClose:
+			code := closeNoStatus
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			if code == closeNoStatus {
+				code = CloseNormal
+			}
+			c.Close(code)
+			return nil
+		case opPong, opText, opBinary, opContinuation:
+			// Nothing to do
+		default:
+			c.Close(CloseProtocol)
+			return errors.New("websocket: unknown opcode")
+		}
+	}
+}
+
+type errTooLarge struct{}
+
+func (errTooLarge) Error() string { return "websocket: message too large" }
+
+func (c *Conn) readFrame() (byte, []byte, error) {
+	var head [2]byte
+	_, err := io.ReadFull(c.reader, head[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	opcode := head[0] & 0x0F
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7F)
+
+	if !masked {
+		return 0, nil, errors.New("websocket: client frames must be masked")
+	}
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(c.reader, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(c.reader, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if opcode >= opClose && length > maxControlLength {
+		return 0, nil, errors.New("websocket: control frame too long")
+	}
+	if length > maxMessageSize {
+		return 0, nil, errTooLarge{}
+	}
+
+	var mask [4]byte
+	_, err = io.ReadFull(c.reader, mask[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(c.reader, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"log/slog"
 	"net/http"
-	"time"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/app"
+	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/config"
 	"github.com/OlivierCoq/notes_app/api/notes_app_api/internal/routes"
 )
 
@@ -15,24 +21,31 @@ import (
 
 func main() { 
 
-	var port int
-
-	flag.IntVar(&port, "port", 8080, "Port to run the server on")
-	flag.Parse()
+	// Settings come from flags, NOTES_* environment variables and an optional -config file. Run with -h to list them.
+	cfg, err := config.Load(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(2)
+	}
 
 
 	// Initialize the application (taken from internal/app/app.go):
-	app, err := app.NewApplication()
+	app, err := app.NewApplication(cfg)
 	if err != nil {
 		// Worst case scenario, we panic here with the error. Will crash the app
 		panic(err)
 	}
 	// Log that the app has started
-	app.Logger.Println("Notes app api started. Werk it! 🚀")
+	app.Logger.Info("Notes app api started. Werk it! 🚀")
 
-	// Database connection:
-defer app.DB.Close()
+	// The effective configuration, secrets redacted
+	app.Logger.Info("Configuration", "config", app.Config)
 
+// Background workers, stopped by app.Shutdown
+	app.Start()
 
 // Routes and Handlers setup
 
@@ -45,20 +58,71 @@ defer app.DB.Close()
 
 	// declare a new server with specific configurations
 	server := &http.Server{
-		Addr:         fmt.Sprintf(":%d", port), // returns variable port as a string with a colon in front of it
-		IdleTimeout:  time.Minute,              // how long to wait before closing idle connections
-		ReadTimeout:  10 * time.Second,         // max duration for reading the entire request, including the body
-		WriteTimeout: 30 * time.Second,         // max duration before timing out writes of the response
+		Addr:         fmt.Sprintf(":%d", cfg.Port), // returns variable port as a string with a colon in front of it
+		IdleTimeout:  cfg.IdleTimeout,              // how long to wait before closing idle connections
+		ReadTimeout:  cfg.ReadTimeout,              // max duration for reading the entire request, including the body
+		WriteTimeout: cfg.WriteTimeout,             // max duration before timing out writes of the response
+		ErrorLog:     slog.NewLogLogger(app.Logger.Handler(), slog.LevelError), // connection errors, in the JSON logs
 	}
 
 
+	// Streams would keep Shutdown waiting until the timeout
+	server.RegisterOnShutdown(app.EventHandler.Shutdown)
+
 // Start the server
-	app.Logger.Printf("Starting server on port %d\n", port)
-	err = server.ListenAndServe()
-	// Wait for crashes or shutdown. Always fail first.
+	app.Logger.Info("Starting server", "port", cfg.Port)
+	serverErr := make(chan error, 2)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	// Metrics on their own address, typically one only Prometheus can reach
+	var metricsServer *http.Server
+	if cfg.MetricsAddr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("GET /metrics", app.Metrics.Handler(cfg.MetricsToken))
+		metricsServer = &http.Server{
+			Addr:         cfg.MetricsAddr,
+			Handler:      metricsMux,
+			ReadTimeout:  cfg.ReadTimeout,
+			WriteTimeout: cfg.WriteTimeout,
+			ErrorLog:     slog.NewLogLogger(app.Logger.Handler(), slog.LevelError),
+		}
+		app.Logger.Info("Serving metrics", "addr", cfg.MetricsAddr)
+		go func() {
+			serverErr <- metricsServer.ListenAndServe()
+		}()
+	}
+
+	// Run until stopped (Ctrl+C, or SIGTERM from a deploy) or until the server fails
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	select {
+	case sig := <-stop:
+		app.Logger.Info("Shutting down", "signal", sig.String())
+	case err := <-serverErr:
+		app.Logger.Error("Server error", "error", err)
+	}
+	signal.Stop(stop)
+
+	// Stop taking new connections and let in-flight requests finish, then stop the workers and close the database.
+	// Each step gets its own timeout, so slow requests cannot leave the mail and workers no time at all.
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancelDrain()
+	err = server.Shutdown(drainCtx)
+	if err != nil {
+		app.Logger.Error("Error draining requests", "error", err)
+	}
+	if metricsServer != nil {
+		metricsServer.Shutdown(drainCtx)
+	}
+
+	appCtx, cancelApp := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancelApp()
+	err = app.Shutdown(appCtx)
 	if err != nil {
-		app.Logger.Println(err)
+		app.Logger.Error("Error shutting down", "error", err)
 	}
-	app.Logger.Println("Application stopped. Bye! 👋") 
+	app.Logger.Info("Application stopped. Bye! 👋")
 
-}
\ No newline at end of file
+}
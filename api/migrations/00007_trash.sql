@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- Soft deletion. deleted_by_folder_id is set on rows that were trashed because a parent folder was,
+-- so restoring that folder can bring back exactly what went with it.
+ALTER TABLE folders
+    ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN IF NOT EXISTS deleted_by_folder_id INTEGER;
+
+ALTER TABLE notes
+    ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN IF NOT EXISTS deleted_by_folder_id INTEGER;
+
+CREATE INDEX IF NOT EXISTS idx_folders_deleted_at ON folders (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_notes_deleted_at ON notes (deleted_at) WHERE deleted_at IS NOT NULL;
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idx_notes_deleted_at;
+DROP INDEX IF EXISTS idx_folders_deleted_at;
+ALTER TABLE notes DROP COLUMN IF EXISTS deleted_by_folder_id, DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE folders DROP COLUMN IF EXISTS deleted_by_folder_id, DROP COLUMN IF EXISTS deleted_at;
+-- +goose StatementEnd
@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- A share gives another user access to either a single note or a whole folder (and everything under it).
+CREATE TABLE IF NOT EXISTS note_shares (
+    id SERIAL PRIMARY KEY,
+    owner_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    shared_with_user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    note_id INTEGER REFERENCES notes(id) ON DELETE CASCADE,
+    folder_id INTEGER REFERENCES folders(id) ON DELETE CASCADE,
+    permission VARCHAR(10) NOT NULL CHECK (permission IN ('viewer', 'editor')),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CHECK ((note_id IS NULL) <> (folder_id IS NULL)),
+    UNIQUE (note_id, shared_with_user_id),
+    UNIQUE (folder_id, shared_with_user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_note_shares_shared_with_user_id ON note_shares (shared_with_user_id);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS note_shares;
+-- +goose StatementEnd
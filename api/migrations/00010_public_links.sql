@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- Read-only links to a single note for people without an account.
+-- Only the SHA-256 hash of the slug is stored, same as tokens.
+CREATE TABLE IF NOT EXISTS public_links (
+    id SERIAL PRIMARY KEY,
+    note_id INTEGER NOT NULL REFERENCES notes(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    slug_hash BYTEA UNIQUE NOT NULL,
+    password_hash BYTEA,
+    expires_at TIMESTAMP WITH TIME ZONE,
+    max_views INTEGER,
+    view_count INTEGER NOT NULL DEFAULT 0,
+    revoked_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_public_links_note_id ON public_links (note_id);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS public_links;
+-- +goose StatementEnd
@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Ids for real-time events, shared by every API instance so Last-Event-ID means the same thing everywhere
+CREATE SEQUENCE IF NOT EXISTS event_ids;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP SEQUENCE IF EXISTS event_ids;
+-- +goose StatementEnd
@@ -0,0 +1,30 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- TOTP enrollment, one row per user. The row exists but enabled_at is NULL between setup and confirm.
+CREATE TABLE IF NOT EXISTS two_factor (
+    user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    secret TEXT NOT NULL,
+    enabled_at TIMESTAMP WITH TIME ZONE,
+    last_used_step BIGINT, -- the last accepted code, so a code cannot be used twice
+    failed_attempts INTEGER NOT NULL DEFAULT 0, -- wrong codes since the last accepted one
+    last_failed_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Single-use recovery codes, only the SHA-256 hash is stored
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash BYTEA NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    UNIQUE (user_id, code_hash)
+);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS recovery_codes;
+DROP TABLE IF EXISTS two_factor;
+-- +goose StatementEnd
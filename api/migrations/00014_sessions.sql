@@ -0,0 +1,27 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- Authentication tokens double as sessions. session_id is the public handle for a token, since the hash must stay secret.
+ALTER TABLE tokens
+    ADD COLUMN IF NOT EXISTS session_id UUID NOT NULL DEFAULT gen_random_uuid(),
+    ADD COLUMN IF NOT EXISTS created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    ADD COLUMN IF NOT EXISTS last_used_at TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN IF NOT EXISTS user_agent TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS ip TEXT NOT NULL DEFAULT '';
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_tokens_session_id ON tokens (session_id);
+CREATE INDEX IF NOT EXISTS idx_tokens_user_id_scope ON tokens (user_id, scope);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idx_tokens_user_id_scope;
+DROP INDEX IF EXISTS idx_tokens_session_id;
+ALTER TABLE tokens
+    DROP COLUMN IF EXISTS ip,
+    DROP COLUMN IF EXISTS user_agent,
+    DROP COLUMN IF EXISTS last_used_at,
+    DROP COLUMN IF EXISTS created_at,
+    DROP COLUMN IF EXISTS session_id;
+-- +goose StatementEnd
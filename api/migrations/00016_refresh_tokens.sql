@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- A login is now a family of tokens: access tokens and the refresh tokens that rotate them.
+-- They all share the session_id, which makes it the family id.
+DROP INDEX IF EXISTS idx_tokens_session_id;
+CREATE INDEX IF NOT EXISTS idx_tokens_session_id ON tokens (session_id);
+
+-- Rotated refresh tokens are kept (with used_at set) until they expire, so presenting one again can be detected
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS used_at TIMESTAMP WITH TIME ZONE;
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE tokens DROP COLUMN IF EXISTS used_at;
+DROP INDEX IF EXISTS idx_tokens_session_id;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_tokens_session_id ON tokens (session_id);
+-- +goose StatementEnd
@@ -0,0 +1,72 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- Who did what to which data, from where. user_id is whose account or data the event concerns,
+-- actor_id who did it (NULL when nobody was logged in, like a failed login). No foreign keys, so the
+-- trail outlives deleted users and data.
+CREATE TABLE IF NOT EXISTS audit_events (
+    id BIGSERIAL PRIMARY KEY,
+    actor_id INTEGER,
+    user_id INTEGER,
+    action VARCHAR(50) NOT NULL,
+    target_type VARCHAR(30) NOT NULL DEFAULT '',
+    target_id INTEGER,
+    ip TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    before JSONB,
+    after JSONB,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_events_user_id ON audit_events (user_id, id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_actor_id ON audit_events (actor_id, id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_target ON audit_events (target_type, target_id);
+
+-- The trail is append-only, even for the application's own database user
+CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_events_no_update_or_delete
+    BEFORE UPDATE OR DELETE ON audit_events
+    FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
+
+CREATE TRIGGER audit_events_no_truncate
+    BEFORE TRUNCATE ON audit_events
+    FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only();
+
+-- The admin audit trail becomes part of the general one
+INSERT INTO audit_events (actor_id, user_id, action, target_type, target_id, ip, after, created_at)
+SELECT admin_id, target_user_id, 'admin.' || action, 'user', target_user_id, ip, details, created_at
+FROM admin_actions
+ORDER BY id;
+
+DROP TABLE IF EXISTS admin_actions;
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS admin_actions (
+    id BIGSERIAL PRIMARY KEY,
+    admin_id INTEGER NOT NULL,
+    action VARCHAR(50) NOT NULL,
+    target_user_id INTEGER,
+    details JSONB NOT NULL DEFAULT '{}',
+    ip TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_admin_actions_target_user_id ON admin_actions (target_user_id);
+
+INSERT INTO admin_actions (admin_id, action, target_user_id, details, ip, created_at)
+SELECT actor_id, substring(action FROM 7), target_id, COALESCE(after, '{}'), ip, created_at
+FROM audit_events
+WHERE action LIKE 'admin.%'
+ORDER BY id;
+
+DROP TABLE IF EXISTS audit_events;
+DROP FUNCTION IF EXISTS audit_events_append_only();
+-- +goose StatementEnd